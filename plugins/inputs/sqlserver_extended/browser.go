@@ -0,0 +1,99 @@
+package sqlserver_extended
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// sqlBrowserPort is the UDP port of the SQL Server Browser service
+	sqlBrowserPort = "1434"
+	// browserTimeout bounds the lookup of an instance, as in the driver
+	browserTimeout = 5 * time.Second
+	// dacDefaultPort is the TCP port of the DAC of a default instance
+	dacDefaultPort = "1434"
+)
+
+// withoutInstance drops the named instance of a connection string with a
+// port, the driver would look up the port from the SQL Server Browser even
+// if one is given. Named instances without a port are left to the driver.
+func withoutInstance(dsn string) string {
+	params := parseConnectionString(dsn)
+	parts := strings.SplitN(serverName(params), `\`, 2)
+	if len(parts) < 2 || parts[1] == "" || params["port"] == "" {
+		return dsn
+	}
+	return withServer(dsn, parts[0])
+}
+
+// browserAddress returns the address of the SQL Server Browser of the host,
+// the local host can be given as "." and "(local)" as for the driver
+func browserAddress(host string) string {
+	if host == "." || strings.EqualFold(host, "(local)") || host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, sqlBrowserPort)
+}
+
+// queryBrowser sends the request to the SQL Server Browser at the address
+// and returns its response
+func queryBrowser(ctx context.Context, dialer contextDialer, addr, instance string, req []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, browserTimeout)
+	defer cancel()
+
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("querying SQL Server Browser at %s for instance %q failed: %v", addr, instance, err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	resp := make([]byte, 16*1024)
+	n := 0
+	if _, err = conn.Write(req); err == nil {
+		n, err = conn.Read(resp)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("SQL Server Browser at %s did not answer the lookup of instance %q, "+
+			"check that the SQL Server Browser service is running and UDP port %s is reachable: %v",
+			addr, instance, sqlBrowserPort, err)
+	}
+	return resp[:n], nil
+}
+
+// resolveDAC points the connection string to the Dedicated Admin Connection
+// of its server. The DAC of a default instance listens on TCP port 1434, the
+// one of a named instance is looked up from the SQL Server Browser.
+func resolveDAC(ctx context.Context, dialer contextDialer, dsn string) (string, error) {
+	parts := strings.SplitN(serverName(parseConnectionString(dsn)), `\`, 2)
+	host, port := parts[0], dacDefaultPort
+	if len(parts) == 2 && parts[1] != "" && !strings.EqualFold(parts[1], "MSSQLSERVER") {
+		var err error
+		if port, err = lookupDAC(ctx, dialer, browserAddress(host), parts[1]); err != nil {
+			return "", err
+		}
+	}
+	return withParams(withServer(withoutParams(dsn, "port"), host), map[string]string{"port": port}), nil
+}
+
+// lookupDAC queries the SQL Server Browser at the address for the TCP port
+// of the Dedicated Admin Connection of the instance
+func lookupDAC(ctx context.Context, dialer contextDialer, addr, instance string) (string, error) {
+	// CLNT_UCAST_DAC, protocol version 1 and the instance name
+	req := append([]byte{0x0f, 0x01}, instance...)
+	resp, err := queryBrowser(ctx, dialer, addr, instance, append(req, 0x00))
+	if err != nil {
+		return "", err
+	}
+	// SVR_RESP with a size of 6, protocol version 1 and the port
+	if len(resp) < 6 || resp[0] != 0x05 || resp[3] != 0x01 {
+		return "", fmt.Errorf("instance %q has no Dedicated Admin Connection at %s", instance, addr)
+	}
+	return strconv.Itoa(int(binary.LittleEndian.Uint16(resp[4:6]))), nil
+}
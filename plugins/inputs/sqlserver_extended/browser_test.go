@@ -0,0 +1,79 @@
+package sqlserver_extended
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sqlBrowser answers the DAC requests for instance INST1 with port 50124
+// until it is closed
+func sqlBrowser(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			switch {
+			case n > 2 && buf[0] == 0x0f && string(buf[2:n]) == "INST1\x00":
+				conn.WriteTo([]byte{0x05, 0x06, 0x00, 0x01, 0xcc, 0xc3}, addr)
+			case n > 2 && buf[0] == 0x0f:
+				conn.WriteTo([]byte{0x05, 0x00, 0x00}, addr)
+			}
+		}
+	}()
+	return conn
+}
+
+func TestWithoutInstance(t *testing.T) {
+	// servers without an instance are left untouched
+	assert.Equal(t, "Server=sql01;User Id=telegraf", withoutInstance("Server=sql01;User Id=telegraf"))
+
+	// instances with a port are connected to without the SQL Browser
+	assert.Equal(t, "Server=sql01;Port=50123;User Id=telegraf", withoutInstance(`Server=sql01\INST1;Port=50123;User Id=telegraf`))
+
+	// instances without a port are looked up by the driver
+	assert.Equal(t, `Server=sql01\INST1;User Id=telegraf`, withoutInstance(`Server=sql01\INST1;User Id=telegraf`))
+}
+
+func TestResolveDAC(t *testing.T) {
+	dsn, err := resolveDAC(context.Background(), &net.Dialer{}, "Server=sql01;Port=1433;User Id=telegraf")
+	require.NoError(t, err)
+	assert.Equal(t, "Server=sql01;User Id=telegraf;port=1434", dsn)
+
+	dsn, err = resolveDAC(context.Background(), &net.Dialer{}, `Server=sql01\MSSQLSERVER;User Id=telegraf`)
+	require.NoError(t, err)
+	assert.Equal(t, "Server=sql01;User Id=telegraf;port=1434", dsn)
+}
+
+func TestLookupDAC(t *testing.T) {
+	browser := sqlBrowser(t)
+	defer browser.Close()
+	addr := browser.LocalAddr().String()
+
+	port, err := lookupDAC(context.Background(), &net.Dialer{}, addr, "INST1")
+	require.NoError(t, err)
+	assert.Equal(t, "50124", port)
+
+	_, err = lookupDAC(context.Background(), &net.Dialer{}, addr, "INST2")
+	require.Error(t, err)
+}
+
+func TestLookupDACNoBrowser(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	_, err = lookupDAC(context.Background(), &net.Dialer{}, addr, "INST1")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "check that the SQL Server Browser service is running")
+}
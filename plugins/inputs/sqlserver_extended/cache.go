@@ -0,0 +1,93 @@
+package sqlserver_extended
+
+import (
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// cachedMetric is a metric added by a query run, kept for re-emitting
+type cachedMetric struct {
+	measurement string
+	fields      map[string]interface{}
+	tags        map[string]string
+}
+
+// cachedResult holds the metrics of the last successful run of a query on a
+// server
+type cachedResult struct {
+	created time.Time
+	metrics []cachedMetric
+}
+
+// resultCache keeps query results per server and query name
+type resultCache struct {
+	sync.Mutex
+	results map[string]map[string]*cachedResult
+}
+
+func newResultCache() *resultCache {
+	return &resultCache{results: make(map[string]map[string]*cachedResult)}
+}
+
+func (c *resultCache) store(server, query string, result *cachedResult) {
+	c.Lock()
+	defer c.Unlock()
+	if c.results[server] == nil {
+		c.results[server] = make(map[string]*cachedResult)
+	}
+	c.results[server][query] = result
+}
+
+// release drops the results of the servers
+func (c *resultCache) release(servers ...string) {
+	c.Lock()
+	defer c.Unlock()
+	for _, server := range servers {
+		delete(c.results, server)
+	}
+}
+
+// get returns the result of the query on the server unless it is older than
+// the ttl
+func (c *resultCache) get(server, query string, ttl time.Duration, now time.Time) *cachedResult {
+	c.Lock()
+	defer c.Unlock()
+	result := c.results[server][query]
+	if result == nil || now.Sub(result.created) > ttl {
+		return nil
+	}
+	return result
+}
+
+// recordingAccumulator passes the metrics to the accumulator and records
+// them for the cache
+type recordingAccumulator struct {
+	telegraf.Accumulator
+
+	sync.Mutex
+	metrics []cachedMetric
+}
+
+func (a *recordingAccumulator) AddFields(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	a.Lock()
+	a.metrics = append(a.metrics, cachedMetric{measurement: measurement, fields: fields, tags: tags})
+	a.Unlock()
+	a.Accumulator.AddFields(measurement, fields, tags, t...)
+}
+
+// replay adds the cached metrics to the accumulator with the current time
+func (r *cachedResult) replay(acc telegraf.Accumulator, now time.Time) {
+	for _, m := range r.metrics {
+		fields := make(map[string]interface{}, len(m.fields))
+		for k, v := range m.fields {
+			fields[k] = v
+		}
+		tags := make(map[string]string, len(m.tags))
+		for k, v := range m.tags {
+			tags[k] = v
+		}
+		acc.AddFields(m.measurement, fields, tags, now)
+	}
+}
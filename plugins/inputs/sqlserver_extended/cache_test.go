@@ -0,0 +1,54 @@
+package sqlserver_extended
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSqlServerExtended_CacheTTL(t *testing.T) {
+	s := &SQLServerExtended{
+		Query: []QueryConfig{
+			{
+				Name:     "backups",
+				Script:   "SELECT 1",
+				Interval: internal.Duration{Duration: time.Hour},
+				CacheTTL: internal.Duration{Duration: 30 * time.Minute},
+			},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	query := s.queries["backups"]
+
+	// record the metrics of a run as gatherCached does
+	var acc testutil.Accumulator
+	recorder := &recordingAccumulator{Accumulator: &acc}
+	rows := &mockResults{sets: []mockResultSet{{
+		columns: []string{"database", "field_age"},
+		rows:    []mockRow{{"db1", int64(3)}},
+	}}}
+	_, err := s.accResults(query, recorder, rows)
+	require.NoError(t, err)
+	start := time.Now()
+	s.cache.store("server", query.Name, &cachedResult{created: start, metrics: recorder.metrics})
+
+	acc.ClearMetrics()
+	now := start.Add(10 * time.Minute)
+	s.replayCached("server", []Query{query}, now, &acc)
+	acc.AssertContainsTaggedFields(t, "sqlserver_extended",
+		map[string]interface{}{"age": int64(3)},
+		map[string]string{"database": "db1", "query_name": "backups"})
+	require.Len(t, acc.Metrics, 1)
+	assert.Equal(t, now, acc.Metrics[0].Time)
+
+	// results of other servers and expired results are not re-emitted
+	acc.ClearMetrics()
+	s.replayCached("other", []Query{query}, now, &acc)
+	s.replayCached("server", []Query{query}, start.Add(time.Hour), &acc)
+	assert.Empty(t, acc.Metrics)
+}
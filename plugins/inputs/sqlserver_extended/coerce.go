@@ -0,0 +1,152 @@
+package sqlserver_extended
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Types of the convert option
+const (
+	typeFloat  = "float"
+	typeInt    = "int"
+	typeUint   = "uint"
+	typeBool   = "bool"
+	typeString = "string"
+)
+
+// isCoerceType reports whether the type is valid in the convert option
+func isCoerceType(t string) bool {
+	switch t {
+	case typeFloat, typeInt, typeUint, typeBool, typeString:
+		return true
+	}
+	return false
+}
+
+// coerce forces the value into the given type so that the field type does
+// not change between rows, e.g. for outputs rejecting field type conflicts
+func coerce(value interface{}, t string) (interface{}, error) {
+	switch t {
+	case typeFloat:
+		return toFloat(value)
+	case typeInt:
+		return toInt(value)
+	case typeUint:
+		return toUint(value)
+	case typeBool:
+		return toBool(value)
+	case typeString:
+		return toString(value), nil
+	}
+	return value, nil
+}
+
+func toFloat(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case bool:
+		if v {
+			return float64(1), nil
+		}
+		return float64(0), nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return nil, fmt.Errorf("can not convert %T to float", value)
+}
+
+func toInt(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case uint64:
+		if v > math.MaxInt64 {
+			return nil, fmt.Errorf("value %d is out of the integer range", v)
+		}
+		return int64(v), nil
+	case float64:
+		if v < math.MinInt64 || v >= math.MaxInt64 || math.IsNaN(v) {
+			return nil, fmt.Errorf("value %v is out of the integer range", v)
+		}
+		return int64(v), nil
+	case bool:
+		if v {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case string:
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return n, nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("can not convert %q to integer", v)
+		}
+		return toInt(f)
+	}
+	return nil, fmt.Errorf("can not convert %T to integer", value)
+}
+
+func toUint(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case uint64:
+		return v, nil
+	case int64:
+		if v < 0 {
+			return nil, fmt.Errorf("negative value %d is out of the unsigned range", v)
+		}
+		return uint64(v), nil
+	case float64:
+		if v < 0 || v >= math.MaxUint64 || math.IsNaN(v) {
+			return nil, fmt.Errorf("value %v is out of the unsigned range", v)
+		}
+		return uint64(v), nil
+	case bool:
+		if v {
+			return uint64(1), nil
+		}
+		return uint64(0), nil
+	case string:
+		if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+			return n, nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("can not convert %q to unsigned", v)
+		}
+		return toUint(f)
+	}
+	return nil, fmt.Errorf("can not convert %T to unsigned", value)
+}
+
+func toBool(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case int64:
+		return v != 0, nil
+	case uint64:
+		return v != 0, nil
+	case float64:
+		return v != 0, nil
+	case string:
+		return strconv.ParseBool(v)
+	}
+	return nil, fmt.Errorf("can not convert %T to bool", value)
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,91 @@
+package sqlserver_extended
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoerce(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		t        string
+		expected interface{}
+	}{
+		{value: int64(3), t: typeFloat, expected: float64(3)},
+		{value: "1.5", t: typeFloat, expected: 1.5},
+		{value: true, t: typeFloat, expected: float64(1)},
+		{value: 2.9, t: typeInt, expected: int64(2)},
+		{value: "42", t: typeInt, expected: int64(42)},
+		{value: "4.2e1", t: typeInt, expected: int64(42)},
+		{value: uint64(7), t: typeInt, expected: int64(7)},
+		{value: int64(7), t: typeUint, expected: uint64(7)},
+		{value: "18446744073709551615", t: typeUint, expected: uint64(math.MaxUint64)},
+		{value: int64(0), t: typeBool, expected: false},
+		{value: "true", t: typeBool, expected: true},
+		{value: 0.25, t: typeString, expected: "0.25"},
+		{value: int64(-3), t: typeString, expected: "-3"},
+		{value: false, t: typeString, expected: "false"},
+	}
+	for _, tt := range tests {
+		actual, err := coerce(tt.value, tt.t)
+		require.NoError(t, err, "%v to %s", tt.value, tt.t)
+		assert.Equal(t, tt.expected, actual, "%v to %s", tt.value, tt.t)
+	}
+
+	for _, tt := range []struct {
+		value interface{}
+		t     string
+	}{
+		{value: "abc", t: typeFloat},
+		{value: uint64(math.MaxUint64), t: typeInt},
+		{value: 1e20, t: typeInt},
+		{value: int64(-1), t: typeUint},
+		{value: "yes please", t: typeBool},
+	} {
+		_, err := coerce(tt.value, tt.t)
+		require.Error(t, err, "%v to %s", tt.value, tt.t)
+	}
+}
+
+func TestConvertCoerce(t *testing.T) {
+	query := Query{Convert: map[string]string{"field_cpu": typeFloat}, NullHandling: nullString}
+
+	value, err := query.convert("field_cpu", int64(12), "INT")
+	require.NoError(t, err)
+	assert.Equal(t, float64(12), value)
+
+	value, err = query.convert("field_cpu", []byte("12.5"), "DECIMAL")
+	require.NoError(t, err)
+	assert.Equal(t, 12.5, value)
+
+	// replaced NULL values are not converted
+	value, err = query.convert("field_cpu", nil, "INT")
+	require.NoError(t, err)
+	assert.Equal(t, "NULL", value)
+}
+
+func TestConvertCoerceNullZero(t *testing.T) {
+	query := Query{
+		Convert:      map[string]string{"field_cpu": typeFloat, "field_state": typeInt, "field_online": typeBool, "field_id": typeString},
+		NullHandling: nullZero,
+	}
+
+	tests := []struct {
+		column   string
+		dbType   string
+		expected interface{}
+	}{
+		{column: "field_cpu", dbType: "INT", expected: float64(0)},
+		{column: "field_state", dbType: "NVARCHAR", expected: int64(0)},
+		{column: "field_online", dbType: "VARCHAR", expected: false},
+		{column: "field_id", dbType: "BIGINT", expected: "0"},
+	}
+	for _, tt := range tests {
+		value, err := query.convert(tt.column, nil, tt.dbType)
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, value, tt.column)
+	}
+}
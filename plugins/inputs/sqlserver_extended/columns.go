@@ -0,0 +1,438 @@
+package sqlserver_extended
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/influxdata/telegraf/filter"
+	"github.com/influxdata/telegraf/internal"
+)
+
+// defaultMeasurementColumn is the column holding the measurement name unless
+// set otherwise by measurement_column
+const defaultMeasurementColumn = "measurement"
+
+// defaultFieldPrefix marks the columns collected as fields unless set
+// otherwise by field_prefix or the fields are given by field_columns
+const defaultFieldPrefix = "field_"
+
+// columnRoles decides which columns of the results become tags and fields.
+// Without explicit lists, string and BIT columns are tags and columns
+// starting with the field prefix are fields. Without a prefix all numeric
+// columns are fields.
+type columnRoles struct {
+	tags   filter.Filter
+	fields filter.Filter
+	// prefix is the field prefix, "field_" if nil
+	prefix *string
+	// trim keeps the full column name following the prefix as field name
+	trim bool
+}
+
+// Modes of field_name_mode
+const (
+	fieldNameLegacy = "legacy"
+	fieldNameTrim   = "trim"
+)
+
+// newColumnRoles compiles the tag_columns and field_columns of a query
+func newColumnRoles(tags, fields []string, prefix, nameMode string) (columnRoles, error) {
+	roles := columnRoles{prefix: &prefix}
+	switch nameMode {
+	case "", fieldNameLegacy:
+	case fieldNameTrim:
+		roles.trim = true
+	default:
+		return roles, fmt.Errorf("invalid field_name_mode %q", nameMode)
+	}
+	var err error
+	if len(tags) > 0 {
+		if roles.tags, err = filter.Compile(tags); err != nil {
+			return roles, fmt.Errorf("invalid tag_columns: %v", err)
+		}
+	}
+	if len(fields) > 0 {
+		if roles.fields, err = filter.Compile(fields); err != nil {
+			return roles, fmt.Errorf("invalid field_columns: %v", err)
+		}
+	}
+	return roles, nil
+}
+
+// isTag reports whether the column holding the value is a tag
+func (r columnRoles) isTag(column string, value interface{}) bool {
+	if r.tags != nil {
+		return r.tags.Match(column)
+	}
+	if _, ok := tagValue(value); !ok {
+		return false
+	}
+	return !r.isField(column, value)
+}
+
+// tagValue returns the tag value of a column value, BIT columns are tagged
+// with "true" and "false"
+func tagValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+// isField reports whether the column holding the value is a field
+func (r columnRoles) isField(column string, value interface{}) bool {
+	if r.fields != nil {
+		return r.fields.Match(column)
+	}
+	if r.tags != nil && r.tags.Match(column) {
+		return false
+	}
+	if prefix := r.fieldPrefix(); prefix != "" {
+		return strings.HasPrefix(column, prefix)
+	}
+	switch value.(type) {
+	case int64, uint64, float64:
+		return true
+	}
+	return false
+}
+
+// fieldPrefix returns the prefix of the field columns
+func (r columnRoles) fieldPrefix() string {
+	if r.prefix == nil {
+		return defaultFieldPrefix
+	}
+	return *r.prefix
+}
+
+// fieldName returns the name of the field of the column, the part following
+// the field prefix. The legacy mode stops at the next underscore, turning
+// "field_page_life_expectancy" into "page".
+func (r columnRoles) fieldName(column string) string {
+	prefix := r.fieldPrefix()
+	if prefix == "" || !strings.HasPrefix(column, prefix) {
+		return column
+	}
+	name := strings.TrimPrefix(column, prefix)
+	if r.trim {
+		return name
+	}
+	return strings.Split(name, "_")[0]
+}
+
+// fieldName returns the name of the field of the column, as given by rename
+// or by the column roles
+func (q *Query) fieldName(column string) string {
+	if name, ok := q.Rename[column]; ok {
+		return name
+	}
+	return q.Columns.fieldName(column)
+}
+
+// tagName returns the key of the tag of the column, as given by rename or the
+// column name
+func (q *Query) tagName(column string) string {
+	if name, ok := q.Rename[column]; ok {
+		return name
+	}
+	return column
+}
+
+// Formats of datetime_formats
+const (
+	datetimeTime    = "time"
+	datetimeRFC3339 = "rfc3339"
+)
+
+// isDatetimeFormat reports whether the format is valid in datetime_formats
+func isDatetimeFormat(format string) bool {
+	switch format {
+	case datetimeTime, datetimeRFC3339, "unix", "unix_ms", "unix_us", "unix_ns":
+		return true
+	}
+	return false
+}
+
+// location returns the timezone of times without an offset
+func (q *Query) location() *time.Location {
+	if q.TimeLocation == nil {
+		return time.UTC
+	}
+	return q.TimeLocation
+}
+
+// localize returns the time of a date and time column. The driver returns
+// the types without an offset as UTC, their wall clock is in the configured
+// timezone.
+func (q *Query) localize(t time.Time) time.Time {
+	if t.Location() != time.UTC {
+		return t
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), q.location())
+}
+
+// rowTime returns the time held by the time column, now if it is NULL
+func (q *Query) rowTime(value interface{}, now time.Time) (time.Time, error) {
+	switch v := value.(type) {
+	case nil:
+		return now, nil
+	case time.Time:
+		return q.localize(v), nil
+	case string, int64, float64:
+		if q.TimeFormat == "" {
+			return time.Time{}, fmt.Errorf("time column %q holds a %T, time_format is required", q.TimeColumn, value)
+		}
+		t, err := internal.ParseTimestamp(q.TimeFormat, v, q.location().String())
+		if err != nil {
+			return time.Time{}, fmt.Errorf("parsing time column %q failed: %v", q.TimeColumn, err)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("time column %q is of unsupported type %T", q.TimeColumn, value)
+}
+
+// Policies of null_handling
+const (
+	nullSkip   = "skip"
+	nullZero   = "zero"
+	nullString = "string"
+)
+
+// nullValue is collected for NULL values with the "string" null_handling
+const nullValue = "NULL"
+
+// columnTyper is implemented by *sql.Rows
+type columnTyper interface {
+	ColumnTypes() ([]*sql.ColumnType, error)
+}
+
+// columnTypes returns the database type names of the columns of the current
+// result set, nil if they are not available
+func columnTypes(rows resultSet) ([]string, error) {
+	typer, ok := rows.(columnTyper)
+	if !ok {
+		return nil, nil
+	}
+	types, err := typer.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(types))
+	for _, t := range types {
+		names = append(names, t.DatabaseTypeName())
+	}
+	return names, nil
+}
+
+// columnType returns the database type name of the i-th column, empty if it
+// is not known
+func (q *Query) columnType(i int) string {
+	if i < len(q.ColumnTypes) {
+		return q.ColumnTypes[i]
+	}
+	return ""
+}
+
+// convert converts the value of a column of the given database type into
+// the value collected, nil if the column is left out
+func (q *Query) convert(column string, value interface{}, dbType string) (interface{}, error) {
+	if value == nil {
+		switch q.NullHandling {
+		case nullZero:
+			return q.coercedZeroValue(column, dbType)
+		case nullString:
+			return nullValue, nil
+		}
+		return nil, nil
+	}
+	if t, ok := q.Convert[column]; ok {
+		converted, err := q.convertType(column, value, dbType)
+		if err != nil || converted == nil {
+			return converted, err
+		}
+		return coerce(converted, t)
+	}
+	return q.convertType(column, value, dbType)
+}
+
+// convertType converts a non-NULL value by the database type of its column
+func (q *Query) convertType(column string, value interface{}, dbType string) (interface{}, error) {
+	if t, ok := value.(time.Time); ok {
+		return q.convertDatetime(column, t), nil
+	}
+	if q.UnsignedColumns != nil && q.UnsignedColumns.Match(column) {
+		return convertUnsigned(value, dbType)
+	}
+
+	switch dbType {
+	case "DECIMAL", "NUMERIC", "MONEY", "SMALLMONEY":
+		return q.convertDecimal(value)
+	case "UNIQUEIDENTIFIER":
+		return convertGUID(value)
+	case "BINARY", "VARBINARY", "IMAGE":
+		return q.convertBinary(column, value), nil
+	}
+	return value, nil
+}
+
+// convertUnsigned converts integers, decimals and binary values of up to
+// eight bytes such as rowversions into unsigned integers. Values out of range
+// are reported instead of being wrapped.
+func convertUnsigned(value interface{}, dbType string) (interface{}, error) {
+	switch v := value.(type) {
+	case int64:
+		if v < 0 {
+			return nil, fmt.Errorf("negative value %d is out of the unsigned range", v)
+		}
+		return uint64(v), nil
+	case float64:
+		if v < 0 || v >= math.MaxUint64 || v != math.Trunc(v) {
+			return nil, fmt.Errorf("value %v is out of the unsigned range", v)
+		}
+		return uint64(v), nil
+	case []byte:
+		if dbType == "BINARY" || dbType == "VARBINARY" {
+			if len(v) > 8 {
+				return nil, fmt.Errorf("binary value of %d bytes is out of the unsigned range", len(v))
+			}
+			var n uint64
+			for _, b := range v {
+				n = n<<8 | uint64(b)
+			}
+			return n, nil
+		}
+		// decimals are returned as strings
+		n, err := strconv.ParseUint(string(v), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("value %s is not an unsigned 64-bit integer", v)
+		}
+		return n, nil
+	}
+	return value, nil
+}
+
+// Encodings of binary_encodings
+const (
+	encodingHex    = "hex"
+	encodingBase64 = "base64"
+)
+
+// convertBinary encodes the value of a binary column as given by
+// binary_encodings, as hex literal like "0x1A2B" by default
+func (q *Query) convertBinary(column string, value interface{}) interface{} {
+	b, ok := value.([]byte)
+	if !ok {
+		return value
+	}
+	if q.BinaryEncodings[column] == encodingBase64 {
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	return "0x" + strings.ToUpper(hex.EncodeToString(b))
+}
+
+// convertGUID converts the bytes of a UNIQUEIDENTIFIER column into the GUID
+// string shown by SQL Server, e.g. "6F9619FF-8B86-D011-B42D-00C04FC964FF"
+func convertGUID(value interface{}) (interface{}, error) {
+	b, ok := value.([]byte)
+	if !ok {
+		return value, nil
+	}
+	var guid mssql.UniqueIdentifier
+	if err := guid.Scan(b); err != nil {
+		return nil, err
+	}
+	return guid.String(), nil
+}
+
+// convertDecimal converts the decimal strings returned by the driver into
+// floats unless they are passed on as strings to keep their precision. The
+// driver returns money as decimal strings with four decimal places as well.
+func (q *Query) convertDecimal(value interface{}) (interface{}, error) {
+	b, ok := value.([]byte)
+	if !ok {
+		return value, nil
+	}
+	if q.DecimalAsString {
+		return string(b), nil
+	}
+	return strconv.ParseFloat(string(b), 64)
+}
+
+// convertDatetime converts the value of a date and time column into the
+// format given by datetime_formats, the value is left out without a format
+func (q *Query) convertDatetime(column string, t time.Time) interface{} {
+	t = q.localize(t)
+	switch format := q.DatetimeFormats[column]; format {
+	case "":
+		return nil
+	case datetimeRFC3339:
+		return t.Format(time.RFC3339Nano)
+	case "unix":
+		return t.Unix()
+	case "unix_ms":
+		return t.UnixNano() / int64(time.Millisecond)
+	case "unix_us":
+		return t.UnixNano() / int64(time.Microsecond)
+	default:
+		return t.UnixNano()
+	}
+}
+
+// coercedZeroValue returns the zero value of the column converted into the
+// type given by convert, so that NULLs do not change the field type
+func (q *Query) coercedZeroValue(column, dbType string) (interface{}, error) {
+	zero := q.zeroValue(column, dbType)
+	t, ok := q.Convert[column]
+	if !ok || zero == nil {
+		return zero, nil
+	}
+	// the empty string does not parse as a number or boolean
+	if zero == "" && t != typeString {
+		zero = int64(0)
+	}
+	return coerce(zero, t)
+}
+
+// zeroValue returns the zero value of the type the values of the column are
+// converted into, 0 if the database type is not known
+func (q *Query) zeroValue(column, dbType string) interface{} {
+	switch dbType {
+	case "DATETIME", "DATETIME2", "SMALLDATETIME", "DATE", "TIME", "DATETIMEOFFSET":
+		switch q.DatetimeFormats[column] {
+		case "":
+			return nil
+		case datetimeRFC3339:
+			return ""
+		}
+		return int64(0)
+	}
+	if q.UnsignedColumns != nil && q.UnsignedColumns.Match(column) {
+		return uint64(0)
+	}
+
+	switch dbType {
+	case "DECIMAL", "NUMERIC", "MONEY", "SMALLMONEY":
+		if q.DecimalAsString {
+			return "0"
+		}
+		return float64(0)
+	case "FLOAT", "REAL":
+		return float64(0)
+	case "BIT":
+		return false
+	case "CHAR", "NCHAR", "VARCHAR", "NVARCHAR", "TEXT", "NTEXT", "XML",
+		"UNIQUEIDENTIFIER", "BINARY", "VARBINARY", "IMAGE":
+		return ""
+	}
+	return int64(0)
+}
@@ -0,0 +1,439 @@
+package sqlserver_extended
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/filter"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccRowColumnRoles(t *testing.T) {
+	tests := []struct {
+		name           string
+		tags           []string
+		fields         []string
+		fieldsExpected map[string]interface{}
+		tagsExpected   map[string]string
+	}{
+		{
+			name:           "inferred",
+			fieldsExpected: map[string]interface{}{"wait": int64(10)},
+			tagsExpected:   map[string]string{"wait_type": "LCK_M_S", "category": "Lock", "query_name": "waits"},
+		},
+		{
+			name:           "explicit tags",
+			tags:           []string{"wait_type"},
+			fieldsExpected: map[string]interface{}{"wait": int64(10)},
+			tagsExpected:   map[string]string{"wait_type": "LCK_M_S", "query_name": "waits"},
+		},
+		{
+			name:           "explicit fields",
+			fields:         []string{"category", "tasks"},
+			fieldsExpected: map[string]interface{}{"category": "Lock", "tasks": int64(2)},
+			tagsExpected:   map[string]string{"wait_type": "LCK_M_S", "query_name": "waits"},
+		},
+		{
+			name:           "both",
+			tags:           []string{"category"},
+			fields:         []string{"field_*"},
+			fieldsExpected: map[string]interface{}{"wait": int64(10)},
+			tagsExpected:   map[string]string{"category": "Lock", "query_name": "waits"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var acc testutil.Accumulator
+			s := &SQLServerExtended{}
+
+			columns, err := newColumnRoles(tt.tags, tt.fields, defaultFieldPrefix, "")
+			require.NoError(t, err)
+			query := Query{
+				Name:           "waits",
+				Columns:        columns,
+				OrderedColumns: []string{"measurement", "wait_type", "category", "field_wait", "tasks"},
+			}
+			require.NoError(t, s.accRow(query, &acc, mockRow{"waits", "LCK_M_S", "Lock", int64(10), int64(2)}))
+			acc.AssertContainsTaggedFields(t, "waits", tt.fieldsExpected, tt.tagsExpected)
+		})
+	}
+}
+
+func TestAccRowMeasurementColumn(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	query := Query{
+		Name:              "report",
+		MeasurementColumn: "metric_group",
+		OrderedColumns:    []string{"metric_group", "measurement", "field_value"},
+	}
+	require.NoError(t, s.accRow(query, &acc, mockRow{"io", "reads", int64(10)}))
+	acc.AssertContainsTaggedFields(t, "io",
+		map[string]interface{}{"value": int64(10)},
+		map[string]string{"measurement": "reads", "query_name": "report"})
+}
+
+func TestAccRowTimeColumn(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	query := Query{
+		Name:           "jobs",
+		TimeColumn:     "run_time",
+		OrderedColumns: []string{"job_name", "run_time", "field_duration"},
+	}
+	runTime := time.Date(2020, 5, 4, 3, 2, 1, 0, time.UTC)
+	require.NoError(t, s.accRow(query, &acc, mockRow{"backup", runTime, int64(42)}))
+	require.NoError(t, s.accRow(query, &acc, mockRow{"backup", nil, int64(43)}))
+	require.Error(t, s.accRow(query, &acc, mockRow{"backup", "yesterday", int64(44)}))
+
+	require.Len(t, acc.Metrics, 2)
+	assert.Equal(t, runTime, acc.Metrics[0].Time)
+	assert.Equal(t, map[string]interface{}{"duration": int64(42)}, acc.Metrics[0].Fields)
+	assert.Equal(t, map[string]string{"job_name": "backup", "query_name": "jobs"}, acc.Metrics[0].Tags)
+	assert.WithinDuration(t, time.Now(), acc.Metrics[1].Time, time.Minute)
+}
+
+func TestRowTimeFormat(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	now := time.Now()
+	expected := time.Date(2020, 5, 4, 1, 2, 1, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		query    Query
+		value    interface{}
+		expected time.Time
+	}{
+		{
+			name:     "naive datetime",
+			query:    Query{TimeLocation: berlin},
+			value:    time.Date(2020, 5, 4, 3, 2, 1, 0, time.UTC),
+			expected: expected,
+		},
+		{
+			name:     "datetimeoffset",
+			query:    Query{TimeLocation: berlin},
+			value:    time.Date(2020, 5, 4, 4, 2, 1, 0, time.FixedZone("", 3*60*60)),
+			expected: expected,
+		},
+		{
+			name:     "layout",
+			query:    Query{TimeFormat: "2006-01-02 15:04:05", TimeLocation: berlin},
+			value:    "2020-05-04 03:02:01",
+			expected: expected,
+		},
+		{
+			name:     "unix",
+			query:    Query{TimeFormat: "unix_ms"},
+			value:    expected.UnixNano() / int64(time.Millisecond),
+			expected: expected,
+		},
+		{
+			name:     "null",
+			query:    Query{TimeFormat: "unix"},
+			value:    nil,
+			expected: now,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := tt.query.rowTime(tt.value, now)
+			require.NoError(t, err)
+			assert.True(t, tt.expected.Equal(actual), "expected %v, got %v", tt.expected, actual)
+		})
+	}
+
+	_, err = (&Query{}).rowTime("2020-05-04 03:02:01", now)
+	require.Error(t, err)
+	_, err = (&Query{TimeFormat: "2006-01-02"}).rowTime("yesterday", now)
+	require.Error(t, err)
+}
+
+func TestAccRowNullHandling(t *testing.T) {
+	tests := []struct {
+		policy string
+		fields map[string]interface{}
+		tags   map[string]string
+	}{
+		{
+			policy: nullSkip,
+			fields: map[string]interface{}{"reads": int64(5)},
+			tags:   map[string]string{"query_name": "io"},
+		},
+		{
+			policy: nullZero,
+			fields: map[string]interface{}{"reads": int64(5), "latency": float64(0), "state": ""},
+			tags:   map[string]string{"query_name": "io", "file": ""},
+		},
+		{
+			policy: nullString,
+			fields: map[string]interface{}{"reads": int64(5), "latency": "NULL", "state": "NULL"},
+			tags:   map[string]string{"query_name": "io", "file": "NULL"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			var acc testutil.Accumulator
+			s := &SQLServerExtended{}
+
+			query := Query{
+				Name:           "io",
+				NullHandling:   tt.policy,
+				OrderedColumns: []string{"measurement", "file", "field_reads", "field_latency", "field_state"},
+				ColumnTypes:    []string{"NVARCHAR", "NVARCHAR", "BIGINT", "FLOAT", "NVARCHAR"},
+			}
+			require.NoError(t, s.accRow(query, &acc, mockRow{"io", nil, int64(5), nil, nil}))
+			acc.AssertContainsTaggedFields(t, "io", tt.fields, tt.tags)
+		})
+	}
+}
+
+func TestAccRowByRowNull(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	query := Query{
+		Name:           "counters",
+		ResultByRow:    true,
+		NullHandling:   nullSkip,
+		OrderedColumns: []string{"counter", "value"},
+	}
+	require.NoError(t, s.accRow(query, &acc, mockRow{"Page life expectancy", nil}))
+	require.Empty(t, acc.Metrics)
+}
+
+func TestAccRowLegacyQueryName(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	query := Query{
+		Name:           "custom_0",
+		OrderedColumns: []string{"measurement", "file", "field_reads"},
+		legacy:         true,
+	}
+	require.NoError(t, s.accRow(query, &acc, mockRow{"io", "data.mdf", int64(5)}))
+	acc.AssertContainsTaggedFields(t, "io", map[string]interface{}{"reads": int64(5)}, map[string]string{"file": "data.mdf"})
+}
+
+func TestAccRowByRowMissingValue(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	query := Query{
+		Name:           "counters",
+		ResultByRow:    true,
+		OrderedColumns: []string{"counter", "cntr_value"},
+	}
+	err := s.accRow(query, &acc, mockRow{"Page life expectancy", int64(300)})
+	require.EqualError(t, err, `value column of result_by_row query "counters" is missing`)
+	require.Empty(t, acc.Metrics)
+}
+
+func TestConvert(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	naive := time.Date(2020, 5, 4, 3, 2, 1, 500, time.UTC)
+
+	tests := []struct {
+		name     string
+		query    Query
+		dbType   string
+		value    interface{}
+		expected interface{}
+	}{
+		{name: "untyped", value: []byte("1.5"), expected: []byte("1.5")},
+		{name: "decimal", dbType: "DECIMAL", value: []byte("12.3400"), expected: 12.34},
+		{name: "numeric", dbType: "NUMERIC", value: []byte("-7"), expected: float64(-7)},
+		{name: "money", dbType: "MONEY", value: []byte("-922337203685477.5808"), expected: -922337203685477.5808},
+		{name: "smallmoney", dbType: "SMALLMONEY", value: []byte("0.0005"), expected: 0.0005},
+		{name: "money as string", query: Query{DecimalAsString: true}, dbType: "MONEY", value: []byte("1234.5600"), expected: "1234.5600"},
+		{name: "decimal as string", query: Query{DecimalAsString: true}, dbType: "DECIMAL", value: []byte("12345678901234567890.1234"), expected: "12345678901234567890.1234"},
+		{name: "datetime without format", dbType: "DATETIME2", value: naive, expected: nil},
+		{name: "datetime unix_ns", query: Query{DatetimeFormats: map[string]string{"value": "unix_ns"}}, dbType: "DATETIME2", value: naive, expected: naive.UnixNano()},
+		{name: "datetime unix", query: Query{DatetimeFormats: map[string]string{"value": "unix"}}, dbType: "DATETIME", value: naive, expected: naive.Unix()},
+		{name: "datetime rfc3339", query: Query{DatetimeFormats: map[string]string{"value": "rfc3339"}}, dbType: "DATETIME2", value: naive, expected: "2020-05-04T03:02:01.0000005Z"},
+		{name: "datetime local", query: Query{DatetimeFormats: map[string]string{"value": "rfc3339"}, TimeLocation: berlin}, dbType: "DATETIME2", value: naive, expected: "2020-05-04T03:02:01.0000005+02:00"},
+		{name: "datetimeoffset", query: Query{DatetimeFormats: map[string]string{"value": "unix_ms"}, TimeLocation: berlin}, dbType: "DATETIMEOFFSET", value: naive.In(time.FixedZone("", 3600)), expected: naive.UnixNano() / int64(time.Millisecond)},
+		{name: "uniqueidentifier", dbType: "UNIQUEIDENTIFIER", value: []byte{0xFF, 0x19, 0x96, 0x6F, 0x86, 0x8B, 0x11, 0xD0, 0xB4, 0x2D, 0x00, 0xC0, 0x4F, 0xC9, 0x64, 0xFF}, expected: "6F9619FF-8B86-D011-B42D-00C04FC964FF"},
+		{name: "varbinary", dbType: "VARBINARY", value: []byte{0x1a, 0x2b, 0xff}, expected: "0x1A2BFF"},
+		{name: "varbinary base64", query: Query{BinaryEncodings: map[string]string{"value": "base64"}}, dbType: "VARBINARY", value: []byte{0x1a, 0x2b, 0xff}, expected: "Giv/"},
+		{name: "decimal zero", query: Query{NullHandling: nullZero, DecimalAsString: true}, dbType: "DECIMAL", expected: "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := tt.query.convert("value", tt.value, tt.dbType)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+
+	_, err = (&Query{}).convert("value", []byte("abc"), "DECIMAL")
+	require.Error(t, err)
+	_, err = (&Query{}).convert("value", []byte{0x01}, "UNIQUEIDENTIFIER")
+	require.Error(t, err)
+}
+
+func TestDatetimeFormatsTime(t *testing.T) {
+	s := &SQLServerExtended{
+		Query: []QueryConfig{{Name: "jobs", Script: "SELECT 1", DatetimeFormats: map[string]string{"run_time": "time", "start": "unix"}}},
+		Log:   testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	defer s.Stop()
+	assert.Equal(t, "run_time", s.queries["jobs"].TimeColumn)
+	assert.Equal(t, map[string]string{"start": "unix"}, s.queries["jobs"].DatetimeFormats)
+}
+
+func TestAccRowBit(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	query := Query{
+		Name:           "databases",
+		OrderedColumns: []string{"measurement", "database_name", "is_read_only", "field_online", "field_size"},
+	}
+	require.NoError(t, s.accRow(query, &acc, mockRow{"databases", "sales", false, true, int64(1024)}))
+	acc.AssertContainsTaggedFields(t, "databases",
+		map[string]interface{}{"online": true, "size": int64(1024)},
+		map[string]string{"database_name": "sales", "is_read_only": "false", "query_name": "databases"})
+}
+
+func TestConvertUnsigned(t *testing.T) {
+	unsigned, err := filter.Compile([]string{"rv", "field_count"})
+	require.NoError(t, err)
+	query := Query{UnsignedColumns: unsigned}
+
+	tests := []struct {
+		column   string
+		dbType   string
+		value    interface{}
+		expected interface{}
+	}{
+		{column: "rv", dbType: "BINARY", value: []byte{0, 0, 0, 0, 0, 0, 0x07, 0xd1}, expected: uint64(2001)},
+		{column: "rv", dbType: "BINARY", value: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, expected: uint64(math.MaxUint64)},
+		{column: "field_count", dbType: "BIGINT", value: int64(42), expected: uint64(42)},
+		{column: "field_count", dbType: "DECIMAL", value: []byte("18446744073709551615"), expected: uint64(math.MaxUint64)},
+		{column: "field_count", dbType: "FLOAT", value: float64(1e10), expected: uint64(1e10)},
+		{column: "field_other", dbType: "BIGINT", value: int64(-1), expected: int64(-1)},
+	}
+	for _, tt := range tests {
+		actual, err := query.convert(tt.column, tt.value, tt.dbType)
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, actual)
+	}
+
+	for _, value := range []interface{}{int64(-1), float64(-1), float64(1.5), []byte("18446744073709551616"), []byte("1.5")} {
+		_, err := query.convert("field_count", value, "DECIMAL")
+		require.Error(t, err, "value %v", value)
+	}
+	_, err = query.convert("rv", make([]byte, 9), "VARBINARY")
+	require.Error(t, err)
+}
+
+func TestConvertNullZero(t *testing.T) {
+	unsigned, err := filter.Compile([]string{"rv"})
+	require.NoError(t, err)
+	query := Query{
+		NullHandling:    nullZero,
+		UnsignedColumns: unsigned,
+		BinaryEncodings: map[string]string{"b64": encodingBase64},
+		DatetimeFormats: map[string]string{"started": "rfc3339", "ended": "unix", "created": "unix_ms"},
+	}
+
+	tests := []struct {
+		column   string
+		dbType   string
+		expected interface{}
+	}{
+		{column: "count", dbType: "BIGINT", expected: int64(0)},
+		{column: "rv", dbType: "BINARY", expected: uint64(0)},
+		{column: "hash", dbType: "VARBINARY", expected: ""},
+		{column: "b64", dbType: "VARBINARY", expected: ""},
+		{column: "id", dbType: "UNIQUEIDENTIFIER", expected: ""},
+		{column: "started", dbType: "DATETIME2", expected: ""},
+		{column: "started", dbType: "DATETIMEOFFSET", expected: ""},
+		{column: "ended", dbType: "DATETIME", expected: int64(0)},
+		{column: "created", dbType: "DATE", expected: int64(0)},
+		{column: "modified", dbType: "TIME", expected: nil},
+	}
+	for _, tt := range tests {
+		actual, err := query.convert(tt.column, nil, tt.dbType)
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, actual, "%s %s", tt.column, tt.dbType)
+	}
+}
+
+func TestAccRowFieldPrefix(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefix   string
+		expected map[string]interface{}
+	}{
+		{name: "custom", prefix: "f_", expected: map[string]interface{}{"reads": int64(5)}},
+		{name: "none", prefix: "", expected: map[string]interface{}{"f_reads": int64(5), "field_writes": int64(7), "io_stall_ms": 1.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var acc testutil.Accumulator
+			s := &SQLServerExtended{}
+
+			columns, err := newColumnRoles(nil, nil, tt.prefix, "")
+			require.NoError(t, err)
+			query := Query{
+				Name:           "io",
+				Columns:        columns,
+				OrderedColumns: []string{"measurement", "file", "f_reads", "field_writes", "io_stall_ms"},
+			}
+			require.NoError(t, s.accRow(query, &acc, mockRow{"io", "data", int64(5), int64(7), 1.5}))
+			acc.AssertContainsTaggedFields(t, "io", tt.expected, map[string]string{"file": "data", "query_name": "io"})
+		})
+	}
+}
+
+func TestFieldPrefixOverride(t *testing.T) {
+	plugin, query := "p_", ""
+	s := &SQLServerExtended{
+		FieldPrefix: &plugin,
+		Query: []QueryConfig{
+			{Name: "default", Script: "SELECT 1"},
+			{Name: "override", Script: "SELECT 2", FieldPrefix: &query},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	defer s.Stop()
+	assert.Equal(t, "p_", s.queries["default"].Columns.fieldPrefix())
+	assert.Equal(t, "", s.queries["override"].Columns.fieldPrefix())
+}
+
+func TestFieldNameMode(t *testing.T) {
+	legacy, err := newColumnRoles(nil, nil, defaultFieldPrefix, fieldNameLegacy)
+	require.NoError(t, err)
+	assert.Equal(t, "page", legacy.fieldName("field_page_life_expectancy"))
+
+	trim, err := newColumnRoles(nil, nil, defaultFieldPrefix, fieldNameTrim)
+	require.NoError(t, err)
+	assert.Equal(t, "page_life_expectancy", trim.fieldName("field_page_life_expectancy"))
+	assert.Equal(t, "page_life_expectancy", trim.fieldName("page_life_expectancy"))
+}
+
+func TestAccRowRename(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	query := Query{
+		Name:           "buffers",
+		Rename:         map[string]string{"field_plecount": "page_life_expectancy", "db": "database_name"},
+		OrderedColumns: []string{"measurement", "db", "field_plecount", "field_reads"},
+	}
+	require.NoError(t, s.accRow(query, &acc, mockRow{"buffers", "tempdb", int64(3600), int64(5)}))
+	acc.AssertContainsTaggedFields(t, "buffers",
+		map[string]interface{}{"page_life_expectancy": int64(3600), "reads": int64(5)},
+		map[string]string{"database_name": "tempdb", "query_name": "buffers"})
+}
@@ -0,0 +1,372 @@
+package sqlserver_extended
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/influxdata/telegraf"
+)
+
+// defaultKeepAlivePeriod is the TCP keep-alive period of the connections
+// recommended by the TDS specification
+const defaultKeepAlivePeriod = 30 * time.Second
+
+// connectionPools keeps one connection pool per server for the lifetime of
+// the plugin, so the logins are not repeated for every query
+type connectionPools struct {
+	sync.Mutex
+	pools map[string]*sql.DB
+
+	maxOpen        int
+	maxIdle        *int
+	maxLifetime    time.Duration
+	connectTimeout time.Duration
+
+	// params are the driver keywords added to every connection string
+	params map[string]string
+	// forcedParams replace the driver keywords of every connection string
+	forcedParams map[string]string
+}
+
+func newConnectionPools(maxOpen int, maxIdle *int, maxLifetime, connectTimeout time.Duration) *connectionPools {
+	return &connectionPools{
+		pools:          make(map[string]*sql.DB),
+		maxOpen:        maxOpen,
+		maxIdle:        maxIdle,
+		maxLifetime:    maxLifetime,
+		connectTimeout: connectTimeout,
+	}
+}
+
+// get returns the pool of the server, opening it on first use
+func (c *connectionPools) get(server string) (*sql.DB, error) {
+	c.Lock()
+	defer c.Unlock()
+	if db, ok := c.pools[server]; ok {
+		return db, nil
+	}
+
+	// opening is deferred, connections are established on first use
+	dsn := c.connectionString(server)
+	params := parseConnectionString(dsn)
+	proxyURL := params["proxy"]
+	dac := params[dacParam] == "true"
+	dsn = withoutParams(dsn, "proxy", dacParam)
+
+	tr, host, err := parseTransport(serverName(params))
+	if err != nil {
+		return nil, err
+	}
+	if tr.pipe != "" || tr.localDB != "" {
+		if dac {
+			return nil, fmt.Errorf("the Dedicated Admin Connection requires TCP")
+		}
+		// the driver only connects over TCP, it is pointed to a placeholder
+		// address while the connector opens the pipe
+		dsn = withParams(withServer(withoutParams(dsn, "port"), pipeHost), map[string]string{"hostnameincertificate": tr.hostname()})
+	} else if host != serverName(params) {
+		dsn = withServer(dsn, host)
+	}
+
+	conn, err := mssql.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	connector := &connector{Connector: conn, timeout: c.connectTimeout, dac: dac, transport: tr}
+	// the driver only applies keepalive to its own dialer
+	if connector.dialer.KeepAlive, err = keepAlivePeriod(params); err != nil {
+		return nil, err
+	}
+	if proxyURL != "" {
+		if connector.proxy, err = newProxyDialer(proxyURL, &connector.dialer); err != nil {
+			return nil, err
+		}
+	}
+	// named instances are resolved for every connection, as their port can
+	// change with a restart
+	if hasCredentials(dsn) || dac || strings.Contains(serverName(parseConnectionString(dsn)), `\`) {
+		connector.dsn = dsn
+	}
+	conn.Dialer = connector
+	db := sql.OpenDB(connector)
+
+	db.SetMaxOpenConns(c.maxOpen)
+	if c.maxIdle != nil {
+		db.SetMaxIdleConns(*c.maxIdle)
+	}
+	if dac {
+		// a server accepts a single DAC, it is not kept open between queries
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(0)
+	}
+	db.SetConnMaxLifetime(c.maxLifetime)
+	c.pools[server] = db
+	return db, nil
+}
+
+// connectionString adds the driver keywords of the plugin options to the
+// connection string of the server
+func (c *connectionPools) connectionString(server string) string {
+	dsn := withParams(server, c.params)
+	if len(c.forcedParams) == 0 {
+		return dsn
+	}
+	keys := make([]string, 0, len(c.forcedParams))
+	for k := range c.forcedParams {
+		keys = append(keys, k)
+	}
+	return withParams(withoutParams(dsn, keys...), c.forcedParams)
+}
+
+// release closes the pools of the servers
+func (c *connectionPools) release(servers ...string) {
+	c.Lock()
+	defer c.Unlock()
+	for _, server := range servers {
+		if db, ok := c.pools[server]; ok {
+			db.Close()
+			delete(c.pools, server)
+		}
+	}
+}
+
+// close closes the pools of all servers
+func (c *connectionPools) close() {
+	c.Lock()
+	defer c.Unlock()
+	for server, db := range c.pools {
+		db.Close()
+		delete(c.pools, server)
+	}
+}
+
+// connector bounds the time to establish a connection, including the login,
+// independently of the timeout of the query needing the connection. The
+// credentials referenced by dsn and its DAC port are resolved for every
+// connection.
+type connector struct {
+	*mssql.Connector
+	timeout   time.Duration
+	dialer    net.Dialer
+	dsn       string
+	proxy     contextDialer
+	dac       bool
+	transport transport
+}
+
+// dialedConnsKey is the context key of the connections dialed by Connect
+type dialedConnsKey struct{}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	base := c.Connector
+	if c.dsn != "" {
+		dsn, err := resolveCredentials(c.dsn)
+		if err != nil {
+			return nil, err
+		}
+		if c.dac {
+			if dsn, err = resolveDAC(ctx, &c.dialer, dsn); err != nil {
+				return nil, err
+			}
+		} else {
+			dsn = withoutInstance(dsn)
+		}
+		if base, err = mssql.NewConnector(dsn); err != nil {
+			return nil, err
+		}
+		base.Dialer = c
+	}
+
+	if c.timeout <= 0 {
+		return base.Connect(ctx)
+	}
+
+	var dialed []net.Conn
+	ctx = context.WithValue(ctx, dialedConnsKey{}, &dialed)
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	conn, err := base.Connect(ctx)
+	// the login is bounded by a deadline on the network connection, lift
+	// it for the queries run on the established connection
+	for _, d := range dialed {
+		d.SetDeadline(time.Time{})
+	}
+	return conn, err
+}
+
+func (c *connector) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	// the SQL Browser is queried over UDP, which is not proxied
+	if c.transport.pipe != "" || c.transport.localDB != "" {
+		conn, err = c.dialPipe(ctx)
+	} else if c.proxy != nil && network == "tcp" {
+		conn, err = c.proxy.DialContext(ctx, network, addr)
+	} else {
+		conn, err = c.dialer.DialContext(ctx, network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if dialed, ok := ctx.Value(dialedConnsKey{}).(*[]net.Conn); ok {
+		if err := conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		*dialed = append(*dialed, conn)
+	}
+	return conn, nil
+}
+
+// dialPipe opens the named pipe of the server, the one of a LocalDB instance
+// is looked up after starting the instance
+func (c *connector) dialPipe(ctx context.Context) (net.Conn, error) {
+	path := c.transport.pipe
+	if c.transport.localDB != "" {
+		var err error
+		if path, err = localDBPipe(ctx, c.transport.localDB); err != nil {
+			return nil, err
+		}
+	}
+	return dialPipe(ctx, path)
+}
+
+// connectionParams returns the driver keywords set by the plugin options
+func (s *SQLServerExtended) connectionParams() (map[string]string, error) {
+	params := make(map[string]string)
+	if s.ReadOnlyIntent {
+		if s.EnforcePrimary {
+			return nil, fmt.Errorf("read_only_intent and enforce_primary are mutually exclusive")
+		}
+		params["applicationintent"] = "ReadOnly"
+	}
+	if s.MultiSubnetFailover {
+		params["multisubnetfailover"] = "true"
+	}
+	if s.Proxy != "" {
+		if _, err := newProxyDialer(s.Proxy, &net.Dialer{}); err != nil {
+			return nil, err
+		}
+		params["proxy"] = s.Proxy
+	}
+
+	// the driver negotiates TLS itself, it does not support client
+	// certificates which SQL Server does not authenticate with anyway
+	if s.TLSCA != "" || s.InsecureSkipVerify || s.HostnameInCertificate != "" {
+		params["encrypt"] = "true"
+		params["trustservercertificate"] = strconv.FormatBool(s.InsecureSkipVerify)
+	}
+	if s.TLSCA != "" {
+		params["certificate"] = s.TLSCA
+	}
+	if s.HostnameInCertificate != "" {
+		params["hostnameincertificate"] = s.HostnameInCertificate
+	}
+	if s.TCPKeepAlivePeriod != nil {
+		period := s.TCPKeepAlivePeriod.Duration
+		if period < 0 || (period > 0 && period%time.Second != 0) {
+			return nil, fmt.Errorf("tcp_keep_alive_period must be 0 or a whole number of seconds")
+		}
+		params["keepalive"] = strconv.Itoa(int(period / time.Second))
+	}
+	for k, v := range params {
+		if strings.Contains(v, ";") {
+			return nil, fmt.Errorf("%s must not contain a semicolon", k)
+		}
+	}
+	return params, nil
+}
+
+// keepAlivePeriod returns the TCP keep-alive period of the connection string
+// for a net.Dialer. The driver keyword keepalive is given in seconds, zero
+// disables the keep-alive probes.
+func keepAlivePeriod(params map[string]string) (time.Duration, error) {
+	value, ok := params["keepalive"]
+	if !ok {
+		return defaultKeepAlivePeriod, nil
+	}
+	seconds, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid keepalive %q: %v", value, err)
+	}
+	if seconds == 0 {
+		return -1, nil
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// serverStatus remembers the connection failures of a server across gathers
+type serverStatus struct {
+	failing bool
+	since   time.Time
+	err     string
+}
+
+// connect pings the server, retrying with a doubling backoff, and reports
+// whether the queries can be run. The outcome is emitted as health metric,
+// a failure is only reported once as long as the server keeps failing with
+// the same error.
+func (s *SQLServerExtended) connect(ctx context.Context, server string, acc telegraf.Accumulator) bool {
+	var latency time.Duration
+	db, err := s.pools.get(server)
+	if err == nil {
+		backoff := s.ConnectRetryBackoff.Duration
+		for attempt := 0; ; attempt++ {
+			start := time.Now()
+			err = db.PingContext(ctx)
+			latency = time.Since(start)
+			if err == nil || attempt >= s.ConnectRetries {
+				break
+			}
+			s.Log.Debugf("Connecting to server %q failed, retrying in %s: %v", serverName(parseConnectionString(server)), backoff, err)
+			if !sleep(ctx, backoff) {
+				break
+			}
+			backoff *= 2
+		}
+	}
+
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	status, ok := s.status[server]
+	if !ok {
+		status = &serverStatus{}
+		s.status[server] = status
+	}
+
+	name := serverName(parseConnectionString(server))
+	tags := map[string]string{"sql_instance": name}
+	if err == nil {
+		acc.AddFields("sqlserver_extended_health", map[string]interface{}{
+			"up":                 1,
+			"connect_latency_ms": float64(latency) / float64(time.Millisecond),
+		}, tags)
+		if status.failing {
+			s.Log.Infof("Connection to server %q restored after %s", name, time.Since(status.since).Round(time.Second))
+		}
+		*status = serverStatus{}
+		return true
+	}
+
+	acc.AddFields("sqlserver_extended_health", map[string]interface{}{"up": 0}, tags)
+	if status.failing && status.err == err.Error() {
+		s.Log.Debugf("Server %q is still unavailable: %v", name, err)
+		return false
+	}
+	if !status.failing {
+		status.since = time.Now()
+	}
+	status.failing = true
+	status.err = err.Error()
+	acc.AddError(fmt.Errorf("connecting to server %q failed: %v", name, err))
+	return false
+}
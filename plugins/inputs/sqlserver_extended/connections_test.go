@@ -0,0 +1,169 @@
+package sqlserver_extended
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionPools(t *testing.T) {
+	pools := newConnectionPools(0, nil, 0, 0)
+
+	first, err := pools.get("Server=sql01;User Id=telegraf;")
+	require.NoError(t, err)
+	again, err := pools.get("Server=sql01;User Id=telegraf;")
+	require.NoError(t, err)
+	other, err := pools.get("Server=sql02;User Id=telegraf;")
+	require.NoError(t, err)
+
+	assert.Same(t, first, again)
+	assert.NotSame(t, first, other)
+
+	pools.close()
+	assert.Empty(t, pools.pools)
+}
+
+func TestConnectionPoolLimits(t *testing.T) {
+	idle := 1
+	pools := newConnectionPools(4, &idle, time.Hour, 0)
+	defer pools.close()
+
+	db, err := pools.get("Server=sql01;User Id=telegraf;")
+	require.NoError(t, err)
+	assert.Equal(t, 4, db.Stats().MaxOpenConnections)
+}
+
+func TestConnectionPoolDAC(t *testing.T) {
+	pools := newConnectionPools(4, nil, time.Hour, 0)
+	defer pools.close()
+
+	db, err := pools.get(dacServer("Server=sql01;User Id=telegraf;"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, db.Stats().MaxOpenConnections)
+	assert.Equal(t, "Server=sql01;User Id=telegraf;telegraf_dac=true", dacServer("Server=sql01;User Id=telegraf;"))
+}
+
+func TestKeepAlivePeriod(t *testing.T) {
+	period, err := keepAlivePeriod(map[string]string{})
+	require.NoError(t, err)
+	assert.Equal(t, defaultKeepAlivePeriod, period)
+
+	period, err = keepAlivePeriod(map[string]string{"keepalive": "120"})
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Minute, period)
+
+	period, err = keepAlivePeriod(map[string]string{"keepalive": "0"})
+	require.NoError(t, err)
+	assert.True(t, period < 0)
+
+	_, err = keepAlivePeriod(map[string]string{"keepalive": "1m"})
+	require.Error(t, err)
+}
+
+func TestConnectionParamsKeepAlive(t *testing.T) {
+	s := &SQLServerExtended{TCPKeepAlivePeriod: &internal.Duration{Duration: time.Minute}}
+	params, err := s.connectionParams()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"keepalive": "60"}, params)
+
+	s.TCPKeepAlivePeriod.Duration = 0
+	params, err = s.connectionParams()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"keepalive": "0"}, params)
+
+	s.TCPKeepAlivePeriod.Duration = 1500 * time.Millisecond
+	_, err = s.connectionParams()
+	require.Error(t, err)
+}
+
+func TestConnectTimeout(t *testing.T) {
+	// a server accepting connections without ever answering the login
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	pools := newConnectionPools(0, nil, 0, 200*time.Millisecond)
+	defer pools.close()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	db, err := pools.get(fmt.Sprintf("Server=127.0.0.1;Port=%d;User Id=telegraf;Password=secret;encrypt=disable", addr.Port))
+	require.NoError(t, err)
+
+	start := time.Now()
+	require.Error(t, db.PingContext(context.Background()))
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestConnectRetries(t *testing.T) {
+	// a closed port refuses every connection
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	server := fmt.Sprintf("Server=127.0.0.1;Port=%d;User Id=telegraf;Password=secret;encrypt=disable", addr.Port)
+	s := &SQLServerExtended{
+		Servers:             []string{server},
+		ConnectRetries:      2,
+		ConnectRetryBackoff: internal.Duration{Duration: 10 * time.Millisecond},
+		Log:                 testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	defer s.Stop()
+
+	var acc testutil.Accumulator
+	require.False(t, s.connect(context.Background(), server, &acc))
+	require.Len(t, acc.Errors, 1)
+	acc.AssertContainsTaggedFields(t, "sqlserver_extended_health",
+		map[string]interface{}{"up": 0},
+		map[string]string{"sql_instance": "127.0.0.1"})
+
+	// the same failure is not reported again
+	require.False(t, s.connect(context.Background(), server, &acc))
+	require.Len(t, acc.Errors, 1)
+	assert.True(t, s.status[server].failing)
+}
+
+func TestGatherHealthWithoutDueQueries(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	s := &SQLServerExtended{
+		Servers: []string{fmt.Sprintf("Server=127.0.0.1;Port=%d;User Id=telegraf;Password=secret;encrypt=disable", addr.Port)},
+		Log:     testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	defer s.Stop()
+
+	// a dead server is reported as down on every gather
+	for i := 0; i < 2; i++ {
+		var acc testutil.Accumulator
+		require.NoError(t, s.Gather(&acc))
+		acc.AssertContainsTaggedFields(t, "sqlserver_extended_health",
+			map[string]interface{}{"up": 0},
+			map[string]string{"sql_instance": "127.0.0.1"})
+	}
+}
+
+func TestConnectRetriesNegative(t *testing.T) {
+	s := &SQLServerExtended{ConnectRetries: -1, Log: testutil.Logger{}}
+	require.Error(t, s.Init())
+}
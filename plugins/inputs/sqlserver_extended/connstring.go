@@ -0,0 +1,110 @@
+package sqlserver_extended
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/influxdata/telegraf/internal/choice"
+)
+
+// parseConnectionString splits an ADO style "key=value;key=value" connection
+// string into its parameters, keys are lower cased
+func parseConnectionString(dsn string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range strings.Split(dsn, ";") {
+		if len(part) == 0 {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		if len(kv) == 2 {
+			params[key] = strings.TrimSpace(kv[1])
+		} else {
+			params[key] = ""
+		}
+	}
+	return params
+}
+
+// serverName returns the server the connection string points to
+func serverName(params map[string]string) string {
+	for _, key := range []string{"server", "data source", "address", "addr", "network address"} {
+		if v, ok := params[key]; ok && v != "" {
+			return v
+		}
+	}
+	return "."
+}
+
+// databaseName returns the initial database of the connection string
+func databaseName(params map[string]string) string {
+	for _, key := range []string{"database", "initial catalog"} {
+		if v, ok := params[key]; ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// withParams adds the keywords to the connection string, keywords already
+// set in the connection string take precedence
+func withParams(dsn string, params map[string]string) string {
+	if len(params) == 0 {
+		return dsn
+	}
+	existing := parseConnectionString(dsn)
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		if _, ok := existing[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if dsn != "" && !strings.HasSuffix(dsn, ";") {
+			dsn += ";"
+		}
+		dsn += k + "=" + params[k]
+	}
+	return dsn
+}
+
+// withoutParams removes the keywords from the connection string
+func withoutParams(dsn string, keys ...string) string {
+	var parts []string
+	for _, part := range strings.Split(dsn, ";") {
+		key := strings.ToLower(strings.TrimSpace(strings.SplitN(part, "=", 2)[0]))
+		if key == "" || choice.Contains(key, keys) {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ";")
+}
+
+// withServer replaces the server of the connection string
+func withServer(dsn, server string) string {
+	dsn = withoutParams(dsn, "server", "data source", "address", "addr", "network address")
+	if dsn == "" {
+		return "Server=" + server
+	}
+	return "Server=" + server + ";" + dsn
+}
+
+// failoverPartner splits the failover partner off the connection string, so
+// that the failover is handled by the plugin instead of the driver
+func failoverPartner(dsn string) (server, partner string) {
+	params := parseConnectionString(dsn)
+	name := params["failoverpartner"]
+	if name == "" {
+		return dsn, ""
+	}
+
+	server = withoutParams(dsn, "failoverpartner", "failoverport")
+	partner = withServer(server, name)
+	if port, ok := params["failoverport"]; ok {
+		partner = withParams(withoutParams(partner, "port"), map[string]string{"port": port})
+	}
+	return server, partner
+}
@@ -0,0 +1,71 @@
+package sqlserver_extended
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithParams(t *testing.T) {
+	params := map[string]string{"applicationintent": "ReadOnly"}
+	assert.Equal(t, "Server=sql01;User Id=telegraf;applicationintent=ReadOnly",
+		withParams("Server=sql01;User Id=telegraf;", params))
+	assert.Equal(t, "Server=sql01;applicationintent=ReadOnly",
+		withParams("Server=sql01", params))
+	assert.Equal(t, "Server=sql01;ApplicationIntent=ReadWrite",
+		withParams("Server=sql01;ApplicationIntent=ReadWrite", params))
+	assert.Equal(t, "Server=sql01", withParams("Server=sql01", nil))
+}
+
+func TestConnectionParams(t *testing.T) {
+	s := &SQLServerExtended{}
+	params, err := s.connectionParams()
+	require.NoError(t, err)
+	assert.Empty(t, params)
+
+	s.ReadOnlyIntent = true
+	s.MultiSubnetFailover = true
+	params, err = s.connectionParams()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"applicationintent":   "ReadOnly",
+		"multisubnetfailover": "true",
+	}, params)
+}
+
+func TestConnectionParamsTLS(t *testing.T) {
+	s := &SQLServerExtended{HostnameInCertificate: "sql01.example.com"}
+	s.TLSCA = "/etc/telegraf/ca.pem"
+	params, err := s.connectionParams()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"encrypt":                "true",
+		"trustservercertificate": "false",
+		"certificate":            "/etc/telegraf/ca.pem",
+		"hostnameincertificate":  "sql01.example.com",
+	}, params)
+
+	s = &SQLServerExtended{}
+	s.InsecureSkipVerify = true
+	params, err = s.connectionParams()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"encrypt":                "true",
+		"trustservercertificate": "true",
+	}, params)
+}
+
+func TestFailoverPartner(t *testing.T) {
+	server, partner := failoverPartner("Server=sql01;Port=1433;failoverPartner=sql02;failoverPort=1533;User Id=telegraf")
+	assert.Equal(t, "Server=sql01;Port=1433;User Id=telegraf", server)
+	assert.Equal(t, "Server=sql02;User Id=telegraf;port=1533", partner)
+
+	server, partner = failoverPartner("Server=sql01;failoverPartner=sql02")
+	assert.Equal(t, "Server=sql01", server)
+	assert.Equal(t, "Server=sql02", partner)
+
+	server, partner = failoverPartner("Server=sql01;User Id=telegraf;")
+	assert.Equal(t, "Server=sql01;User Id=telegraf;", server)
+	assert.Empty(t, partner)
+}
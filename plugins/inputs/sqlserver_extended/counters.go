@@ -0,0 +1,211 @@
+package sqlserver_extended
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// counterTypeColumn holds the type of the performance counters of pivoted
+// results, e.g. of sys.dm_os_performance_counters
+const counterTypeColumn = "cntr_type"
+
+// Types of the cntr_type column
+const (
+	perfLargeRawcount    = 65792      // PERF_COUNTER_LARGE_RAWCOUNT, collected as is
+	perfCounterCounter   = 272696320  // PERF_COUNTER_COUNTER, cumulative per-second
+	perfCounterBulkCount = 272696576  // PERF_COUNTER_BULK_COUNT, cumulative per-second
+	perfLargeRawFraction = 537003264  // PERF_LARGE_RAW_FRACTION, ratio to its base
+	perfAverageBulk      = 1073874176 // PERF_AVERAGE_BULK, average per operation of its base
+	perfLargeRawBase     = 1073939712 // PERF_LARGE_RAW_BASE, base of a fraction or average
+)
+
+// counterSample is the value of a series observed by a gather
+type counterSample struct {
+	value float64
+	base  float64
+	time  time.Time
+}
+
+// counterStore keeps the last samples of cumulative counters per server and
+// query to compute their deltas across gathers
+type counterStore struct {
+	sync.Mutex
+	series map[string]map[string]*counterSeries
+}
+
+func newCounterStore() *counterStore {
+	return &counterStore{series: make(map[string]map[string]*counterSeries)}
+}
+
+// get returns the series of the query on the server
+func (c *counterStore) get(server, query string) *counterSeries {
+	c.Lock()
+	defer c.Unlock()
+	if c.series[server] == nil {
+		c.series[server] = make(map[string]*counterSeries)
+	}
+	series, ok := c.series[server][query]
+	if !ok {
+		series = &counterSeries{samples: make(map[string]counterSample)}
+		c.series[server][query] = series
+	}
+	return series
+}
+
+// release drops the series of the servers
+func (c *counterStore) release(servers ...string) {
+	c.Lock()
+	defer c.Unlock()
+	for _, server := range servers {
+		delete(c.series, server)
+	}
+}
+
+// counterSeries holds the last samples of the series of a query
+type counterSeries struct {
+	sync.Mutex
+	samples map[string]counterSample
+}
+
+// swap stores the sample of the series and returns the previous one, nothing
+// is kept by a nil series
+func (s *counterSeries) swap(key string, sample counterSample) (counterSample, bool) {
+	if s == nil {
+		return counterSample{}, false
+	}
+	s.Lock()
+	defer s.Unlock()
+	previous, ok := s.samples[key]
+	s.samples[key] = sample
+	return previous, ok
+}
+
+// seriesKey identifies the series of a field by measurement and tags
+func seriesKey(measurement string, tags map[string]string, field string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(measurement)
+	for _, k := range keys {
+		b.WriteString("\x00" + k + "=" + tags[k])
+	}
+	b.WriteString("\x00" + field)
+	return b.String()
+}
+
+// perfCounter is a row of a pivoted result set with a counter type, paired
+// with its base counter by name and collected as field
+type perfCounter struct {
+	measurement string
+	tags        map[string]string
+	name        string
+	field       string
+	value       interface{}
+	counterType int64
+	time        time.Time
+}
+
+// perfCounterBatch collects the counters of a result set, fractions and
+// averages need their base counters of the same result set
+type perfCounterBatch struct {
+	counters []perfCounter
+}
+
+func (b *perfCounterBatch) add(c perfCounter) {
+	b.counters = append(b.counters, c)
+}
+
+// counterBaseName returns the name shared by a counter and its base counter
+// without the "base" suffix and the unit, e.g. "avg disk read io" for both
+// "Avg Disk Read IO (ms)" and "Avg Disk Read IO (ms) Base"
+func counterBaseName(name string, counterType int64) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if counterType == perfLargeRawBase {
+		name = strings.TrimSpace(strings.TrimSuffix(name, "base"))
+	}
+	if i := strings.Index(name, "("); i > 0 {
+		name = name[:i]
+	}
+	return strings.TrimSpace(name)
+}
+
+// emit adds the values of the counters by their type. Per-second counters
+// are collected as the rate since the previous gather, fractions as
+// percentage of their base and averages as the delta of the counter per delta
+// of its base since the previous gather. Counters without a previous sample,
+// reset since or missing their base are left out, base counters themselves
+// are not collected.
+func (b *perfCounterBatch) emit(acc telegraf.Accumulator, series *counterSeries) {
+	bases := make(map[string]float64)
+	for _, c := range b.counters {
+		if c.counterType != perfLargeRawBase {
+			continue
+		}
+		if v, err := toFloat(c.value); err == nil {
+			bases[seriesKey(c.measurement, c.tags, counterBaseName(c.name, c.counterType))] = v.(float64)
+		}
+	}
+
+	for _, c := range b.counters {
+		if c.counterType == perfLargeRawBase {
+			continue
+		}
+		value, err := c.compute(bases, series)
+		if err != nil {
+			acc.AddError(fmt.Errorf("counter %q: %v", c.name, err))
+			continue
+		}
+		if value != nil {
+			acc.AddFields(c.measurement, map[string]interface{}{c.field: value}, c.tags, c.time)
+		}
+	}
+}
+
+// compute returns the value of the counter, nil if it is left out
+func (c *perfCounter) compute(bases map[string]float64, series *counterSeries) (interface{}, error) {
+	switch c.counterType {
+	case perfCounterCounter, perfCounterBulkCount, perfLargeRawFraction, perfAverageBulk:
+	default:
+		return c.value, nil
+	}
+
+	v, err := toFloat(c.value)
+	if err != nil {
+		return nil, err
+	}
+	value := v.(float64)
+	base, hasBase := bases[seriesKey(c.measurement, c.tags, counterBaseName(c.name, c.counterType))]
+
+	switch c.counterType {
+	case perfLargeRawFraction:
+		if !hasBase || base == 0 {
+			return nil, nil
+		}
+		return value / base * 100, nil
+	case perfAverageBulk:
+		if !hasBase {
+			return nil, nil
+		}
+		previous, ok := series.swap(seriesKey(c.measurement, c.tags, c.name), counterSample{value: value, base: base, time: c.time})
+		if !ok || value < previous.value || base <= previous.base {
+			return nil, nil
+		}
+		return (value - previous.value) / (base - previous.base), nil
+	}
+
+	previous, ok := series.swap(seriesKey(c.measurement, c.tags, c.name), counterSample{value: value, time: c.time})
+	elapsed := c.time.Sub(previous.time).Seconds()
+	if !ok || value < previous.value || elapsed <= 0 {
+		return nil, nil
+	}
+	return (value - previous.value) / elapsed, nil
+}
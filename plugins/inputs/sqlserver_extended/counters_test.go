@@ -0,0 +1,121 @@
+package sqlserver_extended
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounterBaseName(t *testing.T) {
+	assert.Equal(t, "buffer cache hit ratio", counterBaseName("Buffer cache hit ratio", perfLargeRawFraction))
+	assert.Equal(t, "buffer cache hit ratio", counterBaseName("Buffer cache hit ratio base    ", perfLargeRawBase))
+	assert.Equal(t, "average wait time", counterBaseName("Average Wait Time (ms)", perfAverageBulk))
+	assert.Equal(t, "average wait time", counterBaseName("Average Wait Time Base", perfLargeRawBase))
+	assert.Equal(t, "avg disk read io", counterBaseName("Avg Disk Read IO (ms)", perfAverageBulk))
+	assert.Equal(t, "avg disk read io", counterBaseName("Avg Disk Read IO (ms) Base", perfLargeRawBase))
+	assert.Equal(t, "avg disk write io", counterBaseName("Avg Disk Write IO (ms)", perfAverageBulk))
+	assert.Equal(t, "avg disk write io", counterBaseName("Avg Disk Write IO (ms) Base", perfLargeRawBase))
+	assert.Equal(t, "average latch wait time", counterBaseName("Average Latch Wait Time (ms)", perfAverageBulk))
+	assert.Equal(t, "average latch wait time", counterBaseName("Average Latch Wait Time Base", perfLargeRawBase))
+}
+
+func TestPerfCounterBatch(t *testing.T) {
+	series := newCounterStore().get("sql01", "counters")
+	tags := map[string]string{"object_name": "SQLServer:Locks", "query_name": "counters"}
+	gather := func(tm time.Time, batches, waits, waitBase int64) *testutil.Accumulator {
+		var acc testutil.Accumulator
+		batch := &perfCounterBatch{}
+		batch.add(perfCounter{"perf", tags, "Batch Requests/sec", "Batch Requests/sec", batches, perfCounterBulkCount, tm})
+		batch.add(perfCounter{"perf", tags, "User Connections", "User Connections", int64(12), perfLargeRawcount, tm})
+		batch.add(perfCounter{"perf", tags, "Cache Hit Ratio", "Cache Hit Ratio", int64(45), perfLargeRawFraction, tm})
+		batch.add(perfCounter{"perf", tags, "Cache Hit Ratio Base", "Cache Hit Ratio Base", int64(50), perfLargeRawBase, tm})
+		batch.add(perfCounter{"perf", tags, "Avg Disk Read IO (ms)", "Avg Disk Read IO (ms)", waits, perfAverageBulk, tm})
+		batch.add(perfCounter{"perf", tags, "Avg Disk Read IO (ms) Base", "Avg Disk Read IO (ms) Base", waitBase, perfLargeRawBase, tm})
+		batch.emit(&acc, series)
+		return &acc
+	}
+
+	start := time.Unix(1600000000, 0)
+	acc := gather(start, 1000, 300, 10)
+	require.Equal(t, uint64(2), acc.NMetrics())
+	acc.AssertContainsTaggedFields(t, "perf", map[string]interface{}{"User Connections": int64(12)}, tags)
+	acc.AssertContainsTaggedFields(t, "perf", map[string]interface{}{"Cache Hit Ratio": float64(90)}, tags)
+
+	acc = gather(start.Add(10*time.Second), 1500, 500, 20)
+	require.Equal(t, uint64(4), acc.NMetrics())
+	acc.AssertContainsTaggedFields(t, "perf", map[string]interface{}{"Batch Requests/sec": float64(50)}, tags)
+	acc.AssertContainsTaggedFields(t, "perf", map[string]interface{}{"Avg Disk Read IO (ms)": float64(20)}, tags)
+
+	// counters reset by a restart of the service start over
+	acc = gather(start.Add(20*time.Second), 100, 20, 1)
+	require.Equal(t, uint64(2), acc.NMetrics())
+	assert.False(t, acc.HasField("perf", "Batch Requests/sec"))
+	assert.False(t, acc.HasField("perf", "Avg Disk Read IO (ms)"))
+}
+
+func TestAccResultsPivotCounterTypes(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	query := Query{
+		Name:             "counters",
+		Measurement:      "perf",
+		Pivot:            true,
+		PivotNameColumn:  "counter_name",
+		PivotValueColumn: "cntr_value",
+		counters:         newCounterStore().get("sql01", "counters"),
+	}
+	rows := &mockResults{sets: []mockResultSet{{
+		columns: []string{"object_name", "counter_name", "cntr_value", "cntr_type"},
+		rows: []mockRow{
+			{"SQLServer:Buffer Manager", "Buffer cache hit ratio", int64(99), int64(perfLargeRawFraction)},
+			{"SQLServer:Buffer Manager", "Buffer cache hit ratio base", int64(100), int64(perfLargeRawBase)},
+			{"SQLServer:Buffer Manager", "Page life expectancy", int64(3600), int64(perfLargeRawcount)},
+			{"SQLServer:Buffer Manager", "Lazy writes/sec", int64(12), int64(perfCounterBulkCount)},
+		},
+	}}}
+	count, err := s.accResults(query, &acc, rows)
+	require.NoError(t, err)
+	require.Equal(t, 4, count)
+
+	require.Equal(t, uint64(1), acc.NMetrics())
+	acc.AssertContainsTaggedFields(t, "perf",
+		map[string]interface{}{"Buffer cache hit ratio": float64(99), "Page life expectancy": int64(3600)},
+		map[string]string{"object_name": "SQLServer:Buffer Manager", "query_name": "counters"})
+}
+
+func TestAccResultsPivotCountersRenamed(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	query := Query{
+		Name:             "counters",
+		Measurement:      "perf",
+		Pivot:            true,
+		PivotNameColumn:  "counter_name",
+		PivotValueColumn: "cntr_value",
+		Rename:           map[string]string{"Buffer cache hit ratio": "buffer_cache_hit_ratio"},
+		counters:         newCounterStore().get("sql01", "counters"),
+	}
+	rows := &mockResults{sets: []mockResultSet{{
+		columns: []string{"object_name", "counter_name", "cntr_value", "cntr_type"},
+		rows: []mockRow{
+			{"SQLServer:Buffer Manager", "Buffer cache hit ratio", int64(99), int64(perfLargeRawFraction)},
+			{"SQLServer:Buffer Manager", "Buffer cache hit ratio base", int64(100), int64(perfLargeRawBase)},
+			// rows without a counter type are left out
+			{"SQLServer:Buffer Manager", "Page life expectancy", int64(3600), nil},
+		},
+	}}}
+	count, err := s.accResults(query, &acc, rows)
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+
+	require.Empty(t, acc.Errors)
+	require.Equal(t, uint64(1), acc.NMetrics())
+	acc.AssertContainsTaggedFields(t, "perf",
+		map[string]interface{}{"buffer_cache_hit_ratio": float64(99)},
+		map[string]string{"object_name": "SQLServer:Buffer Manager", "query_name": "counters"})
+}
@@ -0,0 +1,69 @@
+package sqlserver_extended
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// credentialRe matches the $ENV{NAME} and $FILE{path} references in
+// connection strings which are resolved whenever a connection is established
+var credentialRe = regexp.MustCompile(`\$(ENV|FILE)\{([^}]*)\}`)
+
+// hasCredentials reports whether the connection string references credentials
+func hasCredentials(dsn string) bool {
+	return credentialRe.MatchString(dsn)
+}
+
+// resolveCredentials replaces the credential references of the connection
+// string with their current values
+func resolveCredentials(dsn string) (string, error) {
+	var err error
+	resolved := credentialRe.ReplaceAllStringFunc(dsn, func(ref string) string {
+		match := credentialRe.FindStringSubmatch(ref)
+		value, resolveErr := resolveCredential(match[1], match[2])
+		if resolveErr != nil && err == nil {
+			err = resolveErr
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// resolveCredential returns the value of an environment variable or the
+// content of a file, ignoring surrounding whitespace such as the trailing
+// newline of mounted secrets
+func resolveCredential(kind, name string) (string, error) {
+	var value string
+	switch kind {
+	case "ENV":
+		var ok bool
+		if value, ok = os.LookupEnv(name); !ok {
+			return "", fmt.Errorf("environment variable %q is not set", name)
+		}
+	case "FILE":
+		content, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", fmt.Errorf("reading credentials failed: %v", err)
+		}
+		value = strings.TrimSpace(string(content))
+	}
+
+	if strings.Contains(value, ";") {
+		return "", fmt.Errorf("credentials from %s %q must not contain a semicolon", strings.ToLower(kind), name)
+	}
+	return value, nil
+}
+
+// fileReference returns the $FILE{path} reference to the file
+func fileReference(path string) (string, error) {
+	if strings.ContainsAny(path, ";}") {
+		return "", fmt.Errorf("path %q must not contain a semicolon or closing brace", path)
+	}
+	return "$FILE{" + path + "}", nil
+}
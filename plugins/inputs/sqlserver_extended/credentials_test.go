@@ -0,0 +1,80 @@
+package sqlserver_extended
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveCredentials(t *testing.T) {
+	os.Setenv("SQLSERVER_EXTENDED_TEST_USER", "telegraf")
+	defer os.Unsetenv("SQLSERVER_EXTENDED_TEST_USER")
+	os.Setenv("SQLSERVER_EXTENDED_TEST_PASSWORD", "secret")
+	defer os.Unsetenv("SQLSERVER_EXTENDED_TEST_PASSWORD")
+
+	dsn := "Server=sql01;User Id=$ENV{SQLSERVER_EXTENDED_TEST_USER};Password=$ENV{SQLSERVER_EXTENDED_TEST_PASSWORD}"
+	require.True(t, hasCredentials(dsn))
+	resolved, err := resolveCredentials(dsn)
+	require.NoError(t, err)
+	assert.Equal(t, "Server=sql01;User Id=telegraf;Password=secret", resolved)
+
+	// changed values are picked up by the next connection
+	os.Setenv("SQLSERVER_EXTENDED_TEST_PASSWORD", "rotated")
+	resolved, err = resolveCredentials(dsn)
+	require.NoError(t, err)
+	assert.Equal(t, "Server=sql01;User Id=telegraf;Password=rotated", resolved)
+
+	assert.False(t, hasCredentials("Server=sql01;Password=secret"))
+}
+
+func TestResolveCredentialsInvalid(t *testing.T) {
+	_, err := resolveCredentials("Server=sql01;Password=$ENV{SQLSERVER_EXTENDED_TEST_UNSET}")
+	require.Error(t, err)
+
+	os.Setenv("SQLSERVER_EXTENDED_TEST_PASSWORD", "sec;ret")
+	defer os.Unsetenv("SQLSERVER_EXTENDED_TEST_PASSWORD")
+	_, err = resolveCredentials("Server=sql01;Password=$ENV{SQLSERVER_EXTENDED_TEST_PASSWORD}")
+	require.Error(t, err)
+}
+
+func TestResolveCredentialsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlserver_extended")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "password")
+	require.NoError(t, ioutil.WriteFile(path, []byte("secret\n"), 0600))
+
+	c := ServerConfig{Host: "sql01", User: "telegraf", PasswordFile: path}
+	dsn, err := c.connectionString()
+	require.NoError(t, err)
+	require.True(t, hasCredentials(dsn))
+
+	resolved, err := resolveCredentials(dsn)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", parseConnectionString(resolved)["password"])
+
+	// rotated secrets are read again
+	require.NoError(t, ioutil.WriteFile(path, []byte("rotated\n"), 0600))
+	resolved, err = resolveCredentials(dsn)
+	require.NoError(t, err)
+	assert.Equal(t, "rotated", parseConnectionString(resolved)["password"])
+
+	require.NoError(t, os.Remove(path))
+	_, err = resolveCredentials(dsn)
+	require.Error(t, err)
+}
+
+func TestCredentialFilesExclusive(t *testing.T) {
+	c := ServerConfig{Host: "sql01", Password: "secret", PasswordFile: "/run/secrets/password"}
+	_, err := c.connectionString()
+	require.Error(t, err)
+
+	c = ServerConfig{Host: "sql01", User: "telegraf", UserFile: "/run/secrets/user"}
+	_, err = c.connectionString()
+	require.Error(t, err)
+}
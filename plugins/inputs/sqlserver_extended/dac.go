@@ -0,0 +1,39 @@
+package sqlserver_extended
+
+import (
+	"context"
+
+	"github.com/influxdata/telegraf"
+)
+
+// dacParam marks the connection strings of Dedicated Admin Connections, it is
+// removed before the connection string is passed to the driver
+const dacParam = "telegraf_dac"
+
+// dacServer returns the connection string of the DAC of the server
+func dacServer(server string) string {
+	return withParams(server, map[string]string{dacParam: "true"})
+}
+
+// gatherDAC runs the DAC fallback queries on the Dedicated Admin Connection
+// of a server refusing regular connections, e.g. when it is out of worker
+// threads. The metrics are tagged with dac.
+func (s *SQLServerExtended) gatherDAC(ctx context.Context, server string, queries []Query, acc telegraf.Accumulator) {
+	if s.dacQueries == nil {
+		return
+	}
+
+	var selected []Query
+	for _, query := range queries {
+		if s.dacQueries.Match(query.Name) {
+			selected = append(selected, query)
+		}
+	}
+	if len(selected) == 0 {
+		return
+	}
+
+	s.Log.Debugf("Running %d queries on the Dedicated Admin Connection of server %q", len(selected), serverName(parseConnectionString(server)))
+	acc = &taggingAccumulator{Accumulator: acc, tags: map[string]string{"dac": "true"}}
+	s.gatherQueries(ctx, dacServer(server), selected, acc)
+}
@@ -0,0 +1,424 @@
+package sqlserver_extended
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/filter"
+	"github.com/miekg/dns"
+)
+
+// defaultDiscoveryInterval is the time the discovered servers are cached
+const defaultDiscoveryInterval = 5 * time.Minute
+
+// defaultDiscoveryTimeout bounds the CMS query and the Azure requests
+const defaultDiscoveryTimeout = 30 * time.Second
+
+// defaultDNSTimeout bounds a query of a name server
+const defaultDNSTimeout = 5 * time.Second
+
+// discoverer lists the servers to collect from in addition to the configured
+// ones
+type discoverer interface {
+	discover(ctx context.Context) ([]discoveredServer, error)
+}
+
+// discoveredServer is the connection string of a discovered server and the
+// tags added to its metrics
+type discoveredServer struct {
+	server string
+	tags   map[string]string
+}
+
+// newDiscoverer returns the discoverer of the discovery mode
+func (s *SQLServerExtended) newDiscoverer() (discoverer, error) {
+	switch s.Discovery {
+	case "":
+		return nil, nil
+	case "dns_srv":
+		if s.DNSSRVRecord == "" {
+			return nil, fmt.Errorf("discovery %q requires dns_srv_record", s.Discovery)
+		}
+		return &srvDiscoverer{record: s.DNSSRVRecord, base: s.DiscoveryConnectionString, resolver: newDNSResolver(s.DNSServers)}, nil
+	case "cms":
+		if s.CMSServer == "" {
+			return nil, fmt.Errorf("discovery %q requires cms_server", s.Discovery)
+		}
+		groups, err := filter.Compile(s.CMSGroups)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cms_groups: %v", err)
+		}
+		return &cmsDiscoverer{
+			server:  s.CMSServer,
+			groups:  groups,
+			base:    s.DiscoveryConnectionString,
+			pools:   s.pools,
+			timeout: s.DiscoveryTimeout.Duration,
+		}, nil
+	case "azure":
+		return newAzureDiscoverer(s.AzureSubscriptionID, s.AzureResourceGroups, s.AzureTags, s.DiscoveryConnectionString, s.DiscoveryTimeout.Duration)
+	}
+	return nil, fmt.Errorf("unknown discovery %q", s.Discovery)
+}
+
+// discoveryCache keeps the discovered servers between the refreshes
+type discoveryCache struct {
+	sync.Mutex
+	discoverer discoverer
+	interval   time.Duration
+
+	servers []discoveredServer
+}
+
+// refresh discovers the servers, the previous servers are kept if the
+// discovery fails
+func (c *discoveryCache) refresh(ctx context.Context) error {
+	servers, err := c.discoverer.discover(ctx)
+	if err != nil {
+		return fmt.Errorf("discovering servers failed: %v", err)
+	}
+	c.Lock()
+	c.servers = servers
+	c.Unlock()
+	return nil
+}
+
+// get returns the servers of the last successful discovery
+func (c *discoveryCache) get() []discoveredServer {
+	c.Lock()
+	defer c.Unlock()
+	return c.servers
+}
+
+// run refreshes the discovered servers every interval until the context is
+// cancelled
+func (c *discoveryCache) run(ctx context.Context, acc telegraf.Accumulator) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.refresh(ctx); err != nil && ctx.Err() == nil {
+				acc.AddError(err)
+			}
+		}
+	}
+}
+
+// gatherServers returns the configured servers, the ones of the servers file
+// and the discovered servers, and the tags of the servers defining any
+func (s *SQLServerExtended) gatherServers() ([]string, map[string]map[string]string) {
+	if s.discovery == nil && s.serversFile == nil {
+		return s.servers, s.serverTags
+	}
+
+	var discovered []discoveredServer
+	if s.serversFile != nil {
+		discovered = append(discovered, s.serversFile.servers...)
+	}
+	if s.discovery != nil {
+		discovered = append(discovered, s.discovery.get()...)
+	}
+	servers := append([]string(nil), s.servers...)
+	tags := make(map[string]map[string]string, len(s.serverTags))
+	for server, t := range s.serverTags {
+		tags[server] = t
+	}
+	seen := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		seen[server] = true
+	}
+	for _, d := range discovered {
+		if seen[d.server] {
+			continue
+		}
+		seen[d.server] = true
+		servers = append(servers, d.server)
+		if len(d.tags) > 0 {
+			tags[d.server] = d.tags
+		}
+	}
+	return servers, tags
+}
+
+// own records the connection strings derived from the gathered server, also
+// for its Dedicated Admin Connection
+func (s *SQLServerExtended) own(server string, derived ...string) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	for _, d := range derived {
+		if d == "" {
+			continue
+		}
+		for _, key := range []string{d, dacServer(d)} {
+			if s.owners[key] == nil {
+				s.owners[key] = make(map[string]bool)
+			}
+			s.owners[key][server] = true
+		}
+	}
+}
+
+// releaseServers closes the connection pools and drops the state of the
+// servers which are no longer gathered, e.g. as they left the discovered
+// servers. The state file keeps their watermarks in case they come back.
+func (s *SQLServerExtended) releaseServers(servers []string) {
+	current := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		current[server] = true
+	}
+
+	var released []string
+	s.statusLock.Lock()
+	for key, owners := range s.owners {
+		for owner := range owners {
+			if !current[owner] {
+				delete(owners, owner)
+			}
+		}
+		if len(owners) == 0 {
+			delete(s.owners, key)
+			delete(s.status, key)
+			released = append(released, key)
+		}
+	}
+	s.statusLock.Unlock()
+	if len(released) == 0 {
+		return
+	}
+
+	s.pools.release(released...)
+	s.counters.release(released...)
+	s.cache.release(released...)
+}
+
+// resolvConf lists the name servers used without dns_servers
+const resolvConf = "/etc/resolv.conf"
+
+// srvResolver looks up the SRV records of a name and the time they may be
+// cached for
+type srvResolver interface {
+	lookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error)
+}
+
+// dnsResolver queries the name servers directly, unlike the system resolver
+// it reports the TTL of the records
+type dnsResolver struct {
+	// servers are the name servers as host:port, read from resolv.conf on
+	// every lookup if empty
+	servers []string
+	udp     *dns.Client
+	tcp     *dns.Client
+}
+
+func newDNSResolver(servers []string) *dnsResolver {
+	r := &dnsResolver{
+		udp: &dns.Client{Net: "udp", Timeout: defaultDNSTimeout},
+		tcp: &dns.Client{Net: "tcp", Timeout: defaultDNSTimeout},
+	}
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		r.servers = append(r.servers, server)
+	}
+	return r
+}
+
+// nameServers returns the configured name servers or those of resolv.conf
+func (r *dnsResolver) nameServers() ([]string, error) {
+	if len(r.servers) > 0 {
+		return r.servers, nil
+	}
+	config, err := dns.ClientConfigFromFile(resolvConf)
+	if err != nil {
+		return nil, fmt.Errorf("reading name servers failed, set dns_servers: %v", err)
+	}
+	servers := make([]string, 0, len(config.Servers))
+	for _, server := range config.Servers {
+		servers = append(servers, net.JoinHostPort(server, config.Port))
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no name servers in %s, set dns_servers", resolvConf)
+	}
+	return servers, nil
+}
+
+// lookupSRV asks the name servers in turn for the SRV records of the name,
+// the records may be cached for the lowest of their TTLs
+func (r *dnsResolver) lookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	servers, err := r.nameServers()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeSRV)
+	msg.RecursionDesired = true
+	for _, server := range servers {
+		var resp *dns.Msg
+		resp, _, err = r.udp.ExchangeContext(ctx, msg, server)
+		if err == nil && resp.Truncated {
+			resp, _, err = r.tcp.ExchangeContext(ctx, msg, server)
+		}
+		if err != nil {
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			return nil, 0, fmt.Errorf("looking up %q failed: %s", name, dns.RcodeToString[resp.Rcode])
+		}
+
+		var records []*net.SRV
+		var ttl uint32
+		for _, answer := range resp.Answer {
+			srv, ok := answer.(*dns.SRV)
+			if !ok {
+				continue
+			}
+			if len(records) == 0 || srv.Hdr.Ttl < ttl {
+				ttl = srv.Hdr.Ttl
+			}
+			records = append(records, &net.SRV{Target: srv.Target, Port: srv.Port, Priority: srv.Priority, Weight: srv.Weight})
+		}
+		sort.Slice(records, func(i, j int) bool {
+			if records[i].Priority != records[j].Priority {
+				return records[i].Priority < records[j].Priority
+			}
+			return records[i].Target < records[j].Target
+		})
+		return records, time.Duration(ttl) * time.Second, nil
+	}
+	return nil, 0, fmt.Errorf("looking up %q failed: %v", name, err)
+}
+
+// srvDiscoverer resolves the servers from the targets of a DNS SRV record,
+// the records are reused until their TTL expires
+type srvDiscoverer struct {
+	sync.Mutex
+	record   string
+	base     string
+	resolver srvResolver
+
+	records []*net.SRV
+	expires time.Time
+}
+
+func (d *srvDiscoverer) discover(ctx context.Context) ([]discoveredServer, error) {
+	d.Lock()
+	defer d.Unlock()
+	if now := time.Now(); !now.Before(d.expires) {
+		records, ttl, err := d.resolver.lookupSRV(ctx, d.record)
+		if err != nil {
+			return nil, err
+		}
+		d.records, d.expires = records, now.Add(ttl)
+	}
+
+	servers := make([]discoveredServer, 0, len(d.records))
+	for _, record := range d.records {
+		host := strings.TrimSuffix(record.Target, ".")
+		server := withServer(withoutParams(d.base, "port"), host)
+		server = withParams(server, map[string]string{"port": strconv.Itoa(int(record.Port))})
+		servers = append(servers, discoveredServer{server: server})
+	}
+	return servers, nil
+}
+
+const sqlRegisteredServers = `WITH groups AS (
+	SELECT server_group_id, CAST(N'' AS nvarchar(max)) AS path
+	FROM msdb.dbo.sysmanagement_shared_server_groups
+	WHERE parent_id IS NULL
+	UNION ALL
+	SELECT g.server_group_id, CAST(p.path + N'/' + g.name AS nvarchar(max))
+	FROM msdb.dbo.sysmanagement_shared_server_groups AS g
+	JOIN groups AS p ON g.parent_id = p.server_group_id
+)
+SELECT s.server_name, g.path
+FROM msdb.dbo.sysmanagement_shared_registered_servers AS s
+JOIN groups AS g ON g.server_group_id = s.server_group_id`
+
+// cmsDiscoverer lists the servers registered in a Central Management Server
+type cmsDiscoverer struct {
+	server  string
+	groups  filter.Filter
+	base    string
+	pools   *connectionPools
+	timeout time.Duration
+}
+
+func (d *cmsDiscoverer) discover(ctx context.Context) ([]discoveredServer, error) {
+	conn, err := d.pools.get(d.server)
+	if err != nil {
+		return nil, err
+	}
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+
+	rows, err := conn.QueryContext(ctx, sqlRegisteredServers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	registered := make(map[string][]string)
+	for rows.Next() {
+		var name, path string
+		if err := rows.Scan(&name, &path); err != nil {
+			return nil, err
+		}
+		registered[name] = append(registered[name], strings.TrimPrefix(path, "/"))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var servers []discoveredServer
+	for _, server := range cmsServers(registered, d.groups, d.base) {
+		servers = append(servers, discoveredServer{server: server})
+	}
+	return servers, nil
+}
+
+// cmsServers returns the connection strings of the registered servers in one
+// of the groups or their subgroups, the group paths are separated by slashes
+func cmsServers(registered map[string][]string, groups filter.Filter, base string) []string {
+	var servers []string
+	for name, paths := range registered {
+		if groups != nil && !inGroups(paths, groups) {
+			continue
+		}
+		// registered names can carry the port as "host,port"
+		server := withServer(base, name)
+		if i := strings.LastIndex(name, ","); i > 0 {
+			server = withServer(withoutParams(base, "port"), strings.TrimSpace(name[:i]))
+			server = withParams(server, map[string]string{"port": strings.TrimSpace(name[i+1:])})
+		}
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	return servers
+}
+
+// inGroups reports whether one of the group paths or its parents matches
+func inGroups(paths []string, groups filter.Filter) bool {
+	for _, path := range paths {
+		parts := strings.Split(path, "/")
+		for i := len(parts); i > 0; i-- {
+			if groups.Match(strings.Join(parts[:i], "/")) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+package sqlserver_extended
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/influxdata/telegraf/filter"
+)
+
+const (
+	azureManagementEndpoint  = "https://management.azure.com"
+	azureServersAPIVersion   = "2019-06-01-preview"
+	azureInstancesAPIVersion = "2018-06-01-preview"
+)
+
+// azureResource is the part of an Azure SQL server, database or managed
+// instance resource used for the discovery
+type azureResource struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Location   string            `json:"location"`
+	Tags       map[string]string `json:"tags"`
+	Properties struct {
+		FullyQualifiedDomainName string `json:"fullyQualifiedDomainName"`
+		Status                   string `json:"status"`
+	} `json:"properties"`
+}
+
+// azureResourceList is a page of resources returned by the Resource Manager
+type azureResourceList struct {
+	Value    []azureResource `json:"value"`
+	NextLink string          `json:"nextLink"`
+}
+
+// azureDiscoverer lists the Azure SQL databases and managed instances of a
+// subscription through the Azure Resource Manager API
+type azureDiscoverer struct {
+	subscription   string
+	resourceGroups filter.Filter
+	tags           map[string]string
+	base           string
+
+	endpoint   string
+	client     *http.Client
+	authorizer autorest.Authorizer
+}
+
+func newAzureDiscoverer(subscription string, resourceGroups []string, tags map[string]string, base string, timeout time.Duration) (*azureDiscoverer, error) {
+	if subscription == "" {
+		return nil, fmt.Errorf("discovery \"azure\" requires azure_subscription_id")
+	}
+	// resource group names are case-insensitive
+	groups := make([]string, 0, len(resourceGroups))
+	for _, group := range resourceGroups {
+		groups = append(groups, strings.ToLower(group))
+	}
+	f, err := filter.Compile(groups)
+	if err != nil {
+		return nil, fmt.Errorf("invalid azure_resource_groups: %v", err)
+	}
+	return &azureDiscoverer{
+		subscription:   subscription,
+		resourceGroups: f,
+		tags:           tags,
+		base:           base,
+		endpoint:       azureManagementEndpoint,
+		client:         &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (d *azureDiscoverer) discover(ctx context.Context) ([]discoveredServer, error) {
+	// the credentials are taken from the environment as by the azure_monitor
+	// output, falling back to the managed identity of the host
+	if d.authorizer == nil {
+		authorizer, err := auth.NewAuthorizerFromEnvironmentWithResource(azureManagementEndpoint + "/")
+		if err != nil {
+			return nil, err
+		}
+		d.authorizer = authorizer
+	}
+
+	var servers []discoveredServer
+	sqlServers, err := d.list(ctx, fmt.Sprintf("/subscriptions/%s/providers/Microsoft.Sql/servers?api-version=%s", d.subscription, azureServersAPIVersion))
+	if err != nil {
+		return nil, err
+	}
+	for _, server := range sqlServers {
+		if !d.inResourceGroups(server.ID) {
+			continue
+		}
+		databases, err := d.list(ctx, fmt.Sprintf("%s/databases?api-version=%s", server.ID, azureServersAPIVersion))
+		if err != nil {
+			return nil, err
+		}
+		for _, database := range databases {
+			// paused serverless databases would be resumed by connecting
+			if database.Name == "master" || (database.Properties.Status != "" && database.Properties.Status != "Online") {
+				continue
+			}
+			if !matchTags(d.tags, server.Tags, database.Tags) {
+				continue
+			}
+			dsn := withServer(withoutParams(d.base, "database", "initial catalog"), server.Properties.FullyQualifiedDomainName)
+			dsn = withParams(dsn, map[string]string{"database": database.Name})
+			servers = append(servers, discoveredServer{server: dsn, tags: d.resourceTags(database)})
+		}
+	}
+
+	instances, err := d.list(ctx, fmt.Sprintf("/subscriptions/%s/providers/Microsoft.Sql/managedInstances?api-version=%s", d.subscription, azureInstancesAPIVersion))
+	if err != nil {
+		return nil, err
+	}
+	for _, instance := range instances {
+		if !d.inResourceGroups(instance.ID) || !matchTags(d.tags, instance.Tags) {
+			continue
+		}
+		dsn := withServer(d.base, instance.Properties.FullyQualifiedDomainName)
+		servers = append(servers, discoveredServer{server: dsn, tags: d.resourceTags(instance)})
+	}
+
+	sort.Slice(servers, func(i, j int) bool { return servers[i].server < servers[j].server })
+	return servers, nil
+}
+
+// list returns the resources of all pages of a Resource Manager list request
+func (d *azureDiscoverer) list(ctx context.Context, path string) ([]azureResource, error) {
+	var resources []azureResource
+	for next := d.endpoint + path; next != ""; {
+		req, err := http.NewRequest(http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+		req, err = autorest.CreatePreparer(d.authorizer.WithAuthorization()).Prepare(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := d.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var page azureResourceList
+		err = decodeAzureResponse(resp, &page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, page.Value...)
+		next = page.NextLink
+	}
+	return resources, nil
+}
+
+// decodeAzureResponse decodes the body of a successful response
+func decodeAzureResponse(resp *http.Response, v interface{}) error {
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("listing %s failed: %s: %s", resp.Request.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (d *azureDiscoverer) inResourceGroups(id string) bool {
+	return d.resourceGroups == nil || d.resourceGroups.Match(strings.ToLower(resourceGroup(id)))
+}
+
+// resourceTags returns the tags describing the resource
+func (d *azureDiscoverer) resourceTags(r azureResource) map[string]string {
+	return map[string]string{
+		"azure_subscription_id": d.subscription,
+		"azure_resource_group":  resourceGroup(r.ID),
+		"azure_resource_name":   r.Name,
+		"azure_location":        r.Location,
+	}
+}
+
+// resourceGroup returns the resource group of a resource ID
+func resourceGroup(id string) string {
+	parts := strings.Split(id, "/")
+	for i := 0; i < len(parts)-1; i++ {
+		if strings.EqualFold(parts[i], "resourceGroups") {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// matchTags reports whether the resource tags contain all wanted tags, the
+// tags of later sets take precedence
+func matchTags(want map[string]string, sets ...map[string]string) bool {
+	for k, v := range want {
+		var found string
+		var ok bool
+		for _, tags := range sets {
+			if t, has := tags[k]; has {
+				found, ok = t, true
+			}
+		}
+		if !ok || found != v {
+			return false
+		}
+	}
+	return true
+}
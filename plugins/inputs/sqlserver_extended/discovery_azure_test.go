@@ -0,0 +1,199 @@
+package sqlserver_extended
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const azureSubscription = "00000000-0000-0000-0000-000000000001"
+
+func azureResourceManager(t *testing.T) *httptest.Server {
+	var srv *httptest.Server
+	resource := func(id, name, fqdn, status string, tags map[string]string) map[string]interface{} {
+		return map[string]interface{}{
+			"id":       id,
+			"name":     name,
+			"location": "westeurope",
+			"tags":     tags,
+			"properties": map[string]string{
+				"fullyQualifiedDomainName": fqdn,
+				"status":                   status,
+			},
+		}
+	}
+	prod := "/subscriptions/" + azureSubscription + "/resourceGroups/RG-Prod/providers/Microsoft.Sql/servers/sql01"
+	dev := "/subscriptions/" + azureSubscription + "/resourceGroups/rg-dev/providers/Microsoft.Sql/servers/sql02"
+	pages := map[string]interface{}{
+		"/subscriptions/" + azureSubscription + "/providers/Microsoft.Sql/servers": map[string]interface{}{
+			"value":    []interface{}{resource(prod, "sql01", "sql01.database.windows.net", "", map[string]string{"env": "prod"})},
+			"nextLink": "", // set below, it needs the address of the server
+		},
+		"/next": map[string]interface{}{
+			"value": []interface{}{resource(dev, "sql02", "sql02.database.windows.net", "", map[string]string{"env": "dev"})},
+		},
+		prod + "/databases": map[string]interface{}{
+			"value": []interface{}{
+				resource(prod+"/databases/master", "master", "", "Online", nil),
+				resource(prod+"/databases/orders", "orders", "", "Online", nil),
+				resource(prod+"/databases/archive", "archive", "", "Paused", nil),
+				resource(prod+"/databases/scratch", "scratch", "", "Online", map[string]string{"env": "test"}),
+			},
+		},
+		dev + "/databases": map[string]interface{}{
+			"value": []interface{}{resource(dev+"/databases/orders", "orders", "", "Online", nil)},
+		},
+		"/subscriptions/" + azureSubscription + "/providers/Microsoft.Sql/managedInstances": map[string]interface{}{
+			"value": []interface{}{resource(
+				"/subscriptions/"+azureSubscription+"/resourceGroups/rg-prod/providers/Microsoft.Sql/managedInstances/mi01",
+				"mi01", "mi01.abc123.database.windows.net", "", map[string]string{"env": "prod"},
+			)},
+		},
+	}
+
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Path == "/subscriptions/"+azureSubscription+"/providers/Microsoft.Sql/servers" {
+			page.(map[string]interface{})["nextLink"] = srv.URL + "/next"
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(page))
+	}))
+	return srv
+}
+
+func TestAzureDiscoverer(t *testing.T) {
+	srv := azureResourceManager(t)
+	defer srv.Close()
+
+	d, err := newAzureDiscoverer(azureSubscription, nil, nil, "User Id=telegraf;Database=ignored", 0)
+	require.NoError(t, err)
+	d.endpoint = srv.URL
+	d.authorizer = autorest.NullAuthorizer{}
+
+	servers, err := d.discover(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []discoveredServer{
+		{
+			server: "Server=mi01.abc123.database.windows.net;User Id=telegraf;Database=ignored",
+			tags: map[string]string{
+				"azure_subscription_id": azureSubscription,
+				"azure_resource_group":  "rg-prod",
+				"azure_resource_name":   "mi01",
+				"azure_location":        "westeurope",
+			},
+		},
+		{
+			server: "Server=sql01.database.windows.net;User Id=telegraf;database=orders",
+			tags: map[string]string{
+				"azure_subscription_id": azureSubscription,
+				"azure_resource_group":  "RG-Prod",
+				"azure_resource_name":   "orders",
+				"azure_location":        "westeurope",
+			},
+		},
+		{
+			server: "Server=sql01.database.windows.net;User Id=telegraf;database=scratch",
+			tags: map[string]string{
+				"azure_subscription_id": azureSubscription,
+				"azure_resource_group":  "RG-Prod",
+				"azure_resource_name":   "scratch",
+				"azure_location":        "westeurope",
+			},
+		},
+		{
+			server: "Server=sql02.database.windows.net;User Id=telegraf;database=orders",
+			tags: map[string]string{
+				"azure_subscription_id": azureSubscription,
+				"azure_resource_group":  "rg-dev",
+				"azure_resource_name":   "orders",
+				"azure_location":        "westeurope",
+			},
+		},
+	}, servers)
+}
+
+func TestAzureDiscovererFilters(t *testing.T) {
+	srv := azureResourceManager(t)
+	defer srv.Close()
+
+	d, err := newAzureDiscoverer(azureSubscription, []string{"rg-prod"}, map[string]string{"env": "prod"}, "", 0)
+	require.NoError(t, err)
+	d.endpoint = srv.URL
+	d.authorizer = autorest.NullAuthorizer{}
+
+	servers, err := d.discover(context.Background())
+	require.NoError(t, err)
+	var names []string
+	for _, s := range servers {
+		names = append(names, s.server)
+	}
+	// the tags of the database override the ones of its server
+	assert.Equal(t, []string{
+		"Server=mi01.abc123.database.windows.net",
+		"Server=sql01.database.windows.net;database=orders",
+	}, names)
+}
+
+func TestAzureDiscovererError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":{"code":"AuthorizationFailed"}}`, http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	d, err := newAzureDiscoverer(azureSubscription, nil, nil, "", 0)
+	require.NoError(t, err)
+	d.endpoint = srv.URL
+	d.authorizer = autorest.NullAuthorizer{}
+
+	_, err = d.discover(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "403 Forbidden")
+	assert.Contains(t, err.Error(), "AuthorizationFailed")
+}
+
+func TestResourceGroup(t *testing.T) {
+	assert.Equal(t, "rg-prod", resourceGroup("/subscriptions/1/resourceGroups/rg-prod/providers/Microsoft.Sql/servers/sql01"))
+	assert.Equal(t, "rg-prod", resourceGroup("/subscriptions/1/resourcegroups/rg-prod"))
+	assert.Equal(t, "", resourceGroup("/subscriptions/1"))
+}
+
+func TestAzureDiscoveryOptions(t *testing.T) {
+	s := &SQLServerExtended{Discovery: "azure", Log: testutil.Logger{}}
+	require.Error(t, s.Init())
+
+	s = &SQLServerExtended{Discovery: "azure", AzureSubscriptionID: azureSubscription, Log: testutil.Logger{}}
+	require.NoError(t, s.Init())
+	require.IsType(t, &azureDiscoverer{}, s.discovery.discoverer)
+	// the requests time out also without query_timeout
+	assert.Equal(t, defaultDiscoveryTimeout, s.discovery.discoverer.(*azureDiscoverer).client.Timeout)
+}
+
+func TestAzureDiscovererTimeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	d, err := newAzureDiscoverer(azureSubscription, nil, nil, "", 50*time.Millisecond)
+	require.NoError(t, err)
+	d.endpoint = srv.URL
+	d.authorizer = autorest.NullAuthorizer{}
+
+	_, err = d.discover(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Client.Timeout exceeded")
+}
@@ -0,0 +1,282 @@
+package sqlserver_extended
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/filter"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeResolver struct {
+	records []*net.SRV
+	ttl     time.Duration
+	calls   int
+}
+
+func (r *fakeResolver) lookupSRV(_ context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	r.calls++
+	return r.records, r.ttl, nil
+}
+
+type fakeDiscoverer struct {
+	sync.Mutex
+	servers []discoveredServer
+	err     error
+	calls   int
+}
+
+func (d *fakeDiscoverer) discover(context.Context) ([]discoveredServer, error) {
+	d.Lock()
+	defer d.Unlock()
+	d.calls++
+	return d.servers, d.err
+}
+
+func TestSRVDiscoverer(t *testing.T) {
+	d := &srvDiscoverer{
+		record: "_mssql._tcp.example.com",
+		base:   "Server=ignored;Port=1;User Id=telegraf",
+		resolver: &fakeResolver{records: []*net.SRV{
+			{Target: "sql01.example.com.", Port: 1433},
+			{Target: "sql02.example.com.", Port: 1533},
+		}},
+	}
+	servers, err := d.discover(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []discoveredServer{
+		{server: "Server=sql01.example.com;User Id=telegraf;port=1433"},
+		{server: "Server=sql02.example.com;User Id=telegraf;port=1533"},
+	}, servers)
+}
+
+func TestSRVDiscovererTTL(t *testing.T) {
+	resolver := &fakeResolver{
+		records: []*net.SRV{{Target: "sql01.example.com.", Port: 1433}},
+		ttl:     time.Hour,
+	}
+	d := &srvDiscoverer{record: "_mssql._tcp.example.com", resolver: resolver}
+	for i := 0; i < 3; i++ {
+		servers, err := d.discover(context.Background())
+		require.NoError(t, err)
+		require.Len(t, servers, 1)
+	}
+	assert.Equal(t, 1, resolver.calls)
+
+	// records without TTL are looked up again
+	resolver.ttl = 0
+	d = &srvDiscoverer{record: "_mssql._tcp.example.com", resolver: resolver}
+	for i := 0; i < 2; i++ {
+		_, err := d.discover(context.Background())
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 3, resolver.calls)
+}
+
+func TestDNSResolver(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		if req.Question[0].Name != "_mssql._tcp.example.com." {
+			resp.Rcode = dns.RcodeNameError
+			w.WriteMsg(resp)
+			return
+		}
+		for _, rr := range []string{
+			"_mssql._tcp.example.com. 300 IN SRV 10 5 1533 sql02.example.com.",
+			"_mssql._tcp.example.com. 60 IN SRV 0 5 1433 sql01.example.com.",
+		} {
+			record, err := dns.NewRR(rr)
+			if err == nil {
+				resp.Answer = append(resp.Answer, record)
+			}
+		}
+		w.WriteMsg(resp)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	r := newDNSResolver([]string{conn.LocalAddr().String()})
+	records, ttl, err := r.lookupSRV(context.Background(), "_mssql._tcp.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, ttl)
+	assert.Equal(t, []*net.SRV{
+		{Target: "sql01.example.com.", Port: 1433, Priority: 0, Weight: 5},
+		{Target: "sql02.example.com.", Port: 1533, Priority: 10, Weight: 5},
+	}, records)
+
+	_, _, err = r.lookupSRV(context.Background(), "_mssql._tcp.example.org")
+	require.EqualError(t, err, `looking up "_mssql._tcp.example.org" failed: NXDOMAIN`)
+
+	assert.Equal(t, []string{"10.0.0.2:53", "10.0.0.3:5353"}, newDNSResolver([]string{"10.0.0.2", "10.0.0.3:5353"}).servers)
+}
+
+func TestDiscoveryCache(t *testing.T) {
+	sql01 := []discoveredServer{{server: "Server=sql01"}}
+	sql02 := []discoveredServer{{server: "Server=sql02"}}
+	d := &fakeDiscoverer{servers: sql01}
+	c := &discoveryCache{discoverer: d, interval: time.Minute}
+	assert.Empty(t, c.get())
+
+	require.NoError(t, c.refresh(context.Background()))
+	assert.Equal(t, sql01, c.get())
+
+	d.servers = sql02
+	require.NoError(t, c.refresh(context.Background()))
+	assert.Equal(t, sql02, c.get())
+
+	// the previous servers are kept on failures
+	d.err = errors.New("lookup failed")
+	require.Error(t, c.refresh(context.Background()))
+	assert.Equal(t, sql02, c.get())
+	assert.Equal(t, 3, d.calls)
+}
+
+func TestGatherServers(t *testing.T) {
+	s := &SQLServerExtended{
+		Servers:      []string{"Server=sql01"},
+		Discovery:    "dns_srv",
+		DNSSRVRecord: "_mssql._tcp.example.com",
+		Log:          testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	assert.Equal(t, defaultDiscoveryInterval, s.discovery.interval)
+	assert.Equal(t, defaultDiscoveryTimeout, s.DiscoveryTimeout.Duration)
+
+	s.discovery.discoverer = &fakeDiscoverer{servers: []discoveredServer{
+		{server: "Server=sql01"},
+		{server: "Server=sql02", tags: map[string]string{"env": "prod"}},
+	}}
+	require.NoError(t, s.discovery.refresh(context.Background()))
+	servers, tags := s.gatherServers()
+	assert.Equal(t, []string{"Server=sql01", "Server=sql02"}, servers)
+	assert.Equal(t, map[string]map[string]string{"Server=sql02": {"env": "prod"}}, tags)
+}
+
+func TestGatherReleasesRemovedServers(t *testing.T) {
+	// closed ports refuse the connections, the pools are opened regardless
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	sql01 := fmt.Sprintf("Server=127.0.0.1;Port=%d;User Id=telegraf;Password=secret;encrypt=disable", port)
+	sql02 := fmt.Sprintf("Server=localhost;Port=%d;User Id=telegraf;Password=secret;encrypt=disable", port)
+
+	s := &SQLServerExtended{
+		Servers:      []string{sql01},
+		Discovery:    "dns_srv",
+		DNSSRVRecord: "_mssql._tcp.example.com",
+		Log:          testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	defer s.Stop()
+	d := &fakeDiscoverer{servers: []discoveredServer{{server: sql02}}}
+	s.discovery.discoverer = d
+	require.NoError(t, s.discovery.refresh(context.Background()))
+
+	var acc testutil.Accumulator
+	require.NoError(t, s.Gather(&acc))
+	s.counters.get(sql02, "waits")
+	s.cache.store(sql02, "waits", &cachedResult{})
+	assert.Contains(t, s.pools.pools, sql01)
+	assert.Contains(t, s.pools.pools, sql02)
+	assert.Contains(t, s.status, sql02)
+
+	// the server left the discovered servers
+	d.servers = nil
+	require.NoError(t, s.discovery.refresh(context.Background()))
+	require.NoError(t, s.Gather(&acc))
+	assert.Contains(t, s.pools.pools, sql01)
+	assert.Contains(t, s.status, sql01)
+	assert.NotContains(t, s.pools.pools, sql02)
+	assert.NotContains(t, s.status, sql02)
+	assert.NotContains(t, s.counters.series, sql02)
+	assert.NotContains(t, s.cache.results, sql02)
+	assert.NotContains(t, s.owners, sql02)
+}
+
+func TestDiscoveryStartStop(t *testing.T) {
+	s := &SQLServerExtended{
+		Discovery:    "dns_srv",
+		DNSSRVRecord: "_mssql._tcp.example.com",
+		Log:          testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	d := &fakeDiscoverer{err: errors.New("lookup failed")}
+	s.discovery.discoverer = d
+	s.discovery.interval = 10 * time.Millisecond
+
+	// a failing initial discovery does not prevent the start
+	var acc testutil.Accumulator
+	require.NoError(t, s.Start(&acc))
+	require.Len(t, acc.Errors, 1)
+
+	d.Lock()
+	d.servers, d.err = []discoveredServer{{server: "Server=sql01"}}, nil
+	d.Unlock()
+	require.Eventually(t, func() bool {
+		servers, _ := s.gatherServers()
+		return len(servers) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	s.Stop()
+	assert.Error(t, s.ctx.Err())
+}
+
+func TestDiscoveryOptions(t *testing.T) {
+	s := &SQLServerExtended{Discovery: "dns_srv", Log: testutil.Logger{}}
+	require.Error(t, s.Init())
+
+	s = &SQLServerExtended{Discovery: "zeroconf", Log: testutil.Logger{}}
+	require.Error(t, s.Init())
+
+	// no default server with discovery
+	s = &SQLServerExtended{Discovery: "dns_srv", DNSSRVRecord: "_mssql._tcp.example.com", Log: testutil.Logger{}}
+	require.NoError(t, s.Init())
+	assert.Empty(t, s.servers)
+}
+
+func TestCMSServers(t *testing.T) {
+	registered := map[string][]string{
+		`sql01\INST1`: {"Production"},
+		"sql02,1533":  {"Production/EU"},
+		"sql03":       {"Development"},
+		"sql04":       {""},
+	}
+	base := "User Id=telegraf;Port=1433"
+
+	groups, err := filter.Compile([]string{"Production"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		`Server=sql01\INST1;User Id=telegraf;Port=1433`,
+		"Server=sql02;User Id=telegraf;port=1533",
+	}, cmsServers(registered, groups, base))
+
+	groups, err = filter.Compile([]string{"Production/EU", "Dev*"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"Server=sql02;User Id=telegraf;port=1533",
+		"Server=sql03;User Id=telegraf;Port=1433",
+	}, cmsServers(registered, groups, base))
+
+	assert.Len(t, cmsServers(registered, nil, base), 4)
+}
+
+func TestCMSDiscoveryOptions(t *testing.T) {
+	s := &SQLServerExtended{Discovery: "cms", Log: testutil.Logger{}}
+	require.Error(t, s.Init())
+
+	s = &SQLServerExtended{Discovery: "cms", CMSServer: "Server=cms01", CMSGroups: []string{"Production"}, Log: testutil.Logger{}}
+	require.NoError(t, s.Init())
+	require.IsType(t, &cmsDiscoverer{}, s.discovery.discoverer)
+}
@@ -0,0 +1,51 @@
+package sqlserver_extended
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// isJSONColumn reports whether the column holds JSON documents to expand
+func (q *Query) isJSONColumn(column string) bool {
+	return q.JSONColumns != nil && q.JSONColumns.Match(column)
+}
+
+// expandJSON flattens the JSON document held by a column into fields named
+// by the dotted path of the values below the name, e.g. "waits.0.wait_ms"
+// for the column "waits" holding [{"wait_ms": 10}]. JSON null values are
+// left out.
+func expandJSON(name string, value interface{}, fields map[string]interface{}) error {
+	var document string
+	switch v := value.(type) {
+	case string:
+		document = v
+	case []byte:
+		document = string(v)
+	default:
+		return fmt.Errorf("expected a JSON string but got %T", value)
+	}
+
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(document), &parsed); err != nil {
+		return fmt.Errorf("parsing JSON failed: %v", err)
+	}
+	flattenJSON(name, parsed, fields)
+	return nil
+}
+
+func flattenJSON(name string, value interface{}, fields map[string]interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			flattenJSON(name+"."+key, child, fields)
+		}
+	case []interface{}:
+		for i, child := range v {
+			flattenJSON(name+"."+strconv.Itoa(i), child, fields)
+		}
+	case nil:
+	default:
+		fields[name] = v
+	}
+}
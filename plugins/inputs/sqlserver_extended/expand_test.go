@@ -0,0 +1,35 @@
+package sqlserver_extended
+
+import (
+	"testing"
+
+	"github.com/influxdata/telegraf/filter"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccRowJSONColumns(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	jsonColumns, err := filter.Compile([]string{"waits"})
+	require.NoError(t, err)
+	query := Query{
+		Name:           "session_waits",
+		JSONColumns:    jsonColumns,
+		OrderedColumns: []string{"measurement", "session", "waits"},
+	}
+	waits := `[{"wait_type": "LCK_M_S", "wait_ms": 10, "signal": null}, {"wait_type": "WRITELOG", "wait_ms": 2.5, "blocked": true}]`
+	require.NoError(t, s.accRow(query, &acc, mockRow{"waits", "52", waits}))
+	acc.AssertContainsTaggedFields(t, "waits",
+		map[string]interface{}{
+			"waits.0.wait_type": "LCK_M_S",
+			"waits.0.wait_ms":   float64(10),
+			"waits.1.wait_type": "WRITELOG",
+			"waits.1.wait_ms":   2.5,
+			"waits.1.blocked":   true,
+		},
+		map[string]string{"session": "52", "query_name": "session_waits"})
+
+	require.Error(t, s.accRow(query, &acc, mockRow{"waits", "52", "{not json"}))
+}
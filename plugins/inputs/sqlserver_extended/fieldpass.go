@@ -0,0 +1,27 @@
+package sqlserver_extended
+
+import (
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/filter"
+)
+
+// fieldFilterAccumulator leaves out the fields not passing the fieldpass and
+// fielddrop of the query and metrics without any remaining field
+type fieldFilterAccumulator struct {
+	telegraf.Accumulator
+	filter filter.Filter
+}
+
+func (a *fieldFilterAccumulator) AddFields(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	passed := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		if a.filter.Match(k) {
+			passed[k] = v
+		}
+	}
+	if len(passed) > 0 {
+		a.Accumulator.AddFields(measurement, passed, tags, t...)
+	}
+}
@@ -0,0 +1,51 @@
+package sqlserver_extended
+
+import (
+	"testing"
+
+	"github.com/influxdata/telegraf/filter"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccResultsFieldFilter(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	fieldFilter, err := filter.NewIncludeExcludeFilter([]string{"read*", "stall"}, []string{"reads_text"})
+	require.NoError(t, err)
+	rows := &mockResults{sets: []mockResultSet{{
+		columns: []string{"measurement", "file", "field_reads", "field_writes", "field_stall"},
+		rows: []mockRow{
+			{"io", "data", int64(5), int64(7), 1.5},
+			{"io", "log", nil, int64(3), nil},
+		},
+	}}}
+	_, err = s.accResults(Query{Name: "io", FieldFilter: fieldFilter}, &acc, rows)
+	require.NoError(t, err)
+
+	require.Equal(t, uint64(1), acc.NMetrics())
+	acc.AssertContainsTaggedFields(t, "io",
+		map[string]interface{}{"reads": int64(5), "stall": 1.5},
+		map[string]string{"file": "data", "query_name": "io"})
+}
+
+func TestAccRowUnpivotFieldFilter(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	fieldFilter, err := filter.NewIncludeExcludeFilter(nil, []string{"writes"})
+	require.NoError(t, err)
+	query := Query{
+		Name:           "io",
+		Unpivot:        true,
+		FieldFilter:    fieldFilter,
+		OrderedColumns: []string{"measurement", "field_reads", "field_writes"},
+	}
+	require.NoError(t, s.accRow(query, &acc, mockRow{"io", int64(5), int64(7)}))
+
+	require.Equal(t, uint64(1), acc.NMetrics())
+	acc.AssertContainsTaggedFields(t, "io",
+		map[string]interface{}{"value": int64(5)},
+		map[string]string{"name": "reads", "query_name": "io"})
+}
@@ -0,0 +1,56 @@
+package sqlserver_extended
+
+import (
+	"strings"
+	"unicode"
+)
+
+// normalizeName turns a column name into lowercase snake_case, e.g.
+// "page_life_expectancy" for "[Page Life Expectancy]" and "ple_count" for
+// "PLECount". Brackets, quotes and all other characters besides letters and
+// digits separate words, the dots of expanded JSON paths are kept.
+func normalizeName(name string) string {
+	segments := strings.Split(name, ".")
+	normalized := segments[:0]
+	for _, segment := range segments {
+		if s := normalizeSegment(segment); s != "" {
+			normalized = append(normalized, s)
+		}
+	}
+	return strings.Join(normalized, ".")
+}
+
+func normalizeSegment(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	separate := false
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			separate = b.Len() > 0
+			continue
+		}
+		// words of camel case names start with an upper case letter following
+		// a lower case letter or digit, or ending a run of upper case letters
+		if unicode.IsUpper(r) && i > 0 && b.Len() > 0 {
+			prev := runes[i-1]
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) ||
+				(unicode.IsUpper(prev) && i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				separate = true
+			}
+		}
+		if separate {
+			b.WriteRune('_')
+			separate = false
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// normalizePaths adds the fields expanded from a JSON column with their
+// paths below the field name of the column normalized
+func normalizePaths(name string, expanded, fields map[string]interface{}) {
+	for path, value := range expanded {
+		fields[name+"."+normalizeName(strings.TrimPrefix(path, name+"."))] = value
+	}
+}
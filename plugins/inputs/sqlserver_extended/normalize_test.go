@@ -0,0 +1,78 @@
+package sqlserver_extended
+
+import (
+	"testing"
+
+	"github.com/influxdata/telegraf/filter"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"page_life_expectancy", "page_life_expectancy"},
+		{"[Page Life Expectancy]", "page_life_expectancy"},
+		{`"Wait Time (ms)"`, "wait_time_ms"},
+		{"PageLifeExpectancy", "page_life_expectancy"},
+		{"PLECount", "ple_count"},
+		{"io_stall_read_ms", "io_stall_read_ms"},
+		{"Lazy writes/sec", "lazy_writes_sec"},
+		{"Log2Flushes", "log2_flushes"},
+		{"waits.0.WaitMs", "waits.0.wait_ms"},
+		{"  total  ", "total"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, normalizeName(tt.name), tt.name)
+	}
+}
+
+func TestAccResultsNormalizeNames(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{NormalizeNames: true}
+
+	columns, err := newColumnRoles(nil, nil, "", "")
+	require.NoError(t, err)
+	rows := &mockResults{sets: []mockResultSet{{
+		columns: []string{"measurement", "[Database Name]", "TotalReads"},
+		rows:    []mockRow{{"io", "tempdb", int64(5)}},
+	}}}
+	_, err = s.accResults(Query{Name: "io", Columns: columns}, &acc, rows)
+	require.NoError(t, err)
+	acc.AssertContainsTaggedFields(t, "io",
+		map[string]interface{}{"total_reads": int64(5)},
+		map[string]string{"database_name": "tempdb", "query_name": "io"})
+}
+
+func TestAccResultsNormalizeNamesOrder(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{NormalizeNames: true}
+
+	columns, err := newColumnRoles(nil, nil, "", "")
+	require.NoError(t, err)
+	fieldFilter, err := filter.NewIncludeExcludeFilter([]string{"total_reads", "ReadsPerFile", "stats.*"}, nil)
+	require.NoError(t, err)
+	jsonColumns, err := filter.Compile([]string{"stats"})
+	require.NoError(t, err)
+	query := Query{
+		Name:        "io",
+		Columns:     columns,
+		FieldFilter: fieldFilter,
+		// rename and the field filter match the normalized column names, the
+		// new names are kept as given
+		Rename:      map[string]string{"total_reads": "ReadsPerFile"},
+		JSONColumns: jsonColumns,
+	}
+	rows := &mockResults{sets: []mockResultSet{{
+		columns: []string{"measurement", "[Database Name]", "TotalReads", "TotalWrites", "Stats"},
+		rows:    []mockRow{{"io", "tempdb", int64(5), int64(7), `{"StallMs": 3}`}},
+	}}}
+	_, err = s.accResults(query, &acc, rows)
+	require.NoError(t, err)
+	acc.AssertContainsTaggedFields(t, "io",
+		map[string]interface{}{"ReadsPerFile": int64(5), "stats.stall_ms": float64(3)},
+		map[string]string{"database_name": "tempdb", "query_name": "io"})
+}
@@ -0,0 +1,96 @@
+package sqlserver_extended
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// outputParam is an OUTPUT parameter of a procedure collected as a field
+type outputParam struct {
+	name  string
+	field string
+	kind  string
+}
+
+// outputParams builds the OUTPUT parameters of a query from the parameter
+// types and the optional field names, both keyed by parameter name
+func outputParams(types, fields map[string]string) ([]outputParam, error) {
+	for name := range fields {
+		if _, ok := types[name]; !ok {
+			return nil, fmt.Errorf("output field of unknown output parameter %q", name)
+		}
+	}
+
+	params := make([]outputParam, 0, len(types))
+	for name, kind := range types {
+		switch kind {
+		case "int", "float", "string", "bool":
+		default:
+			return nil, fmt.Errorf("unsupported type %q of output parameter %q", kind, name)
+		}
+		field := fields[name]
+		if field == "" {
+			field = strings.TrimPrefix(name, "@")
+		}
+		params = append(params, outputParam{name: strings.TrimPrefix(name, "@"), field: field, kind: kind})
+	}
+	sort.Slice(params, func(i, j int) bool { return params[i].name < params[j].name })
+	return params, nil
+}
+
+// outputArgs returns the driver arguments receiving the values of the
+// OUTPUT parameters and the destinations they are written to
+func outputArgs(params []outputParam) ([]interface{}, []interface{}) {
+	args := make([]interface{}, 0, len(params))
+	dests := make([]interface{}, 0, len(params))
+	for _, param := range params {
+		var dest interface{}
+		switch param.kind {
+		case "int":
+			dest = new(int64)
+		case "float":
+			dest = new(float64)
+		case "string":
+			dest = new(string)
+		case "bool":
+			dest = new(bool)
+		}
+		args = append(args, sql.Named(param.name, sql.Out{Dest: dest}))
+		dests = append(dests, dest)
+	}
+	return args, dests
+}
+
+// accOutputs adds the values of the OUTPUT parameters as a single metric
+func accOutputs(query Query, acc telegraf.Accumulator, dests []interface{}) {
+	fields := make(map[string]interface{}, len(dests))
+	for i, dest := range dests {
+		switch v := dest.(type) {
+		case *int64:
+			fields[query.Outputs[i].field] = *v
+		case *float64:
+			fields[query.Outputs[i].field] = *v
+		case *string:
+			fields[query.Outputs[i].field] = *v
+		case *bool:
+			fields[query.Outputs[i].field] = *v
+		}
+	}
+
+	tags := make(map[string]string, len(query.Tags)+1)
+	for k, v := range query.Tags {
+		tags[k] = v
+	}
+	tags["query_name"] = query.Name
+
+	measurement := query.Measurement
+	if measurement == "" {
+		measurement = "sqlserver_extended"
+	}
+	acc.AddFields(measurement, fields, tags, time.Now())
+}
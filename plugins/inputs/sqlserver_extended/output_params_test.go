@@ -0,0 +1,56 @@
+package sqlserver_extended
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutputParams(t *testing.T) {
+	s := &SQLServerExtended{
+		Query: []QueryConfig{
+			{
+				Name:           "health",
+				Script:         "EXEC dbo.health_check @score = @score OUTPUT, @state = @state OUTPUT",
+				ExecProcedures: true,
+				OutputParams:   map[string]string{"@score": "float", "state": "string"},
+				OutputFields:   map[string]string{"@score": "health_score"},
+				Tags:           map[string]string{"team": "dba"},
+			},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	query := s.queries["health"]
+	require.Len(t, query.Outputs, 2)
+
+	args, dests := outputArgs(query.Outputs)
+	require.Len(t, args, 2)
+	named := args[0].(sql.NamedArg)
+	assert.Equal(t, "score", named.Name)
+	assert.IsType(t, sql.Out{}, named.Value)
+
+	// the driver writes the values to the destinations
+	*dests[0].(*float64) = 0.75
+	*dests[1].(*string) = "ok"
+
+	var acc testutil.Accumulator
+	accOutputs(query, &acc, dests)
+	acc.AssertContainsTaggedFields(t, "sqlserver_extended",
+		map[string]interface{}{"health_score": 0.75, "state": "ok"},
+		map[string]string{"team": "dba", "query_name": "health"})
+}
+
+func TestOutputParamsInvalid(t *testing.T) {
+	for _, q := range []QueryConfig{
+		{Name: "no_exec", Script: "SELECT 1", OutputParams: map[string]string{"@score": "float"}},
+		{Name: "type", Script: "EXEC p", ExecProcedures: true, OutputParams: map[string]string{"@score": "decimal"}},
+		{Name: "field", Script: "EXEC p", ExecProcedures: true, OutputFields: map[string]string{"@score": "score"}},
+	} {
+		s := &SQLServerExtended{Query: []QueryConfig{q}, Log: testutil.Logger{}}
+		require.Error(t, s.Init(), q.Name)
+	}
+}
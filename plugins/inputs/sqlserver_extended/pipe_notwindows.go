@@ -0,0 +1,19 @@
+// +build !windows
+
+package sqlserver_extended
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var errPipesNotSupported = errors.New("named pipes and LocalDB are only supported on Windows")
+
+func dialPipe(context.Context, string) (net.Conn, error) {
+	return nil, errPipesNotSupported
+}
+
+func localDBPipe(context.Context, string) (string, error) {
+	return "", errPipesNotSupported
+}
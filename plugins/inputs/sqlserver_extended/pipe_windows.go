@@ -0,0 +1,47 @@
+// +build windows
+
+package sqlserver_extended
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// dialPipe opens the named pipe, waiting until the deadline of the context
+// while all its instances are busy. The pipe is opened for overlapped I/O, so
+// the deadlines set by the driver apply to its reads and writes.
+func dialPipe(ctx context.Context, path string) (net.Conn, error) {
+	// the go-winio version in use has no DialPipeContext
+	var timeout *time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		until := time.Until(deadline)
+		timeout = &until
+	}
+	conn, err := winio.DialPipe(path, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("opening pipe %s failed: %v", path, err)
+	}
+	return conn, nil
+}
+
+// localDBPipe starts the LocalDB instance if needed and returns its pipe
+func localDBPipe(ctx context.Context, instance string) (string, error) {
+	if out, err := exec.CommandContext(ctx, "SqlLocalDB.exe", "start", instance).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("starting LocalDB instance %q failed: %v: %s", instance, err, strings.TrimSpace(string(out)))
+	}
+	out, err := exec.CommandContext(ctx, "SqlLocalDB.exe", "info", instance).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("querying LocalDB instance %q failed: %v: %s", instance, err, strings.TrimSpace(string(out)))
+	}
+	pipe := parseLocalDBPipe(string(out))
+	if pipe == "" {
+		return "", fmt.Errorf("LocalDB instance %q has no pipe", instance)
+	}
+	return pipe, nil
+}
@@ -0,0 +1,45 @@
+package sqlserver_extended
+
+import (
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+)
+
+// Default columns of pivoted queries
+const (
+	defaultPivotNameColumn  = "name"
+	defaultPivotValueColumn = "value"
+)
+
+// pivotAccumulator merges the single field metrics of pivoted rows sharing
+// measurement, tags and time into one metric
+type pivotAccumulator struct {
+	telegraf.Accumulator
+	grouper *metric.SeriesGrouper
+}
+
+func newPivotAccumulator(acc telegraf.Accumulator) *pivotAccumulator {
+	return &pivotAccumulator{Accumulator: acc, grouper: metric.NewSeriesGrouper()}
+}
+
+func (a *pivotAccumulator) AddFields(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	tm := time.Now()
+	if len(t) > 0 {
+		tm = t[0]
+	}
+	for name, value := range fields {
+		if err := a.grouper.Add(measurement, tags, tm, name, value); err != nil {
+			a.AddError(err)
+		}
+	}
+}
+
+// flush adds the merged metrics to the accumulator
+func (a *pivotAccumulator) flush() {
+	for _, m := range a.grouper.Metrics() {
+		a.Accumulator.AddFields(m.Name(), m.Fields(), m.Tags(), m.Time())
+	}
+	a.grouper = metric.NewSeriesGrouper()
+}
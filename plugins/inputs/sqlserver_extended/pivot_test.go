@@ -0,0 +1,98 @@
+package sqlserver_extended
+
+import (
+	"testing"
+
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccResultsPivot(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	query := Query{
+		Name:             "counters",
+		Measurement:      "perf",
+		Pivot:            true,
+		PivotNameColumn:  "counter_name",
+		PivotValueColumn: "cntr_value",
+	}
+
+	rows := &mockResults{sets: []mockResultSet{{
+		columns: []string{"object_name", "counter_name", "instance_name", "cntr_value"},
+		rows: []mockRow{
+			{"SQLServer:Buffer Manager", "Page life expectancy    ", "", int64(3600)},
+			{"SQLServer:Buffer Manager", "Lazy writes/sec", "", int64(12)},
+			{"SQLServer:Databases", "Log Flushes/sec", "tempdb", int64(7)},
+			{"SQLServer:Databases", "Transactions/sec", "tempdb", int64(99)},
+			{"SQLServer:Databases", "Transactions/sec", "master", nil},
+		},
+	}}}
+	count, err := s.accResults(query, &acc, rows)
+	require.NoError(t, err)
+	require.Equal(t, 5, count)
+
+	require.Equal(t, uint64(2), acc.NMetrics())
+	acc.AssertContainsTaggedFields(t, "perf",
+		map[string]interface{}{"Page life expectancy": int64(3600), "Lazy writes/sec": int64(12)},
+		map[string]string{"object_name": "SQLServer:Buffer Manager", "instance_name": "", "query_name": "counters"})
+	acc.AssertContainsTaggedFields(t, "perf",
+		map[string]interface{}{"Log Flushes/sec": int64(7), "Transactions/sec": int64(99)},
+		map[string]string{"object_name": "SQLServer:Databases", "instance_name": "tempdb", "query_name": "counters"})
+}
+
+func TestPivotConfig(t *testing.T) {
+	enabled := true
+	s := &SQLServerExtended{
+		Query: []QueryConfig{{Name: "counters", Script: "SELECT 1", Pivot: true}},
+		Log:   testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	defer s.Stop()
+	query := s.queries["counters"]
+	assert.Equal(t, "name", query.PivotNameColumn)
+	assert.Equal(t, "value", query.PivotValueColumn)
+
+	s.Query[0].ResultByRow = &enabled
+	require.Error(t, s.Init())
+
+	s.Query[0].ResultByRow = nil
+	s.Query[0].Unpivot = true
+	require.Error(t, s.Init())
+}
+
+func TestAccResultsPivotMissingColumn(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	query := Query{Name: "counters", Pivot: true, PivotNameColumn: "name", PivotValueColumn: "value"}
+
+	rows := &mockResults{sets: []mockResultSet{{
+		columns: []string{"counter_name", "value"},
+		rows:    []mockRow{{"Batch Requests/sec", int64(5)}},
+	}}}
+	_, err := s.accResults(query, &acc, rows)
+	require.Error(t, err)
+}
+
+func TestAccRowUnpivot(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	query := Query{
+		Name:           "io",
+		Unpivot:        true,
+		OrderedColumns: []string{"measurement", "database_name", "field_reads", "field_writes", "field_stall"},
+	}
+	require.NoError(t, s.accRow(query, &acc, mockRow{"io", "tempdb", int64(5), int64(7), nil}))
+
+	require.Equal(t, uint64(2), acc.NMetrics())
+	acc.AssertContainsTaggedFields(t, "io",
+		map[string]interface{}{"value": int64(5)},
+		map[string]string{"database_name": "tempdb", "name": "reads", "query_name": "io"})
+	acc.AssertContainsTaggedFields(t, "io",
+		map[string]interface{}{"value": int64(7)},
+		map[string]string{"database_name": "tempdb", "name": "writes", "query_name": "io"})
+}
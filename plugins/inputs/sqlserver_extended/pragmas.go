@@ -0,0 +1,217 @@
+package sqlserver_extended
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf/internal"
+)
+
+// pragmaPrefix starts the comments holding the query options in query files
+const pragmaPrefix = "-- telegraf:"
+
+// parsePragmas applies the options given by "-- telegraf:" comments at the
+// top of a query file, before the first line of SQL, to the query
+func parsePragmas(script string, q *QueryConfig) error {
+	scanner := bufio.NewScanner(strings.NewReader(script))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "--") {
+			break
+		}
+		if !strings.HasPrefix(line, pragmaPrefix) {
+			continue
+		}
+
+		options, err := splitPragma(strings.TrimPrefix(line, pragmaPrefix))
+		if err != nil {
+			return err
+		}
+		for _, option := range options {
+			parts := strings.SplitN(option, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("invalid pragma option %q, expected key=value", option)
+			}
+			if err := setPragma(q, parts[0], parts[1]); err != nil {
+				return fmt.Errorf("pragma option %q: %v", parts[0], err)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// splitPragma splits the pragma into its whitespace separated options, values
+// containing whitespace have to be double quoted, e.g. schedule="0 6 * * *"
+func splitPragma(pragma string) ([]string, error) {
+	var options []string
+	for pragma = strings.TrimSpace(pragma); pragma != ""; pragma = strings.TrimSpace(pragma) {
+		eq := strings.IndexAny(pragma, "= \t")
+		if eq < 0 || pragma[eq] != '=' || !strings.HasPrefix(pragma[eq+1:], `"`) {
+			end := strings.IndexAny(pragma, " \t")
+			if end < 0 {
+				end = len(pragma)
+			}
+			options = append(options, pragma[:end])
+			pragma = pragma[end:]
+			continue
+		}
+
+		end := strings.Index(pragma[eq+2:], `"`)
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated quoted value in pragma %q", pragma)
+		}
+		options = append(options, pragma[:eq+1]+pragma[eq+2:eq+2+end])
+		pragma = pragma[eq+3+end:]
+	}
+	return options, nil
+}
+
+// setPragma sets the query option named like its toml key to the value
+func setPragma(q *QueryConfig, key, value string) error {
+	var err error
+	switch key {
+	case "name":
+		q.Name = value
+	case "measurement":
+		q.Measurement = value
+	case "measurement_column":
+		q.MeasurementColumn = value
+	case "time_column":
+		q.TimeColumn = value
+	case "time_format":
+		q.TimeFormat = value
+	case "timezone":
+		q.Timezone = value
+	case "null_handling":
+		q.NullHandling = value
+	case "datetime_formats":
+		q.DatetimeFormats, err = parsePragmaMap(value)
+	case "binary_encodings":
+		q.BinaryEncodings, err = parsePragmaMap(value)
+	case "unsigned_columns":
+		q.UnsignedColumns = strings.Split(value, ",")
+	case "convert":
+		q.Convert, err = parsePragmaMap(value)
+	case "rename":
+		q.Rename, err = parsePragmaMap(value)
+	case "fieldpass":
+		q.FieldPass = strings.Split(value, ",")
+	case "fielddrop":
+		q.FieldDrop = strings.Split(value, ",")
+	case "json_columns":
+		q.JSONColumns = strings.Split(value, ",")
+	case "decimal_as_string":
+		q.DecimalAsString, err = strconv.ParseBool(value)
+	case "result_by_row":
+		var b bool
+		b, err = strconv.ParseBool(value)
+		q.ResultByRow = &b
+	case "pivot":
+		q.Pivot, err = strconv.ParseBool(value)
+	case "unpivot":
+		q.Unpivot, err = strconv.ParseBool(value)
+	case "pivot_name_column":
+		q.PivotNameColumn = value
+	case "pivot_value_column":
+		q.PivotValueColumn = value
+	case "tag_columns":
+		q.TagColumns = strings.Split(value, ",")
+	case "field_columns":
+		q.FieldColumns = strings.Split(value, ",")
+	case "field_prefix":
+		q.FieldPrefix = &value
+	case "field_name_mode":
+		q.FieldNameMode = value
+	case "interval":
+		q.Interval, err = parsePragmaDuration(value)
+	case "schedule":
+		q.Schedule = value
+	case "cache_ttl":
+		q.CacheTTL, err = parsePragmaDuration(value)
+	case "jitter":
+		q.Jitter, err = parsePragmaDuration(value)
+	case "timeout":
+		q.Timeout, err = parsePragmaDuration(value)
+	case "max_rows":
+		q.MaxRows, err = strconv.Atoi(value)
+	case "max_field_length":
+		q.MaxFieldLength, err = strconv.Atoi(value)
+	case "retries":
+		q.Retries, err = strconv.Atoi(value)
+	case "retry_backoff":
+		q.RetryBackoff, err = parsePragmaDuration(value)
+	case "table_types":
+		q.TableTypes, err = parsePragmaMap(value)
+	case "declare":
+		q.Declare, err = parsePragmaMap(value)
+	case "exec_procedures":
+		q.ExecProcedures, err = strconv.ParseBool(value)
+	case "output_params":
+		q.OutputParams, err = parsePragmaMap(value)
+	case "output_fields":
+		q.OutputFields, err = parsePragmaMap(value)
+	case "disable_query_prefix":
+		q.DisableQueryPrefix, err = strconv.ParseBool(value)
+	case "isolation_level":
+		q.IsolationLevel = value
+	case "deadlock_priority":
+		q.DeadlockPriority = value
+	case "lock_timeout_ms":
+		var ms int
+		ms, err = strconv.Atoi(value)
+		q.LockTimeoutMs = &ms
+	case "tags":
+		q.Tags, err = parsePragmaMap(value)
+	case "min_version":
+		q.MinVersion = value
+	case "max_version":
+		q.MaxVersion = value
+	case "engine_editions":
+		q.EngineEditions = strings.Split(value, ",")
+	case "run_in_each_database":
+		q.RunInEachDatabase, err = strconv.ParseBool(value)
+	case "database_include":
+		q.DatabaseInclude = strings.Split(value, ",")
+	case "database_exclude":
+		q.DatabaseExclude = strings.Split(value, ",")
+	case "include_system_databases":
+		q.IncludeSystemDatabases, err = strconv.ParseBool(value)
+	case "depends_on":
+		q.DependsOn = value
+	case "watermark_column":
+		q.WatermarkColumn = value
+	case "execution_group":
+		q.ExecutionGroup = value
+	case "concurrency_class":
+		q.ConcurrencyClass = value
+	case "replicas":
+		q.Replicas = value
+	default:
+		return fmt.Errorf("unknown option")
+	}
+	return err
+}
+
+func parsePragmaDuration(value string) (internal.Duration, error) {
+	d, err := time.ParseDuration(value)
+	return internal.Duration{Duration: d}, err
+}
+
+// parsePragmaMap parses comma separated key:value pairs
+func parsePragmaMap(value string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid pair %q, expected key:value", pair)
+		}
+		m[parts[0]] = parts[1]
+	}
+	return m, nil
+}
@@ -0,0 +1,63 @@
+package sqlserver_extended
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePragmas(t *testing.T) {
+	script := `-- Backup age per database
+-- telegraf: measurement=backups interval=60s tags=collector:backups,team:dba
+-- telegraf: schedule="0 */6 * * *" result_by_row=true jitter=5s
+
+SELECT name, DATEDIFF(hour, backup_finish_date, GETDATE()) AS field_age
+-- telegraf: max_rows=10
+FROM msdb.dbo.backupset`
+
+	var q QueryConfig
+	require.NoError(t, parsePragmas(script, &q))
+	assert.Equal(t, "backups", q.Measurement)
+	assert.Equal(t, time.Minute, q.Interval.Duration)
+	assert.Equal(t, "0 */6 * * *", q.Schedule)
+	assert.Equal(t, 5*time.Second, q.Jitter.Duration)
+	assert.Equal(t, map[string]string{"collector": "backups", "team": "dba"}, q.Tags)
+	require.NotNil(t, q.ResultByRow)
+	assert.True(t, *q.ResultByRow)
+	// pragmas after the first line of SQL are ignored
+	assert.Zero(t, q.MaxRows)
+
+	for _, pragma := range []string{
+		"-- telegraf: color=red",
+		"-- telegraf: interval",
+		"-- telegraf: interval=often",
+		"-- telegraf: tags=collector",
+		`-- telegraf: schedule="0 */6 * * *`,
+	} {
+		require.Error(t, parsePragmas(pragma+"\nSELECT 1", &QueryConfig{}), pragma)
+	}
+}
+
+func TestQueryFilePragmas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlserver_extended")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "waits.sql")
+	script := "-- telegraf: name=wait_stats measurement=waits\nSELECT 1"
+	require.NoError(t, ioutil.WriteFile(path, []byte(script), 0644))
+
+	s := &SQLServerExtended{
+		QueryFiles: []string{path},
+		Log:        testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	require.Contains(t, s.queries, "wait_stats")
+	assert.Equal(t, "waits", s.queries["wait_stats"].Measurement)
+}
@@ -0,0 +1,119 @@
+package sqlserver_extended
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// contextDialer establishes the connections to the servers
+type contextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// newProxyDialer returns a dialer connecting through the SOCKS5 or HTTP
+// CONNECT proxy given as URL
+func newProxyDialer(rawurl string, forward *net.Dialer) (contextDialer, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		// neither the URL nor the error of the parser quoting parts of it
+		// are given, the password can not be told apart in a malformed URL
+		return nil, fmt.Errorf("invalid proxy: malformed URL")
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, forward)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %v", redactURL(u), err)
+		}
+		return d.(contextDialer), nil
+	case "http":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q: missing host", redactURL(u))
+		}
+		return &httpProxyDialer{proxy: u, forward: forward}, nil
+	}
+	return nil, fmt.Errorf("invalid proxy %q: unsupported scheme %q", redactURL(u), u.Scheme)
+}
+
+// redactURL returns the URL with its password replaced
+func redactURL(u *url.URL) string {
+	if u.User == nil {
+		return u.String()
+	}
+	if _, ok := u.User.Password(); !ok {
+		return u.String()
+	}
+	redacted := *u
+	redacted.User = url.UserPassword(u.User.Username(), redactedValue)
+	return redacted.String()
+}
+
+// httpProxyDialer tunnels the connections through an HTTP proxy with CONNECT
+type httpProxyDialer struct {
+	proxy   *url.URL
+	forward *net.Dialer
+}
+
+func (d *httpProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, "tcp", d.proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := d.proxy.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	// the deadline of the context bounds the handshake with the proxy
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", d.proxy.Host, err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", d.proxy.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: CONNECT %s failed: %s", d.proxy.Host, addr, resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads the data buffered while reading the proxy response first
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,131 @@
+package sqlserver_extended
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// queryFile tracks a query loaded from a file
+type queryFile struct {
+	name    string
+	modTime time.Time
+	fromDir bool
+}
+
+// queryFromFile reads the query text from the given file and names the query
+// after the file unless its pragmas set the name
+func queryFromFile(path string) (QueryConfig, error) {
+	script, err := ioutil.ReadFile(path)
+	if err != nil {
+		return QueryConfig{}, fmt.Errorf("reading query file failed: %v", err)
+	}
+
+	name := filepath.Base(path)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	q := QueryConfig{Name: name, Script: string(script)}
+	if err := parsePragmas(q.Script, &q); err != nil {
+		return QueryConfig{}, fmt.Errorf("query file %q: %v", path, err)
+	}
+	return q, nil
+}
+
+// loadQueryFile reads the query file and registers its query, replacing the
+// query previously loaded from the same file. The previous query is kept if
+// the file cannot be loaded.
+func (s *SQLServerExtended) loadQueryFile(path string, fromDir bool) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("reading query file failed: %v", err)
+	}
+	q, err := queryFromFile(path)
+	if err != nil {
+		return err
+	}
+
+	previous, loaded := s.queryFiles[path]
+	var previousQuery Query
+	if loaded {
+		previousQuery = s.queries[previous.name]
+		delete(s.queries, previous.name)
+	}
+	if err := s.addQuery(q); err != nil {
+		if loaded {
+			s.queries[previous.name] = previousQuery
+		}
+		return err
+	}
+
+	s.queryFiles[path] = &queryFile{name: q.Name, modTime: info.ModTime(), fromDir: fromDir}
+	return nil
+}
+
+// refreshQueryFiles reloads the modified query files and synchronizes the
+// queries with the files matching query_dir
+func (s *SQLServerExtended) refreshQueryFiles() error {
+	var errs []string
+	for path, file := range s.queryFiles {
+		info, err := os.Stat(path)
+		if err != nil {
+			// removed files of query_dir are handled below
+			if !file.fromDir {
+				errs = append(errs, fmt.Sprintf("reading query file failed: %v", err))
+			}
+			continue
+		}
+		if info.ModTime().Equal(file.modTime) {
+			continue
+		}
+
+		s.Log.Infof("Query file %q was modified, reloading query %q", path, file.name)
+		if err := s.loadQueryFile(path, file.fromDir); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if s.queryDir != nil {
+		if err := s.loadQueryDir(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("refreshing query files failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// loadQueryDir synchronizes the queries with the files matching query_dir,
+// new files are added and the queries of removed files are dropped
+func (s *SQLServerExtended) loadQueryDir() error {
+	matched := make(map[string]bool)
+	for _, path := range s.queryDir.Match() {
+		matched[path] = true
+	}
+
+	for path, file := range s.queryFiles {
+		if file.fromDir && !matched[path] {
+			s.Log.Infof("Query file %q was removed, dropping query %q", path, file.name)
+			delete(s.queries, file.name)
+			delete(s.queryFiles, path)
+		}
+	}
+
+	var errs []string
+	for path := range matched {
+		if _, ok := s.queryFiles[path]; ok {
+			continue
+		}
+		if err := s.loadQueryFile(path, true); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("loading query_dir failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
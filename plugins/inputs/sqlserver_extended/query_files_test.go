@@ -0,0 +1,81 @@
+package sqlserver_extended
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryFiles(t *testing.T) {
+	s := &SQLServerExtended{
+		QueryFiles: []string{"testdata/waits.sql"},
+		Log:        testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	require.Contains(t, s.queries, "waits")
+	assert.Contains(t, s.queries["waits"].Script, "FROM sys.dm_os_wait_stats")
+
+	s = &SQLServerExtended{
+		QueryFiles: []string{"testdata/missing.sql"},
+		Log:        testutil.Logger{},
+	}
+	require.Error(t, s.Init())
+}
+
+func TestQueryDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlserver_extended")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "waits.sql"), []byte("SELECT 1"), 0644))
+
+	s := &SQLServerExtended{
+		QueryDir: filepath.Join(dir, "*.sql"),
+		Log:      testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	require.Len(t, s.queries, 1)
+	require.Contains(t, s.queries, "waits")
+
+	// new files are picked up, removed ones are dropped
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "io.sql"), []byte("SELECT 2"), 0644))
+	require.NoError(t, os.Remove(filepath.Join(dir, "waits.sql")))
+	require.NoError(t, s.loadQueryDir())
+	require.Len(t, s.queries, 1)
+	require.Contains(t, s.queries, "io")
+}
+
+func TestQueryFilesReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlserver_extended")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "waits.sql")
+	require.NoError(t, ioutil.WriteFile(path, []byte("SELECT 1"), 0644))
+
+	s := &SQLServerExtended{
+		QueryFiles: []string{path},
+		Log:        testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	assert.Equal(t, sqlPrefix+"SELECT 1", s.queries["waits"].Script)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("SELECT 2"), 0644))
+	modTime := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+	require.NoError(t, s.refreshQueryFiles())
+	assert.Equal(t, sqlPrefix+"SELECT 2", s.queries["waits"].Script)
+
+	// a broken file keeps the previous version of the query
+	require.NoError(t, ioutil.WriteFile(path, []byte("SELECT {{"), 0644))
+	modTime = modTime.Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+	require.Error(t, s.refreshQueryFiles())
+	assert.Equal(t, sqlPrefix+"SELECT 2", s.queries["waits"].Script)
+}
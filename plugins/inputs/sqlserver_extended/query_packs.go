@@ -0,0 +1,112 @@
+package sqlserver_extended
+
+// queryPacks are the bundled query sets enabled with the query_packs option.
+// Their queries follow the row convention of the plugin and are named after
+// the pack so they can be filtered with include_queries and exclude_queries.
+var queryPacks = map[string][]QueryConfig{
+	"core": {
+		{Name: "core_properties", Script: sqlCoreProperties, EngineEditions: []string{"SQLServer", "AzureSQLManagedInstance"}},
+		{Name: "core_counters", Script: sqlCoreCounters},
+	},
+	"waits": {
+		{Name: "waits_stats", Script: sqlWaitsStats},
+	},
+	"io": {
+		{Name: "io_virtual_file_stats", Script: sqlIOVirtualFileStats, EngineEditions: []string{"SQLServer", "AzureSQLManagedInstance"}},
+	},
+	"ag": {
+		{Name: "ag_replicas", Script: sqlAGReplicas, MinVersion: "11", EngineEditions: []string{"SQLServer"}},
+		{Name: "ag_databases", Script: sqlAGDatabases, MinVersion: "11", EngineEditions: []string{"SQLServer"}},
+	},
+}
+
+const sqlCoreProperties = `SELECT
+	'sqlserver_properties' AS measurement,
+	CAST(SERVERPROPERTY('ServerName') AS nvarchar(128)) AS sql_instance,
+	CAST(SERVERPROPERTY('ProductVersion') AS nvarchar(128)) AS sql_version,
+	CAST(SERVERPROPERTY('Edition') AS nvarchar(128)) AS sql_edition,
+	si.cpu_count AS field_cpus,
+	si.scheduler_count AS field_schedulers,
+	si.committed_target_kb AS field_targetkb,
+	DATEDIFF(SECOND, si.sqlserver_start_time, GETDATE()) AS field_uptime,
+	(SELECT COUNT(*) FROM sys.databases) AS field_databases
+FROM sys.dm_os_sys_info AS si`
+
+const sqlCoreCounters = `SELECT
+	'sqlserver_counters' AS measurement,
+	RTRIM(pc.object_name) AS object,
+	RTRIM(pc.counter_name) AS counter,
+	RTRIM(pc.instance_name) AS instance,
+	pc.cntr_value AS field_value
+FROM sys.dm_os_performance_counters AS pc
+WHERE pc.counter_name IN (
+	'Page life expectancy',
+	'User Connections',
+	'Processes blocked',
+	'Memory Grants Pending',
+	'Target Server Memory (KB)',
+	'Total Server Memory (KB)'
+)`
+
+const sqlWaitsStats = `SELECT
+	'sqlserver_waits' AS measurement,
+	ws.wait_type,
+	ws.waiting_tasks_count AS field_tasks,
+	ws.wait_time_ms AS field_wait,
+	ws.signal_wait_time_ms AS field_signal,
+	ws.max_wait_time_ms AS field_max
+FROM sys.dm_os_wait_stats AS ws
+WHERE ws.waiting_tasks_count > 0
+AND ws.wait_type NOT IN (
+	N'BROKER_EVENTHANDLER', N'BROKER_RECEIVE_WAITFOR', N'BROKER_TASK_STOP',
+	N'BROKER_TO_FLUSH', N'BROKER_TRANSMITTER', N'CHECKPOINT_QUEUE',
+	N'CLR_AUTO_EVENT', N'CLR_MANUAL_EVENT', N'DIRTY_PAGE_POLL',
+	N'DISPATCHER_QUEUE_SEMAPHORE', N'FT_IFTS_SCHEDULER_IDLE_WAIT',
+	N'HADR_FILESTREAM_IOMGR_IOCOMPLETION', N'HADR_WORK_QUEUE',
+	N'LAZYWRITER_SLEEP', N'LOGMGR_QUEUE', N'ONDEMAND_TASK_QUEUE',
+	N'QDS_PERSIST_TASK_MAIN_LOOP_SLEEP', N'QDS_CLEANUP_STALE_QUERIES_TASK_MAIN_LOOP_SLEEP',
+	N'REQUEST_FOR_DEADLOCK_SEARCH', N'SLEEP_TASK', N'SP_SERVER_DIAGNOSTICS_SLEEP',
+	N'SQLTRACE_BUFFER_FLUSH', N'SQLTRACE_INCREMENTAL_FLUSH_SLEEP',
+	N'WAITFOR', N'XE_DISPATCHER_WAIT', N'XE_TIMER_EVENT'
+)`
+
+const sqlIOVirtualFileStats = `SELECT
+	'sqlserver_io' AS measurement,
+	DB_NAME(vfs.database_id) AS database_name,
+	mf.name AS logical_filename,
+	mf.type_desc AS file_type,
+	vfs.num_of_reads AS field_reads,
+	vfs.num_of_writes AS field_writes,
+	vfs.num_of_bytes_read AS field_readbytes,
+	vfs.num_of_bytes_written AS field_writebytes,
+	vfs.io_stall_read_ms AS field_readstall,
+	vfs.io_stall_write_ms AS field_writestall
+FROM sys.dm_io_virtual_file_stats(NULL, NULL) AS vfs
+INNER JOIN sys.master_files AS mf
+	ON mf.database_id = vfs.database_id AND mf.file_id = vfs.file_id`
+
+const sqlAGReplicas = `SELECT
+	'sqlserver_ag_replicas' AS measurement,
+	ag.name AS ag_name,
+	ar.replica_server_name,
+	ars.role_desc AS role,
+	ars.synchronization_health_desc AS synchronization_health,
+	ars.connected_state_desc AS connected_state,
+	CAST(CASE WHEN ars.synchronization_health = 2 THEN 1 ELSE 0 END AS int) AS field_healthy
+FROM sys.dm_hadr_availability_replica_states AS ars
+INNER JOIN sys.availability_replicas AS ar ON ar.replica_id = ars.replica_id
+INNER JOIN sys.availability_groups AS ag ON ag.group_id = ars.group_id`
+
+const sqlAGDatabases = `SELECT
+	'sqlserver_ag_databases' AS measurement,
+	ag.name AS ag_name,
+	ar.replica_server_name,
+	DB_NAME(drs.database_id) AS database_name,
+	drs.synchronization_state_desc AS synchronization_state,
+	ISNULL(drs.log_send_queue_size, 0) AS field_sendqueue,
+	ISNULL(drs.log_send_rate, 0) AS field_sendrate,
+	ISNULL(drs.redo_queue_size, 0) AS field_redoqueue,
+	ISNULL(drs.redo_rate, 0) AS field_redorate
+FROM sys.dm_hadr_database_replica_states AS drs
+INNER JOIN sys.availability_replicas AS ar ON ar.replica_id = drs.replica_id
+INNER JOIN sys.availability_groups AS ag ON ag.group_id = drs.group_id`
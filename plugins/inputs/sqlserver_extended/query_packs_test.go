@@ -0,0 +1,30 @@
+package sqlserver_extended
+
+import (
+	"testing"
+
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryPacks(t *testing.T) {
+	var packs []string
+	for pack := range queryPacks {
+		packs = append(packs, pack)
+	}
+
+	s := &SQLServerExtended{
+		QueryPacks:     packs,
+		ExcludeQueries: []string{"io_*"},
+		Log:            testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	assert.Contains(t, s.queries, "core_properties")
+	assert.Contains(t, s.queries, "waits_stats")
+	assert.Contains(t, s.queries, "ag_replicas")
+	assert.NotContains(t, s.queries, "io_virtual_file_stats")
+
+	s.QueryPacks = []string{"unknown"}
+	require.Error(t, s.Init())
+}
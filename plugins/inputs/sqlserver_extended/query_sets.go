@@ -0,0 +1,60 @@
+package sqlserver_extended
+
+import (
+	"fmt"
+
+	"github.com/influxdata/telegraf/filter"
+)
+
+// QuerySetConfig restricts the queries executed on some of the servers
+type QuerySetConfig struct {
+	Servers        []string `toml:"servers"`
+	IncludeQueries []string `toml:"include_queries"`
+	ExcludeQueries []string `toml:"exclude_queries"`
+}
+
+// querySet is a compiled QuerySetConfig
+type querySet struct {
+	servers filter.Filter
+	queries filter.Filter
+}
+
+// compileQuerySets builds the filters of the query sets
+func compileQuerySets(configs []QuerySetConfig) ([]querySet, error) {
+	sets := make([]querySet, 0, len(configs))
+	for i, c := range configs {
+		if len(c.Servers) == 0 {
+			return nil, fmt.Errorf("query set %d: servers must not be empty", i+1)
+		}
+		servers, err := filter.Compile(c.Servers)
+		if err != nil {
+			return nil, fmt.Errorf("query set %d: invalid servers: %v", i+1, err)
+		}
+		queries, err := filter.NewIncludeExcludeFilter(c.IncludeQueries, c.ExcludeQueries)
+		if err != nil {
+			return nil, fmt.Errorf("query set %d: invalid query filter: %v", i+1, err)
+		}
+		sets = append(sets, querySet{servers: servers, queries: queries})
+	}
+	return sets, nil
+}
+
+// serverQueries returns the queries to execute on the server, restricted by
+// the first query set matching the server name if any
+func (s *SQLServerExtended) serverQueries(server string, queries []Query) []Query {
+	name := serverName(parseConnectionString(server))
+	for _, set := range s.querySets {
+		if !set.servers.Match(name) {
+			continue
+		}
+
+		var selected []Query
+		for _, query := range queries {
+			if set.queries.Match(query.Name) {
+				selected = append(selected, query)
+			}
+		}
+		return selected
+	}
+	return queries
+}
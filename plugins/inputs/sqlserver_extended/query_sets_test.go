@@ -0,0 +1,40 @@
+package sqlserver_extended
+
+import (
+	"testing"
+
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerQueries(t *testing.T) {
+	s := &SQLServerExtended{
+		QueryPacks: []string{"core", "ag"},
+		QuerySets: []QuerySetConfig{
+			{Servers: []string{"sqlag-*"}, IncludeQueries: []string{"ag_*"}},
+			{Servers: []string{"sqlazure-*"}, ExcludeQueries: []string{"ag_*"}},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+
+	var queries []Query
+	for _, query := range s.queries {
+		queries = append(queries, query)
+	}
+	names := func(server string) []string {
+		var names []string
+		for _, query := range s.serverQueries(server, queries) {
+			names = append(names, query.Name)
+		}
+		return names
+	}
+
+	assert.ElementsMatch(t, []string{"ag_replicas", "ag_databases"}, names("Server=sqlag-01;User Id=sa"))
+	assert.ElementsMatch(t, []string{"core_properties", "core_counters"}, names("Server=sqlazure-01;User Id=sa"))
+	assert.Len(t, names("Server=sqlprod-01;User Id=sa"), 4)
+
+	s.QuerySets = []QuerySetConfig{{IncludeQueries: []string{"ag_*"}}}
+	require.Error(t, s.Init())
+}
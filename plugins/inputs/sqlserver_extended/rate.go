@@ -0,0 +1,71 @@
+package sqlserver_extended
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/filter"
+)
+
+// FieldConfig sets options of the fields matching the name
+type FieldConfig struct {
+	Name string `toml:"name"`
+	Rate bool   `toml:"rate"`
+}
+
+// compileRateFields returns the filter of the fields collected as rate, nil
+// if there are none
+func compileRateFields(fields []FieldConfig) (filter.Filter, error) {
+	var names []string
+	for _, f := range fields {
+		if f.Name == "" {
+			return nil, fmt.Errorf("field name must not be empty")
+		}
+		if f.Rate {
+			names = append(names, f.Name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	return filter.Compile(names)
+}
+
+// rateAccumulator replaces the values of cumulative fields by their rate per
+// second since the previous gather. Fields without a previous value or reset
+// since, e.g. by a failover or a restart of the service, are left out.
+type rateAccumulator struct {
+	telegraf.Accumulator
+	fields filter.Filter
+	series *counterSeries
+}
+
+func (a *rateAccumulator) AddFields(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	tm := time.Now()
+	if len(t) > 0 {
+		tm = t[0]
+	}
+	rates := make(map[string]interface{}, len(fields))
+	for name, value := range fields {
+		if !a.fields.Match(name) {
+			rates[name] = value
+			continue
+		}
+		v, err := toFloat(value)
+		if err != nil {
+			a.AddError(fmt.Errorf("rate of field %q: %v", name, err))
+			continue
+		}
+		current := v.(float64)
+		previous, ok := a.series.swap(seriesKey(measurement, tags, name), counterSample{value: current, time: tm})
+		elapsed := tm.Sub(previous.time).Seconds()
+		if !ok || current < previous.value || elapsed <= 0 {
+			continue
+		}
+		rates[name] = (current - previous.value) / elapsed
+	}
+	if len(rates) > 0 {
+		a.Accumulator.AddFields(measurement, rates, tags, tm)
+	}
+}
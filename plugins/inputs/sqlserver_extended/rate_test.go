@@ -0,0 +1,46 @@
+package sqlserver_extended
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateAccumulator(t *testing.T) {
+	fields, err := compileRateFields([]FieldConfig{{Name: "reads", Rate: true}, {Name: "size"}})
+	require.NoError(t, err)
+	series := newCounterStore().get("sql01", "io")
+	tags := map[string]string{"file": "data", "query_name": "io"}
+	gather := func(tm time.Time, reads int64) *testutil.Accumulator {
+		var acc testutil.Accumulator
+		racc := &rateAccumulator{Accumulator: &acc, fields: fields, series: series}
+		racc.AddFields("io", map[string]interface{}{"reads": reads, "size": int64(8)}, tags, tm)
+		return &acc
+	}
+
+	start := time.Unix(1600000000, 0)
+	acc := gather(start, 1000)
+	acc.AssertContainsTaggedFields(t, "io", map[string]interface{}{"size": int64(8)}, tags)
+
+	acc = gather(start.Add(10*time.Second), 1500)
+	acc.AssertContainsTaggedFields(t, "io", map[string]interface{}{"reads": float64(50), "size": int64(8)}, tags)
+
+	// the counter starts over after a failover
+	acc = gather(start.Add(20*time.Second), 100)
+	acc.AssertContainsTaggedFields(t, "io", map[string]interface{}{"size": int64(8)}, tags)
+
+	acc = gather(start.Add(30*time.Second), 300)
+	acc.AssertContainsTaggedFields(t, "io", map[string]interface{}{"reads": float64(20), "size": int64(8)}, tags)
+}
+
+func TestCompileRateFields(t *testing.T) {
+	fields, err := compileRateFields([]FieldConfig{{Name: "size"}})
+	require.NoError(t, err)
+	assert.Nil(t, fields)
+
+	_, err = compileRateFields([]FieldConfig{{Rate: true}})
+	require.Error(t, err)
+}
@@ -0,0 +1,86 @@
+package sqlserver_extended
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/influxdata/telegraf"
+)
+
+// redactedValue replaces the secrets in errors and log messages
+const redactedValue = "xxxxx"
+
+var (
+	// secretParamRe matches connection string keywords holding secrets, the
+	// value ends with the parameter or the quotes of a formatted string
+	secretParamRe = regexp.MustCompile(`(?i)\b(password|pwd|access ?token|client ?secret)(\s*=\s*)[^;"'\n]*`)
+	// urlPasswordRe matches the password in the user info of an URL
+	urlPasswordRe = regexp.MustCompile(`(\b[a-zA-Z][a-zA-Z0-9+.-]*://[^:/@\s]*:)[^@/\s]*@`)
+	// bearerRe matches the tokens of authorization headers
+	bearerRe = regexp.MustCompile(`(?i)(\bbearer\s+)[a-z0-9._~+/-]+=*`)
+)
+
+// redact scrubs the passwords and tokens from the message
+func redact(message string) string {
+	message = secretParamRe.ReplaceAllString(message, "${1}${2}"+redactedValue)
+	message = urlPasswordRe.ReplaceAllString(message, "${1}"+redactedValue+"@")
+	return bearerRe.ReplaceAllString(message, "${1}"+redactedValue)
+}
+
+// redactError returns the error with the secrets scrubbed from its message
+func redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if message := redact(err.Error()); message != err.Error() {
+		return errors.New(message)
+	}
+	return err
+}
+
+// redactingAccumulator scrubs the secrets from all reported errors
+type redactingAccumulator struct {
+	telegraf.Accumulator
+}
+
+func (a *redactingAccumulator) AddError(err error) {
+	a.Accumulator.AddError(redactError(err))
+}
+
+// redactingLogger scrubs the secrets from all log messages
+type redactingLogger struct {
+	telegraf.Logger
+}
+
+func (l *redactingLogger) Errorf(format string, args ...interface{}) {
+	l.Logger.Error(redact(fmt.Sprintf(format, args...)))
+}
+
+func (l *redactingLogger) Error(args ...interface{}) {
+	l.Logger.Error(redact(fmt.Sprint(args...)))
+}
+
+func (l *redactingLogger) Debugf(format string, args ...interface{}) {
+	l.Logger.Debug(redact(fmt.Sprintf(format, args...)))
+}
+
+func (l *redactingLogger) Debug(args ...interface{}) {
+	l.Logger.Debug(redact(fmt.Sprint(args...)))
+}
+
+func (l *redactingLogger) Warnf(format string, args ...interface{}) {
+	l.Logger.Warn(redact(fmt.Sprintf(format, args...)))
+}
+
+func (l *redactingLogger) Warn(args ...interface{}) {
+	l.Logger.Warn(redact(fmt.Sprint(args...)))
+}
+
+func (l *redactingLogger) Infof(format string, args ...interface{}) {
+	l.Logger.Info(redact(fmt.Sprintf(format, args...)))
+}
+
+func (l *redactingLogger) Info(args ...interface{}) {
+	l.Logger.Info(redact(fmt.Sprint(args...)))
+}
@@ -0,0 +1,212 @@
+package sqlserver_extended
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// Replica roles, as used by the replicas query option
+const (
+	replicaPrimary   = "primary"
+	replicaSecondary = "secondary"
+	replicaAll       = "all"
+)
+
+// replica is a server the queries are executed on, role is empty unless the
+// server was discovered as replica of an Availability Group
+type replica struct {
+	server  string
+	role    string
+	partner string
+}
+
+// sqlIsSecondary counts the Availability Groups the server is a secondary
+// replica of
+const sqlIsSecondary = `SELECT COUNT(*)
+FROM sys.dm_hadr_availability_replica_states
+WHERE is_local = 1 AND role_desc = 'SECONDARY'`
+
+const sqlReplicas = `SELECT ar.replica_server_name, ars.role_desc
+FROM sys.availability_replicas AS ar
+JOIN sys.dm_hadr_availability_replica_states AS ars ON ars.replica_id = ar.replica_id`
+
+// replicas returns the servers to collect from for a configured server. With
+// discover_replicas the server is expected to be an Availability Group
+// listener and the primary and secondary replicas behind it are returned.
+func (s *SQLServerExtended) replicas(ctx context.Context, server string, acc telegraf.Accumulator) []replica {
+	if !s.DiscoverReplicas {
+		server, partner := failoverPartner(server)
+		return []replica{{server: server, partner: partner}}
+	}
+	server, _ = failoverPartner(server)
+
+	found, err := s.discoverReplicas(ctx, server)
+	if err != nil {
+		acc.AddError(fmt.Errorf("discovering replicas of server %q failed: %v", serverName(parseConnectionString(server)), err))
+	}
+	replicas := selectReplicas(server, found)
+	if !s.EnforcePrimary {
+		return replicas
+	}
+
+	var primaries []replica
+	for _, r := range replicas {
+		if r.role == replicaPrimary {
+			primaries = append(primaries, r)
+		}
+	}
+	return primaries
+}
+
+// discoverReplicas queries the names and roles of the replicas of the
+// Availability Groups the server is part of
+func (s *SQLServerExtended) discoverReplicas(ctx context.Context, server string) (map[string]string, error) {
+	conn, err := s.pools.get(server)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.QueryTimeout.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.QueryTimeout.Duration)
+		defer cancel()
+	}
+
+	rows, err := conn.QueryContext(ctx, sqlReplicas)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := make(map[string]string)
+	for rows.Next() {
+		var name, role string
+		if err := rows.Scan(&name, &role); err != nil {
+			return nil, err
+		}
+		// a server can be the primary of one group and a secondary of another
+		if found[name] != replicaPrimary {
+			found[name] = strings.ToLower(role)
+		}
+	}
+	return found, rows.Err()
+}
+
+// selectReplicas builds the connection strings of the discovered replicas
+// from the one of the listener. Replicas changing their role are skipped,
+// without any replica the listener is used as primary.
+func selectReplicas(server string, found map[string]string) []replica {
+	var replicas []replica
+	for name, role := range found {
+		if role != replicaPrimary && role != replicaSecondary {
+			continue
+		}
+		replicas = append(replicas, replica{server: withServer(server, name), role: role})
+	}
+	if len(replicas) == 0 {
+		return []replica{{server: server, role: replicaPrimary}}
+	}
+	sort.Slice(replicas, func(i, j int) bool { return replicas[i].server < replicas[j].server })
+	return replicas
+}
+
+// gatherReplica runs the queries on the replica, or its failover partner if
+// the replica is unreachable
+func (s *SQLServerExtended) gatherReplica(ctx context.Context, r replica, queries, cached []Query, now time.Time, acc telegraf.Accumulator) {
+	queries = replicaQueries(r.role, s.serverQueries(r.server, queries))
+	cached = replicaQueries(r.role, s.serverQueries(r.server, cached))
+	if r.partner == "" {
+		s.replayCached(r.server, cached, now, acc)
+		// the health is reported on every gather, also if no query is due
+		if !s.connect(ctx, r.server, acc) {
+			s.gatherDAC(ctx, r.server, queries, acc)
+			return
+		}
+		if len(queries) > 0 && (!s.EnforcePrimary || s.isPrimary(ctx, r.server, acc)) {
+			s.gatherQueries(ctx, r.server, queries, acc)
+		}
+		return
+	}
+
+	server := r.server
+	if !s.connect(ctx, server, acc) {
+		server = r.partner
+		if !s.connect(ctx, server, acc) {
+			s.gatherDAC(ctx, r.server, queries, acc)
+			return
+		}
+	}
+
+	if s.EnforcePrimary && !s.isPrimary(ctx, server, acc) {
+		return
+	}
+
+	acc = &taggingAccumulator{
+		Accumulator: acc,
+		tags:        map[string]string{"active_endpoint": serverName(parseConnectionString(server))},
+	}
+	s.replayCached(server, cached, now, acc)
+	if len(queries) > 0 {
+		s.gatherQueries(ctx, server, queries, acc)
+	}
+}
+
+// isPrimary reports whether the server can be collected from with
+// enforce_primary, i.e. whether it is not a secondary replica
+func (s *SQLServerExtended) isPrimary(ctx context.Context, server string, acc telegraf.Accumulator) bool {
+	conn, err := s.pools.get(server)
+	if err == nil {
+		if s.QueryTimeout.Duration > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, s.QueryTimeout.Duration)
+			defer cancel()
+		}
+		var secondary int
+		if err = conn.QueryRowContext(ctx, sqlIsSecondary).Scan(&secondary); err == nil && secondary > 0 {
+			err = fmt.Errorf("server is a secondary replica")
+		}
+	}
+	if err != nil {
+		acc.AddError(fmt.Errorf("skipping server %q with enforce_primary: %v", serverName(parseConnectionString(server)), err))
+		return false
+	}
+	return true
+}
+
+// taggingAccumulator adds the tags to all metrics
+type taggingAccumulator struct {
+	telegraf.Accumulator
+
+	tags map[string]string
+}
+
+func (a *taggingAccumulator) AddFields(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	tagged := make(map[string]string, len(tags)+len(a.tags))
+	for k, v := range tags {
+		tagged[k] = v
+	}
+	for k, v := range a.tags {
+		tagged[k] = v
+	}
+	a.Accumulator.AddFields(measurement, fields, tagged, t...)
+}
+
+// replicaQueries returns the queries to execute on a replica with the role
+func replicaQueries(role string, queries []Query) []Query {
+	if role == "" {
+		return queries
+	}
+
+	var selected []Query
+	for _, query := range queries {
+		if query.Replicas == replicaAll || query.Replicas == role {
+			selected = append(selected, query)
+		}
+	}
+	return selected
+}
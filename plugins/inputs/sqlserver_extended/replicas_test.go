@@ -0,0 +1,89 @@
+package sqlserver_extended
+
+import (
+	"testing"
+
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectReplicas(t *testing.T) {
+	listener := "Server=ag-listener;Port=1433;User Id=telegraf;"
+	replicas := selectReplicas(listener, map[string]string{
+		"SQL02": "secondary",
+		"SQL01": "primary",
+		"SQL03": "resolving",
+	})
+	assert.Equal(t, []replica{
+		{server: "Server=SQL01;Port=1433;User Id=telegraf", role: replicaPrimary},
+		{server: "Server=SQL02;Port=1433;User Id=telegraf", role: replicaSecondary},
+	}, replicas)
+
+	// not part of an Availability Group
+	assert.Equal(t, []replica{{server: listener, role: replicaPrimary}}, selectReplicas(listener, nil))
+}
+
+func TestReplicaQueries(t *testing.T) {
+	queries := []Query{
+		{Name: "primary", Replicas: replicaPrimary},
+		{Name: "secondary", Replicas: replicaSecondary},
+		{Name: "all", Replicas: replicaAll},
+	}
+	names := func(queries []Query) []string {
+		var names []string
+		for _, query := range queries {
+			names = append(names, query.Name)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"primary", "secondary", "all"}, names(replicaQueries("", queries)))
+	assert.Equal(t, []string{"primary", "all"}, names(replicaQueries(replicaPrimary, queries)))
+	assert.Equal(t, []string{"secondary", "all"}, names(replicaQueries(replicaSecondary, queries)))
+}
+
+func TestReplicasOption(t *testing.T) {
+	s := &SQLServerExtended{
+		Query: []QueryConfig{
+			{Name: "waits", Script: "SELECT 1"},
+			{Name: "lag", Script: "SELECT 1", Replicas: "secondary"},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	assert.Equal(t, replicaPrimary, s.queries["waits"].Replicas)
+	assert.Equal(t, replicaSecondary, s.queries["lag"].Replicas)
+
+	s.Query[1].Replicas = "tertiary"
+	require.Error(t, s.Init())
+}
+
+func TestTaggingAccumulator(t *testing.T) {
+	var acc testutil.Accumulator
+	tagging := &taggingAccumulator{Accumulator: &acc, tags: map[string]string{"active_endpoint": "sql02"}}
+	tagging.AddFields("waits", map[string]interface{}{"wait": 10}, map[string]string{"query_name": "waits"})
+
+	acc.AssertContainsTaggedFields(t, "waits",
+		map[string]interface{}{"wait": 10},
+		map[string]string{"query_name": "waits", "active_endpoint": "sql02"})
+}
+
+func TestEnforcePrimary(t *testing.T) {
+	s := &SQLServerExtended{
+		Servers:        []string{"Server=ag-listener;ApplicationIntent=ReadOnly;User Id=telegraf"},
+		EnforcePrimary: true,
+		Log:            testutil.Logger{},
+	}
+	require.Error(t, s.Init())
+
+	s.Servers = []string{"Server=ag-listener;User Id=telegraf"}
+	require.NoError(t, s.Init())
+	assert.Equal(t, "Server=ag-listener;User Id=telegraf;applicationintent=ReadWrite", s.pools.connectionString(s.servers[0]))
+
+	// the intent of discovered servers is replaced
+	assert.Equal(t, "Server=sql02;applicationintent=ReadWrite", s.pools.connectionString("Server=sql02;ApplicationIntent=ReadOnly"))
+
+	s.ReadOnlyIntent = true
+	require.Error(t, s.Init())
+}
@@ -0,0 +1,63 @@
+package sqlserver_extended
+
+import (
+	"sort"
+	"strings"
+)
+
+// tagSanitizer cleans up the tag values read from the columns, e.g. query
+// texts spanning several lines or characters an output can not handle
+type tagSanitizer struct {
+	trimSpace          bool
+	collapseWhitespace bool
+	replacer           *strings.Replacer
+}
+
+// newTagSanitizer returns the sanitizer of the tag options, nil if no
+// sanitization is configured
+func newTagSanitizer(trimSpace, collapseWhitespace bool, replaceChars map[string]string) *tagSanitizer {
+	if !trimSpace && !collapseWhitespace && len(replaceChars) == 0 {
+		return nil
+	}
+	t := &tagSanitizer{trimSpace: trimSpace, collapseWhitespace: collapseWhitespace}
+	if len(replaceChars) > 0 {
+		// the replacements are applied in a stable order
+		olds := make([]string, 0, len(replaceChars))
+		for old := range replaceChars {
+			olds = append(olds, old)
+		}
+		sort.Strings(olds)
+		pairs := make([]string, 0, 2*len(olds))
+		for _, old := range olds {
+			pairs = append(pairs, old, replaceChars[old])
+		}
+		t.replacer = strings.NewReplacer(pairs...)
+	}
+	return t
+}
+
+// addTag adds the sanitized value of a column tag unless it is empty and
+// omit_empty_tags is set
+func (s *SQLServerExtended) addTag(tags map[string]string, key, value string) {
+	value = s.sanitizer.sanitize(value)
+	if value == "" && s.OmitEmptyTags {
+		return
+	}
+	tags[key] = value
+}
+
+// sanitize returns the cleaned up tag value
+func (t *tagSanitizer) sanitize(value string) string {
+	if t == nil {
+		return value
+	}
+	if t.collapseWhitespace {
+		value = strings.Join(strings.Fields(value), " ")
+	} else if t.trimSpace {
+		value = strings.TrimSpace(value)
+	}
+	if t.replacer != nil {
+		value = t.replacer.Replace(value)
+	}
+	return value
+}
@@ -0,0 +1,61 @@
+package sqlserver_extended
+
+import (
+	"testing"
+
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTagSanitizer(t *testing.T) {
+	var sanitizer *tagSanitizer
+	assert.Equal(t, " a\nb ", sanitizer.sanitize(" a\nb "))
+	assert.Nil(t, newTagSanitizer(false, false, nil))
+
+	sanitizer = newTagSanitizer(true, false, nil)
+	assert.Equal(t, "SELECT *\n  FROM t", sanitizer.sanitize("\tSELECT *\n  FROM t\r\n"))
+
+	sanitizer = newTagSanitizer(false, true, map[string]string{",": "_", "=": "_", `"`: ""})
+	assert.Equal(t, "SELECT a_b FROM t WHERE x_1", sanitizer.sanitize("\tSELECT a,b\r\n  FROM \"t\"\nWHERE x=1 "))
+}
+
+func TestAccRowSanitizeTags(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{
+		TagCollapseWhitespace: true,
+		Log:                   testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	defer s.Stop()
+
+	query := Query{
+		Name:           "requests",
+		Tags:           map[string]string{"team": " dba "},
+		OrderedColumns: []string{"measurement", "statement", "field_cpu"},
+	}
+	require.NoError(t, s.accRow(query, &acc, mockRow{"requests", "SELECT 1\r\nFROM t ", int64(5)}))
+	acc.AssertContainsTaggedFields(t, "requests",
+		map[string]interface{}{"cpu": int64(5)},
+		map[string]string{"statement": "SELECT 1 FROM t", "team": " dba ", "query_name": "requests"})
+}
+
+func TestAccRowOmitEmptyTags(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{
+		TagTrimSpace:  true,
+		OmitEmptyTags: true,
+		Log:           testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	defer s.Stop()
+
+	query := Query{
+		Name:           "sessions",
+		OrderedColumns: []string{"measurement", "login_name", "program_name", "host_name", "field_count"},
+	}
+	require.NoError(t, s.accRow(query, &acc, mockRow{"sessions", "sa", "", "  ", int64(3)}))
+	acc.AssertContainsTaggedFields(t, "sessions",
+		map[string]interface{}{"count": int64(3)},
+		map[string]string{"login_name": "sa", "query_name": "sessions"})
+}
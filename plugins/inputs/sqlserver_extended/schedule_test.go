@@ -0,0 +1,96 @@
+package sqlserver_extended
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduleNext(t *testing.T) {
+	start := time.Date(2020, 11, 17, 10, 3, 20, 0, time.Local)
+
+	cases := []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2020, 11, 17, 10, 4, 0, 0, time.Local)},
+		{"0 */6 * * *", time.Date(2020, 11, 17, 12, 0, 0, 0, time.Local)},
+		{"30 2 * * *", time.Date(2020, 11, 18, 2, 30, 0, 0, time.Local)},
+		{"15,45 9-17 * * 1-5", time.Date(2020, 11, 17, 10, 15, 0, 0, time.Local)},
+		{"0 0 1 * *", time.Date(2020, 12, 1, 0, 0, 0, 0, time.Local)},
+		{"0 0 * * 7", time.Date(2020, 11, 22, 0, 0, 0, 0, time.Local)},
+		{"0 0 1 1 *", time.Date(2021, 1, 1, 0, 0, 0, 0, time.Local)},
+	}
+	for _, tt := range cases {
+		sched, err := parseSchedule(tt.expr)
+		require.NoError(t, err, tt.expr)
+		assert.Equal(t, tt.expected, sched.next(start), tt.expr)
+	}
+}
+
+func TestScheduleInvalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * * * mon", "*/0 * * * *", "0 0 30 2 *"} {
+		_, err := parseSchedule(expr)
+		require.Error(t, err, expr)
+	}
+}
+
+func TestSqlServerExtended_QuerySchedule(t *testing.T) {
+	s := &SQLServerExtended{
+		Query: []QueryConfig{
+			{Name: "backups", Script: "SELECT 1", Schedule: "0 */6 * * *"},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	query := s.queries["backups"]
+
+	// the first gather only determines the next scheduled time
+	start := time.Date(2020, 11, 17, 10, 3, 0, 0, time.Local)
+	assert.False(t, s.isDue(query, start))
+	assert.False(t, s.isDue(query, start.Add(time.Hour)))
+
+	// ticks arriving slightly early still match the scheduled time once
+	noon := time.Date(2020, 11, 17, 12, 0, 0, 0, time.Local)
+	assert.True(t, s.isDue(query, noon.Add(-100*time.Millisecond)))
+	assert.False(t, s.isDue(query, noon.Add(10*time.Second)))
+	assert.True(t, s.isDue(query, noon.Add(6*time.Hour+10*time.Second)))
+}
+
+func TestSqlServerExtended_QueryJitter(t *testing.T) {
+	s := &SQLServerExtended{
+		Query: []QueryConfig{
+			{Name: "index_stats", Script: "SELECT 1", Jitter: internal.Duration{Duration: 30 * time.Second}},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	assert.Equal(t, 30*time.Second, s.queries["index_stats"].Jitter)
+}
+
+func TestSqlServerExtended_QueryScheduleInvalid(t *testing.T) {
+	s := &SQLServerExtended{
+		Query: []QueryConfig{
+			{Name: "backups", Script: "SELECT 1", Schedule: "0 */6 * *"},
+		},
+		Log: testutil.Logger{},
+	}
+	require.Error(t, s.Init())
+
+	s = &SQLServerExtended{
+		Query: []QueryConfig{
+			{
+				Name:     "backups",
+				Script:   "SELECT 1",
+				Schedule: "0 */6 * * *",
+				Interval: internal.Duration{Duration: time.Hour},
+			},
+		},
+		Log: testutil.Logger{},
+	}
+	require.Error(t, s.Init())
+}
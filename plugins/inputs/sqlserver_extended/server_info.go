@@ -0,0 +1,150 @@
+package sqlserver_extended
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serverInfo describes the instance the queries are executed on
+type serverInfo struct {
+	Version       version
+	EngineEdition string
+}
+
+const sqlServerInfo = `SELECT
+	CAST(SERVERPROPERTY('ProductVersion') AS nvarchar(128)),
+	CAST(SERVERPROPERTY('EngineEdition') AS int)`
+
+// engineEditions maps SERVERPROPERTY('EngineEdition') to the names used by
+// the engine_editions query option
+var engineEditions = map[int]string{
+	1:  "SQLServer", // Personal or Desktop Engine
+	2:  "SQLServer", // Standard
+	3:  "SQLServer", // Enterprise
+	4:  "SQLServer", // Express
+	5:  "AzureSQLDB",
+	6:  "AzureSynapse",
+	8:  "AzureSQLManagedInstance",
+	9:  "AzureSQLEdge",
+	11: "AzureSynapse", // serverless SQL pool
+}
+
+// detectServerInfo queries the properties of the instance
+func detectServerInfo(ctx context.Context, conn *sql.DB) (serverInfo, error) {
+	var info serverInfo
+	var productVersion string
+	var engineEdition int
+	if err := conn.QueryRowContext(ctx, sqlServerInfo).Scan(&productVersion, &engineEdition); err != nil {
+		return info, fmt.Errorf("detecting server properties failed: %v", err)
+	}
+
+	var ok bool
+	if info.EngineEdition, ok = engineEditions[engineEdition]; !ok {
+		info.EngineEdition = strconv.Itoa(engineEdition)
+	}
+
+	var err error
+	info.Version, err = parseVersion(productVersion)
+	if err != nil {
+		return info, err
+	}
+	return info, nil
+}
+
+const sqlDatabases = `SELECT name FROM sys.databases
+WHERE state_desc = 'ONLINE' AND HAS_DBACCESS(name) = 1
+ORDER BY name`
+
+// systemDatabases are skipped by queries running in each database unless
+// requested otherwise
+var systemDatabases = map[string]bool{
+	"master": true,
+	"model":  true,
+	"msdb":   true,
+	"tempdb": true,
+}
+
+// listDatabases returns the databases the queries can be executed in
+func listDatabases(ctx context.Context, conn *sql.DB, timeout time.Duration) ([]string, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	rows, err := conn.QueryContext(ctx, sqlDatabases)
+	if err != nil {
+		return nil, fmt.Errorf("listing databases failed: %v", err)
+	}
+	defer rows.Close()
+
+	var databases []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("listing databases failed: %v", err)
+		}
+		databases = append(databases, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("listing databases failed: %v", err)
+	}
+	return databases, nil
+}
+
+// quoteName quotes an identifier like the T-SQL QUOTENAME function
+func quoteName(name string) string {
+	return "[" + strings.Replace(name, "]", "]]", -1) + "]"
+}
+
+// isEngineEdition reports whether name is a known engine edition
+func isEngineEdition(name string) bool {
+	for _, edition := range engineEditions {
+		if edition == name {
+			return true
+		}
+	}
+	return false
+}
+
+// version is a dotted version number such as 15.0.2000.5
+type version []int
+
+func parseVersion(s string) (version, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	parts := strings.Split(s, ".")
+	v := make(version, 0, len(parts))
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q", s)
+		}
+		v = append(v, n)
+	}
+	return v, nil
+}
+
+// compare compares the version with the bound, only the components present in
+// the bound are taken into account so "14" matches every 14.x version
+func (v version) compare(bound version) int {
+	for i, b := range bound {
+		var n int
+		if i < len(v) {
+			n = v[i]
+		}
+		if n < b {
+			return -1
+		}
+		if n > b {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,96 @@
+package sqlserver_extended
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionCompare(t *testing.T) {
+	v, err := parseVersion("13.0.5026.0")
+	require.NoError(t, err)
+
+	cases := []struct {
+		bound    string
+		expected int
+	}{
+		{"13", 0},
+		{"13.0", 0},
+		{"13.0.6000", -1},
+		{"12", 1},
+		{"15.0", -1},
+	}
+	for _, tt := range cases {
+		bound, err := parseVersion(tt.bound)
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, v.compare(bound), tt.bound)
+	}
+
+	_, err = parseVersion("2019")
+	require.NoError(t, err)
+	_, err = parseVersion("SQL 2019")
+	require.Error(t, err)
+}
+
+func TestQuerySupportsVersion(t *testing.T) {
+	sql2014 := serverInfo{Version: version{12, 0, 6024, 0}}
+	sql2019 := serverInfo{Version: version{15, 0, 2000, 5}}
+
+	query := Query{MinVersion: version{15}}
+	assert.False(t, query.supports(sql2014))
+	assert.True(t, query.supports(sql2019))
+
+	query = Query{MaxVersion: version{14}}
+	assert.True(t, query.supports(sql2014))
+	assert.False(t, query.supports(sql2019))
+}
+
+func TestQuerySupportsEngineEdition(t *testing.T) {
+	s := &SQLServerExtended{
+		Query: []QueryConfig{
+			{Name: "azure", Script: "SELECT 1", EngineEditions: []string{"AzureSQLDB", "AzureSQLManagedInstance"}},
+		},
+	}
+	require.NoError(t, s.Init())
+
+	query := s.queries["azure"]
+	assert.True(t, query.needsServerInfo())
+	assert.True(t, query.supports(serverInfo{EngineEdition: "AzureSQLDB"}))
+	assert.False(t, query.supports(serverInfo{EngineEdition: "SQLServer"}))
+
+	s.Query[0].EngineEditions = []string{"Oracle"}
+	require.Error(t, s.Init())
+}
+
+func TestQuoteName(t *testing.T) {
+	assert.Equal(t, "[Sales]", quoteName("Sales"))
+	assert.Equal(t, "[odd]]name]", quoteName("odd]name"))
+}
+
+func TestQueryRunsInDatabase(t *testing.T) {
+	s := &SQLServerExtended{
+		Query: []QueryConfig{
+			{Name: "default", Script: "SELECT 1", RunInEachDatabase: true},
+			{
+				Name:                   "filtered",
+				Script:                 "SELECT 2",
+				RunInEachDatabase:      true,
+				DatabaseInclude:        []string{"Sales*", "msdb"},
+				DatabaseExclude:        []string{"SalesArchive"},
+				IncludeSystemDatabases: true,
+			},
+		},
+	}
+	require.NoError(t, s.Init())
+
+	query := s.queries["default"]
+	assert.True(t, query.runsIn("Sales"))
+	assert.False(t, query.runsIn("tempdb"))
+
+	query = s.queries["filtered"]
+	assert.True(t, query.runsIn("Sales"))
+	assert.True(t, query.runsIn("msdb"))
+	assert.False(t, query.runsIn("SalesArchive"))
+	assert.False(t, query.runsIn("HR"))
+}
@@ -0,0 +1,180 @@
+package sqlserver_extended
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ServerConfig describes a server with structured connection parameters, set
+// parameters override the ones of the optional connection string. The JSON
+// keys are used by the servers_file.
+type ServerConfig struct {
+	ConnectionString string `toml:"connection_string" json:"connection_string"`
+	Host             string `toml:"host" json:"host"`
+	Port             int    `toml:"port" json:"port"`
+	Instance         string `toml:"instance" json:"instance"`
+	Protocol         string `toml:"protocol" json:"protocol"`
+	Pipe             string `toml:"pipe" json:"pipe"`
+	User             string `toml:"user" json:"user"`
+	UserFile         string `toml:"user_file" json:"user_file"`
+	Password         string `toml:"password" json:"password"`
+	PasswordFile     string `toml:"password_file" json:"password_file"`
+	Database         string `toml:"database" json:"database"`
+	AppName          string `toml:"app_name" json:"app_name"`
+	FailoverPartner  string `toml:"failover_partner" json:"failover_partner"`
+	ReadOnlyIntent   *bool  `toml:"read_only_intent" json:"read_only_intent"`
+	AuthMethod       string `toml:"auth_method" json:"auth_method"`
+	Domain           string `toml:"domain" json:"domain"`
+	Proxy            string `toml:"proxy" json:"proxy"`
+
+	Tags map[string]string `toml:"tags" json:"tags"`
+}
+
+// connectionString builds the connection string of the server
+func (c *ServerConfig) connectionString() (string, error) {
+	if c.Port < 0 || c.Port > 65535 {
+		return "", fmt.Errorf("invalid port %d", c.Port)
+	}
+	method := strings.ToLower(c.AuthMethod)
+	switch {
+	case method == "" || method == "sql":
+		if c.Domain != "" {
+			return "", fmt.Errorf("domain requires auth_method \"NTLM\"")
+		}
+	case method == "ntlm":
+		if c.Domain == "" || (c.User == "" && c.UserFile == "") {
+			return "", fmt.Errorf("auth_method \"NTLM\" requires domain and user")
+		}
+		if strings.Contains(c.Domain, `\`) {
+			return "", fmt.Errorf("invalid domain %q", c.Domain)
+		}
+	default:
+		return "", fmt.Errorf("unknown auth_method %q", c.AuthMethod)
+	}
+
+	params := make(map[string]string)
+	if c.Host != "" || c.Instance != "" {
+		host := c.Host
+		if host == "" {
+			host = strings.SplitN(serverName(parseConnectionString(c.ConnectionString)), `\`, 2)[0]
+		}
+		if c.Instance != "" {
+			host += `\` + c.Instance
+		}
+		params["server"] = host
+	}
+	if c.Port > 0 {
+		params["port"] = strconv.Itoa(c.Port)
+	}
+
+	protocol := strings.ToLower(c.Protocol)
+	switch protocol {
+	case "", protocolTCP:
+	case protocolNamedPipes, protocolSharedMemory:
+		if c.Port > 0 {
+			return "", fmt.Errorf("port requires protocol %q", protocolTCP)
+		}
+	default:
+		return "", fmt.Errorf("unknown protocol %q", c.Protocol)
+	}
+	if c.Pipe != "" {
+		if protocol != "" && protocol != protocolNamedPipes {
+			return "", fmt.Errorf("pipe requires protocol %q", protocolNamedPipes)
+		}
+		params["server"] = protocolNamedPipes + ":" + c.Pipe
+	} else if protocol == protocolNamedPipes || protocol == protocolSharedMemory {
+		server, ok := params["server"]
+		if !ok {
+			server = serverName(parseConnectionString(c.ConnectionString))
+		}
+		params["server"] = protocol + ":" + server
+	}
+	if c.User != "" && c.UserFile != "" {
+		return "", fmt.Errorf("user and user_file are mutually exclusive")
+	}
+	if c.Password != "" && c.PasswordFile != "" {
+		return "", fmt.Errorf("password and password_file are mutually exclusive")
+	}
+	if c.User != "" {
+		params["user id"] = c.User
+	}
+	if c.UserFile != "" {
+		ref, err := fileReference(c.UserFile)
+		if err != nil {
+			return "", err
+		}
+		params["user id"] = ref
+	}
+	// the driver authenticates users qualified with a domain with NTLM
+	if method == "ntlm" {
+		params["user id"] = c.Domain + `\` + params["user id"]
+	}
+	if c.Password != "" {
+		params["password"] = c.Password
+	}
+	if c.PasswordFile != "" {
+		ref, err := fileReference(c.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		params["password"] = ref
+	}
+	if c.Database != "" {
+		params["database"] = c.Database
+	}
+	if c.AppName != "" {
+		params["app name"] = c.AppName
+	}
+	if c.FailoverPartner != "" {
+		params["failoverpartner"] = c.FailoverPartner
+	}
+	if c.Proxy != "" {
+		if _, err := newProxyDialer(c.Proxy, &net.Dialer{}); err != nil {
+			return "", err
+		}
+		params["proxy"] = c.Proxy
+	}
+	if c.ReadOnlyIntent != nil {
+		params["applicationintent"] = "ReadWrite"
+		if *c.ReadOnlyIntent {
+			params["applicationintent"] = "ReadOnly"
+		}
+	}
+
+	keys := make([]string, 0, len(params))
+	for k, v := range params {
+		if strings.Contains(v, ";") {
+			return "", fmt.Errorf("%s must not contain a semicolon", k)
+		}
+		keys = append(keys, k)
+	}
+	// the server can be named by several keywords, all of them are replaced
+	if _, ok := params["server"]; ok {
+		keys = append(keys, "data source", "address", "addr", "network address")
+	}
+	if _, ok := params["database"]; ok {
+		keys = append(keys, "initial catalog")
+	}
+
+	return withParams(withoutParams(c.ConnectionString, keys...), params), nil
+}
+
+// compileServers returns the connection strings of all configured servers
+// and the tags of the servers defining any
+func compileServers(servers []string, configs []ServerConfig) ([]string, map[string]map[string]string, error) {
+	compiled := append([]string(nil), servers...)
+	tags := make(map[string]map[string]string)
+	for i, c := range configs {
+		dsn, err := c.connectionString()
+		if err != nil {
+			return nil, nil, fmt.Errorf("server %d: %v", i+1, err)
+		}
+		compiled = append(compiled, dsn)
+		if len(c.Tags) > 0 {
+			tags[dsn] = c.Tags
+		}
+	}
+	return compiled, tags, nil
+}
@@ -0,0 +1,75 @@
+package sqlserver_extended
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// serversFile tracks the servers loaded from servers_file
+type serversFile struct {
+	path    string
+	modTime time.Time
+	servers []discoveredServer
+}
+
+// parseServers decodes the JSON list of servers, given as connection strings
+// or as objects with the keys of the server table
+func parseServers(data []byte) ([]discoveredServer, error) {
+	var entries []json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	servers := make([]discoveredServer, 0, len(entries))
+	for i, entry := range entries {
+		var server string
+		if err := json.Unmarshal(entry, &server); err == nil {
+			servers = append(servers, discoveredServer{server: server})
+			continue
+		}
+
+		var c ServerConfig
+		decoder := json.NewDecoder(bytes.NewReader(entry))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&c); err != nil {
+			return nil, fmt.Errorf("server %d: %v", i+1, err)
+		}
+		dsn, err := c.connectionString()
+		if err != nil {
+			return nil, fmt.Errorf("server %d: %v", i+1, err)
+		}
+		servers = append(servers, discoveredServer{server: dsn, tags: c.Tags})
+	}
+	return servers, nil
+}
+
+// refresh reloads the servers if the file was modified. A missing file lists
+// no servers, the previous servers are kept if the file cannot be loaded.
+func (f *serversFile) refresh() error {
+	info, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		f.modTime, f.servers = time.Time{}, nil
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading servers file failed: %v", err)
+	}
+	if info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("reading servers file failed: %v", err)
+	}
+	servers, err := parseServers(data)
+	if err != nil {
+		return fmt.Errorf("servers file %q: %v", f.path, err)
+	}
+	f.modTime, f.servers = info.ModTime(), servers
+	return nil
+}
@@ -0,0 +1,81 @@
+package sqlserver_extended
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseServers(t *testing.T) {
+	servers, err := parseServers([]byte(`[
+		"Server=sql01;User Id=telegraf",
+		{"host": "sql02", "port": 1533, "user": "telegraf", "tags": {"env": "dev"}}
+	]`))
+	require.NoError(t, err)
+	assert.Equal(t, []discoveredServer{
+		{server: "Server=sql01;User Id=telegraf"},
+		{server: "port=1533;server=sql02;user id=telegraf", tags: map[string]string{"env": "dev"}},
+	}, servers)
+
+	_, err = parseServers([]byte(`{"servers": []}`))
+	require.Error(t, err)
+	_, err = parseServers([]byte(`[{"hostname": "sql02"}]`))
+	require.Error(t, err)
+	_, err = parseServers([]byte(`[{"host": "sql02", "auth_method": "kerberos"}]`))
+	require.Error(t, err)
+}
+
+func TestServersFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlserver_extended")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sqlservers.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`["Server=sql01"]`), 0644))
+
+	s := &SQLServerExtended{
+		Servers:     []string{"Server=sql00"},
+		ServersFile: path,
+		Log:         testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	servers, _ := s.gatherServers()
+	assert.Equal(t, []string{"Server=sql00", "Server=sql01"}, servers)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`["Server=sql01", "Server=sql02"]`), 0644))
+	modTime := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+	require.NoError(t, s.serversFile.refresh())
+	servers, _ = s.gatherServers()
+	assert.Equal(t, []string{"Server=sql00", "Server=sql01", "Server=sql02"}, servers)
+
+	// a broken file keeps the previous servers
+	require.NoError(t, ioutil.WriteFile(path, []byte(`["Server=sql03"`), 0644))
+	modTime = modTime.Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+	require.Error(t, s.serversFile.refresh())
+	servers, _ = s.gatherServers()
+	assert.Equal(t, []string{"Server=sql00", "Server=sql01", "Server=sql02"}, servers)
+
+	// a removed file lists no servers
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, s.serversFile.refresh())
+	servers, _ = s.gatherServers()
+	assert.Equal(t, []string{"Server=sql00"}, servers)
+}
+
+func TestServersFileNoDefaultServer(t *testing.T) {
+	s := &SQLServerExtended{
+		ServersFile: filepath.Join(os.TempDir(), "sqlserver_extended_missing.json"),
+		Log:         testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	servers, _ := s.gatherServers()
+	assert.Empty(t, servers)
+}
@@ -0,0 +1,151 @@
+package sqlserver_extended
+
+import (
+	"testing"
+
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerConnectionString(t *testing.T) {
+	readOnly := true
+	c := ServerConfig{
+		Host:           "sql01",
+		Port:           1433,
+		Instance:       "INST1",
+		User:           "telegraf",
+		Password:       "secret",
+		Database:       "master",
+		AppName:        "telegraf",
+		ReadOnlyIntent: &readOnly,
+	}
+	dsn, err := c.connectionString()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"server":            `sql01\INST1`,
+		"port":              "1433",
+		"user id":           "telegraf",
+		"password":          "secret",
+		"database":          "master",
+		"app name":          "telegraf",
+		"applicationintent": "ReadOnly",
+	}, parseConnectionString(dsn))
+}
+
+func TestServerConnectionStringOverride(t *testing.T) {
+	c := ServerConfig{
+		ConnectionString: "Data Source=sql01;Initial Catalog=master;User Id=telegraf;Password=old;encrypt=true",
+		Password:         "new",
+		Database:         "msdb",
+	}
+	dsn, err := c.connectionString()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"data source": "sql01",
+		"user id":     "telegraf",
+		"password":    "new",
+		"database":    "msdb",
+		"encrypt":     "true",
+	}, parseConnectionString(dsn))
+
+	c = ServerConfig{ConnectionString: `Server=sql01\OLD`, Instance: "NEW"}
+	dsn, err = c.connectionString()
+	require.NoError(t, err)
+	assert.Equal(t, `sql01\NEW`, serverName(parseConnectionString(dsn)))
+}
+
+func TestServerConnectionStringInvalid(t *testing.T) {
+	c := ServerConfig{Host: "sql01", Password: "se;cret"}
+	_, err := c.connectionString()
+	require.Error(t, err)
+
+	c = ServerConfig{Host: "sql01", Port: 70000}
+	_, err = c.connectionString()
+	require.Error(t, err)
+
+	c = ServerConfig{Host: "sql01", AuthMethod: "kerberos5"}
+	_, err = c.connectionString()
+	require.Error(t, err)
+}
+
+func TestServerNTLM(t *testing.T) {
+	c := ServerConfig{Host: "sql01", AuthMethod: "NTLM", Domain: "CORP", User: "telegraf", Password: "secret"}
+	dsn, err := c.connectionString()
+	require.NoError(t, err)
+	assert.Equal(t, `CORP\telegraf`, parseConnectionString(dsn)["user id"])
+
+	c = ServerConfig{Host: "sql01", AuthMethod: "NTLM", Domain: "CORP", UserFile: "/run/secrets/user"}
+	dsn, err = c.connectionString()
+	require.NoError(t, err)
+	assert.Equal(t, `CORP\$FILE{/run/secrets/user}`, parseConnectionString(dsn)["user id"])
+
+	c = ServerConfig{Host: "sql01", AuthMethod: "NTLM", User: "telegraf"}
+	_, err = c.connectionString()
+	require.Error(t, err)
+
+	c = ServerConfig{Host: "sql01", Domain: "CORP", User: "telegraf"}
+	_, err = c.connectionString()
+	require.Error(t, err)
+}
+
+func TestServerAuthMethod(t *testing.T) {
+	c := ServerConfig{Host: "sql01", User: "telegraf", Password: "secret", AuthMethod: "SQL"}
+	_, err := c.connectionString()
+	require.NoError(t, err)
+
+	c = ServerConfig{Host: "sql01.database.windows.net", AuthMethod: "AAD_managed_identity"}
+	_, err = c.connectionString()
+	require.EqualError(t, err, `unknown auth_method "AAD_managed_identity"`)
+
+	c = ServerConfig{Host: "sql01.database.windows.net", AuthMethod: "AAD_service_principal"}
+	_, err = c.connectionString()
+	require.EqualError(t, err, `unknown auth_method "AAD_service_principal"`)
+
+	c = ServerConfig{Host: "sql01.database.windows.net", AuthMethod: "AAD_workload_identity"}
+	_, err = c.connectionString()
+	require.EqualError(t, err, `unknown auth_method "AAD_workload_identity"`)
+}
+
+func TestServerProtocol(t *testing.T) {
+	c := ServerConfig{Host: "sql01", Instance: "INST1", Protocol: "np"}
+	dsn, err := c.connectionString()
+	require.NoError(t, err)
+	assert.Equal(t, `np:sql01\INST1`, serverName(parseConnectionString(dsn)))
+
+	c = ServerConfig{Protocol: "lpc"}
+	dsn, err = c.connectionString()
+	require.NoError(t, err)
+	assert.Equal(t, "lpc:.", serverName(parseConnectionString(dsn)))
+
+	c = ServerConfig{Pipe: `\\sql01\pipe\custom`}
+	dsn, err = c.connectionString()
+	require.NoError(t, err)
+	assert.Equal(t, `np:\\sql01\pipe\custom`, serverName(parseConnectionString(dsn)))
+
+	c = ServerConfig{Host: "(localdb)", Instance: "MSSQLLocalDB"}
+	dsn, err = c.connectionString()
+	require.NoError(t, err)
+	assert.Equal(t, `(localdb)\MSSQLLocalDB`, serverName(parseConnectionString(dsn)))
+
+	for _, c := range []ServerConfig{
+		{Host: "sql01", Protocol: "via"},
+		{Host: "sql01", Port: 1433, Protocol: "np"},
+		{Protocol: "lpc", Pipe: `\\.\pipe\sql\query`},
+	} {
+		_, err := c.connectionString()
+		require.Error(t, err)
+	}
+}
+
+func TestCompileServers(t *testing.T) {
+	s := &SQLServerExtended{Log: testutil.Logger{}}
+	require.NoError(t, s.Init())
+	assert.Equal(t, []string{defaultServer}, s.servers)
+
+	s.Servers = []string{"Server=sql01;"}
+	s.Server = []ServerConfig{{Host: "sql02", Tags: map[string]string{"env": "prod"}}}
+	require.NoError(t, s.Init())
+	assert.Equal(t, []string{"Server=sql01;", "server=sql02"}, s.servers)
+	assert.Equal(t, map[string]map[string]string{"server=sql02": {"env": "prod"}}, s.serverTags)
+}
@@ -1,31 +1,265 @@
 package sqlserver_extended
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"text/template"
 	"time"
-	"strings"
 
-	_ "github.com/denisenkom/go-mssqldb" // go-mssqldb initialization
+	mssql "github.com/denisenkom/go-mssqldb"
 	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/filter"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/internal/globpath"
 	"github.com/influxdata/telegraf/plugins/inputs"
 )
 
 // SQLServerExtended struct
 type SQLServerExtended struct {
-	Servers       []string `toml:"servers"`
-	Queries       []string `toml:"queries"`
-	ResultByRow   bool `toml:"result_by_row"`
-	queries       MapQuery
-	isInitialized bool
+	Servers     []string         `toml:"servers"`
+	Server      []ServerConfig   `toml:"server"`
+	ServersFile string           `toml:"servers_file"`
+	Query       []QueryConfig    `toml:"query"`
+	QuerySets   []QuerySetConfig `toml:"query_set"`
+	QueryFiles  []string         `toml:"query_files"`
+	QueryDir    string           `toml:"query_dir"`
+	QueryPacks  []string         `toml:"query_packs"`
+
+	Discovery                 string            `toml:"discovery"`
+	DiscoveryInterval         internal.Duration `toml:"discovery_interval"`
+	DiscoveryTimeout          internal.Duration `toml:"discovery_timeout"`
+	DiscoveryConnectionString string            `toml:"discovery_connection_string"`
+	DNSSRVRecord              string            `toml:"dns_srv_record"`
+	DNSServers                []string          `toml:"dns_servers"`
+	CMSServer                 string            `toml:"cms_server"`
+	CMSGroups                 []string          `toml:"cms_groups"`
+	AzureSubscriptionID       string            `toml:"azure_subscription_id"`
+	AzureResourceGroups       []string          `toml:"azure_resource_groups"`
+	AzureTags                 map[string]string `toml:"azure_tags"`
+
+	ReadOnlyIntent      bool   `toml:"read_only_intent"`
+	EnforcePrimary      bool   `toml:"enforce_primary"`
+	MultiSubnetFailover bool   `toml:"multi_subnet_failover"`
+	DiscoverReplicas    bool   `toml:"discover_replicas"`
+	Proxy               string `toml:"proxy"`
+
+	TLSCA                 string `toml:"tls_ca"`
+	InsecureSkipVerify    bool   `toml:"insecure_skip_verify"`
+	HostnameInCertificate string `toml:"hostname_in_certificate"`
+
+	ConnectTimeout        internal.Duration  `toml:"connect_timeout"`
+	ConnectRetries        int                `toml:"connect_retries"`
+	ConnectRetryBackoff   internal.Duration  `toml:"connect_retry_backoff"`
+	MaxOpenConnections    int                `toml:"max_open_connections"`
+	MaxIdleConnections    *int               `toml:"max_idle_connections"`
+	ConnectionMaxLifetime internal.Duration  `toml:"connection_max_lifetime"`
+	TCPKeepAlivePeriod    *internal.Duration `toml:"tcp_keep_alive_period"`
+
+	DACFallbackQueries []string `toml:"dac_fallback_queries"`
+
+	IncludeQueries  []string `toml:"include_queries"`
+	ExcludeQueries  []string `toml:"exclude_queries"`
+	ResultByRow     bool     `toml:"result_by_row"`
+	FieldPrefix     *string  `toml:"field_prefix"`
+	FieldNameMode   string   `toml:"field_name_mode"`
+	ValidateQueries bool     `toml:"validate_queries"`
+	StateFile       string   `toml:"state_file"`
+
+	TagTrimSpace          bool              `toml:"tag_trim_space"`
+	TagCollapseWhitespace bool              `toml:"tag_collapse_whitespace"`
+	TagReplaceChars       map[string]string `toml:"tag_replace_chars"`
+	OmitEmptyTags         bool              `toml:"omit_empty_tags"`
+	NormalizeNames        bool              `toml:"normalize_names"`
+	MaxFieldLength        int               `toml:"max_field_length"`
+
+	QueryTimeout       internal.Duration `toml:"query_timeout"`
+	DisableQueryPrefix bool              `toml:"disable_query_prefix"`
+	IsolationLevel     string            `toml:"isolation_level"`
+	DeadlockPriority   string            `toml:"deadlock_priority"`
+	Declare            map[string]string `toml:"declare"`
+
+	ConcurrencyClasses            map[string]int `toml:"concurrency_classes"`
+	MaxConcurrentQueriesPerServer int            `toml:"max_concurrent_queries_per_server"`
+
+	// Deprecated: use [[inputs.sqlserver_extended.query]] tables instead
+	Queries []string `toml:"queries"`
+
+	Log telegraf.Logger `toml:"-"`
+
+	servers     []string
+	serverTags  map[string]map[string]string
+	serversFile *serversFile
+	discovery   *discoveryCache
+	queries     MapQuery
+	queryFilter filter.Filter
+	dacQueries  filter.Filter
+	sanitizer   *tagSanitizer
+	lastRun     map[string]time.Time
+	nextRun     map[string]time.Time
+	cache       *resultCache
+	counters    *counterStore
+	state       *gatherState
+	pools       *connectionPools
+	status      map[string]*serverStatus
+	// owners are the gathered servers the connection strings of replicas and
+	// failover partners are derived from, their pools and state are released
+	// once all owners are gone
+	owners     map[string]map[string]bool
+	statusLock sync.Mutex
+
+	// ctx is cancelled when the plugin stops to abort running queries and
+	// the background discovery
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+	queryDir   *globpath.GlobPath
+	queryFiles map[string]*queryFile
+	querySets  []querySet
+}
+
+// QueryConfig describes a single named query
+type QueryConfig struct {
+	Name              string            `toml:"name"`
+	Script            string            `toml:"script"`
+	Measurement       string            `toml:"measurement"`
+	MeasurementColumn string            `toml:"measurement_column"`
+	TimeColumn        string            `toml:"time_column"`
+	TimeFormat        string            `toml:"time_format"`
+	Timezone          string            `toml:"timezone"`
+	NullHandling      string            `toml:"null_handling"`
+	DecimalAsString   bool              `toml:"decimal_as_string"`
+	DatetimeFormats   map[string]string `toml:"datetime_formats"`
+	BinaryEncodings   map[string]string `toml:"binary_encodings"`
+	UnsignedColumns   []string          `toml:"unsigned_columns"`
+	Convert           map[string]string `toml:"convert"`
+	JSONColumns       []string          `toml:"json_columns"`
+	XPath             []XPathConfig     `toml:"xpath"`
+	Fields            []FieldConfig     `toml:"field"`
+	ResultByRow       *bool             `toml:"result_by_row"`
+	Pivot             bool              `toml:"pivot"`
+	PivotNameColumn   string            `toml:"pivot_name_column"`
+	PivotValueColumn  string            `toml:"pivot_value_column"`
+	Unpivot           bool              `toml:"unpivot"`
+	TagColumns        []string          `toml:"tag_columns"`
+	FieldColumns      []string          `toml:"field_columns"`
+	FieldPrefix       *string           `toml:"field_prefix"`
+	FieldNameMode     string            `toml:"field_name_mode"`
+	Rename            map[string]string `toml:"rename"`
+	FieldPass         []string          `toml:"fieldpass"`
+	FieldDrop         []string          `toml:"fielddrop"`
+	Interval          internal.Duration `toml:"interval"`
+	Schedule          string            `toml:"schedule"`
+	CacheTTL          internal.Duration `toml:"cache_ttl"`
+	Jitter            internal.Duration `toml:"jitter"`
+	Timeout           internal.Duration `toml:"timeout"`
+	MaxRows           int               `toml:"max_rows"`
+	MaxFieldLength    int               `toml:"max_field_length"`
+
+	Retries      int               `toml:"retries"`
+	RetryBackoff internal.Duration `toml:"retry_backoff"`
+
+	Params                 map[string]interface{} `toml:"params"`
+	TableTypes             map[string]string      `toml:"table_types"`
+	Declare                map[string]string      `toml:"declare"`
+	ExecProcedures         bool                   `toml:"exec_procedures"`
+	OutputParams           map[string]string      `toml:"output_params"`
+	OutputFields           map[string]string      `toml:"output_fields"`
+	DisableQueryPrefix     bool                   `toml:"disable_query_prefix"`
+	IsolationLevel         string                 `toml:"isolation_level"`
+	DeadlockPriority       string                 `toml:"deadlock_priority"`
+	LockTimeoutMs          *int                   `toml:"lock_timeout_ms"`
+	Tags                   map[string]string      `toml:"tags"`
+	MinVersion             string                 `toml:"min_version"`
+	MaxVersion             string                 `toml:"max_version"`
+	EngineEditions         []string               `toml:"engine_editions"`
+	RunInEachDatabase      bool                   `toml:"run_in_each_database"`
+	DatabaseInclude        []string               `toml:"database_include"`
+	DatabaseExclude        []string               `toml:"database_exclude"`
+	IncludeSystemDatabases bool                   `toml:"include_system_databases"`
+	DependsOn              string                 `toml:"depends_on"`
+	WatermarkColumn        string                 `toml:"watermark_column"`
+	ExecutionGroup         string                 `toml:"execution_group"`
+	ConcurrencyClass       string                 `toml:"concurrency_class"`
+	Replicas               string                 `toml:"replicas"`
 }
 
 // Query struct
 type Query struct {
-	Script         string
-	ResultByRow    bool
-	OrderedColumns []string
+	Name              string
+	Script            string
+	Measurement       string
+	MeasurementColumn string
+	TimeColumn        string
+	TimeFormat        string
+	TimeLocation      *time.Location
+	NullHandling      string
+	DecimalAsString   bool
+	DatetimeFormats   map[string]string
+	BinaryEncodings   map[string]string
+	UnsignedColumns   filter.Filter
+	Convert           map[string]string
+	JSONColumns       filter.Filter
+	XPaths            []xpathColumn
+	RateFields        filter.Filter
+	ResultByRow       bool
+	Pivot             bool
+	PivotNameColumn   string
+	PivotValueColumn  string
+	Unpivot           bool
+	Columns           columnRoles
+	Rename            map[string]string
+	FieldFilter       filter.Filter
+	Interval          time.Duration
+	Schedule          *schedule
+	CacheTTL          time.Duration
+	Jitter            time.Duration
+	Timeout           time.Duration
+	MaxRows           int
+	MaxFieldLength    int
+	Retries           int
+	RetryBackoff      time.Duration
+	Args              []interface{}
+	ExecProcedure     bool
+	Outputs           []outputParam
+	Template          *template.Template
+	Tags              map[string]string
+	MinVersion        version
+	MaxVersion        version
+	EngineEditions    []string
+	EachDatabase      bool
+	DatabaseFilter    filter.Filter
+	IncludeSystemDbs  bool
+	DependsOn         string
+	WatermarkColumn   string
+	ExecutionGroup    string
+	ConcurrencyClass  string
+	Replicas          string
+	LastRun           time.Time
+	OrderedColumns    []string
+	ColumnTypes       []string
+
+	// legacy marks the entries of the deprecated queries option, their
+	// metrics are not tagged with the query name to keep their series
+	legacy bool
+	// watermark records the watermark column of the current run
+	watermark *watermarkTracker
+	// now is the time of all rows of the current result set of pivoted
+	// queries, so their fields can be merged
+	now time.Time
+	// counters keeps the samples of the previous run for computing deltas
+	counters *counterSeries
+	// perfCounters collects the rows of pivoted result sets with a counter
+	// type column
+	perfCounters *perfCounterBatch
 }
 
 // MapQuery type
@@ -33,6 +267,10 @@ type MapQuery map[string]Query
 
 const defaultServer = "Server=.;app name=telegraf;log=1;"
 
+// intervalGrace compensates for the jitter of the agent ticker so that a
+// query with an interval equal to the agent interval runs on every gather
+const intervalGrace = time.Second
+
 const sampleConfig = `
   ## Specify instances to monitor with a list of connection strings.
   ## All connection parameters are optional.
@@ -41,13 +279,592 @@ const sampleConfig = `
   ##   See https://github.com/denisenkom/go-mssqldb for detailed connection
   ##   parameters, in particular, tls connections can be created like so:
   ##   "encrypt=true;certificate=<cert>;hostNameInCertificate=<SqlServer host fqdn>"
+  ##   Credentials can reference environment variables as $ENV{NAME} and
+  ##   files as $FILE{path}, they are resolved whenever a connection is
+  ##   established so that rotated secrets are picked up.
+  ##   Named instances ("Server=sql01\\INST1") without a port are looked up
+  ##   from the SQL Server Browser on UDP port 1434 for every connection.
+  ##   On Windows, servers prefixed with "np:" or "lpc:" and LocalDB
+  ##   instances ("Server=(localdb)\\MSSQLLocalDB") are connected to over
+  ##   named pipes.
   # servers = [
   #  "Server=192.168.1.10;Port=1433;User Id=<user>;Password=<pw>;app name=telegraf;log=1;",
   # ]
 
-  # queries = ["select 'measurement_name' as measurement, some_data as value FROM your_table", "add one more query"]
+  ## JSON file listing further servers, as connection strings or as objects
+  ## with the keys of the server tables below. It is re-read every interval
+  ## when modified, a missing file lists no servers.
+  ##   ["Server=sql01;User Id=telegraf", {"host": "sql02", "tags": {"env": "dev"}}]
+  # servers_file = "/etc/telegraf/sqlservers.json"
+
+  ## Connect with ApplicationIntent=ReadOnly, so that connections to an
+  ## Availability Group listener are routed to a readable secondary. An
+  ## applicationintent set in the connection string takes precedence.
+  # read_only_intent = false
+
+  ## Always collect from the primary replica, for queries only valid there.
+  ## Connections are made with ApplicationIntent=ReadWrite regardless of the
+  ## connection string, servers which are a secondary replica of an
+  ## Availability Group are skipped with an error, as are the secondaries
+  ## found by discover_replicas.
+  # enforce_primary = false
+
+  ## Connect to all IP addresses of a multi-subnet Availability Group or
+  ## Failover Cluster Instance listener in parallel, so that a failover to
+  ## another subnet does not wait for the timeouts of the unreachable ones.
+  # multi_subnet_failover = false
+
+  ## Treat the servers as Availability Group listeners and collect from the
+  ## primary and secondary replicas behind them, connecting with the
+  ## replica names and the remaining parameters of the connection string.
+  ## Queries run on the primary unless selected otherwise with replicas.
+  # discover_replicas = false
+
+  ## A server with a failoverPartner (and optionally failoverPort) in its
+  ## connection string is collected from the partner while it is
+  ## unreachable, the metrics are tagged with the active_endpoint in use.
+
+  ## Connect to the servers through a SOCKS5 ("socks5://[user:pw@]host:port")
+  ## or HTTP CONNECT ("http://[user:pw@]host:port") proxy. The server names
+  ## must still resolve locally and named instances require a port, as the
+  ## SQL Browser cannot be queried through the proxy.
+  # proxy = ""
+
+  ## Optional TLS Config, setting any of the options enforces encryption.
+  ## The driver does not support client certificates, there are no tls_cert
+  ## and tls_key options, nor a minimum TLS version. Disable TLS 1.0 and 1.1
+  ## on the servers to prevent falling back to them.
+  # tls_ca = "/etc/telegraf/ca.pem"
+  ## Use TLS but skip chain & host verification
+  # insecure_skip_verify = false
+  ## Host name to verify the server certificate against, by default the
+  ## server of the connection string
+  # hostname_in_certificate = "sql01.example.com"
+
+  ## Discover servers in addition to the configured ones, "dns_srv" resolves
+  ## the targets of the SRV record dns_srv_record, "cms" lists the servers
+  ## registered in the Central Management Server cms_server, optionally only
+  ## those in the cms_groups (including subgroups, nested groups are given
+  ## as "Production/EU"), "azure" lists the Azure SQL databases and managed
+  ## instances of the subscription azure_subscription_id, optionally only
+  ## those in the azure_resource_groups and carrying all azure_tags. The Azure
+  ## credentials are taken from the environment as by the azure_monitor
+  ## output, falling back to the managed identity. The discovered servers are
+  ## refreshed every discovery_interval and connected to with the parameters
+  ## of discovery_connection_string, the connections to servers no longer
+  ## discovered are closed. SRV records are asked from the dns_servers, by
+  ## default those of /etc/resolv.conf, and kept for their TTL, so a short
+  ## discovery_interval picks up changes as soon as the TTL expires. The CMS
+  ## query and each Azure Resource Manager request fail after the
+  ## discovery_timeout.
+  # discovery = ""
+  # discovery_interval = "5m"
+  # discovery_timeout = "30s"
+  # discovery_connection_string = "User Id=telegraf;Password=$ENV{SQL_PASSWORD};app name=telegraf"
+  # dns_srv_record = "_mssql._tcp.example.com"
+  # dns_servers = ["10.0.0.2:53"]
+  # cms_server = "Server=cms01;User Id=telegraf;Password=$ENV{SQL_PASSWORD}"
+  # cms_groups = ["Production"]
+  # azure_subscription_id = "00000000-0000-0000-0000-000000000000"
+  # azure_resource_groups = ["rg-sql-*"]
+  # azure_tags = {monitoring = "telegraf"}
+
+  ## Maximum time to establish a connection to a server including the login,
+  ## independent of the query timeouts. Zero uses the driver default of 15s
+  ## for the TCP connection alone.
+  # connect_timeout = "5s"
+
+  ## Number of times the connection to a server is retried within a gather
+  ## before its queries are skipped, the backoff doubles after every retry.
+  ## A failing server is reported once until the error changes or the
+  ## connection is restored.
+  # connect_retries = 0
+  # connect_retry_backoff = "1s"
+
+  ## Limits of the connection pool kept for each server. Zero means no limit
+  ## for max_open_connections and connection_max_lifetime, by default two
+  ## idle connections are kept open.
+  # max_open_connections = 0
+  # max_idle_connections = 2
+  # connection_max_lifetime = "0s"
+
+  ## Interval of the TCP keep-alive probes of the connections, so that idle
+  ## pooled connections survive firewalls dropping inactive sessions. Whole
+  ## seconds only, 0 disables the probes. The keepalive keyword (in seconds)
+  ## of a connection string takes precedence, defaults to 30s.
+  # tcp_keep_alive_period = "30s"
+
+  ## Return one metric per row with a single "value" field for every query
+  ## instead of collecting the "field_" prefixed columns as fields.
+  # result_by_row = false
+
+  ## Prefix of the columns collected as fields, can be overridden per query.
+  ## Without a prefix, all numeric columns are collected as fields under
+  ## their column name.
+  # field_prefix = "field_"
+
+  ## Naming of the fields of prefixed columns, can be overridden per query.
+  ## "trim" removes the prefix and keeps the rest of the column name, e.g.
+  ## "page_life_expectancy" for "field_page_life_expectancy". "legacy" also
+  ## drops everything from the next underscore on, e.g. "page", and is kept
+  ## as default for existing dashboards.
+  # field_name_mode = "legacy"
+
+  ## Sanitization of the tag values read from the columns. tag_trim_space
+  ## removes leading and trailing whitespace, tag_collapse_whitespace also
+  ## replaces newlines and runs of whitespace within the value, e.g. of query
+  ## texts, by a single space. tag_replace_chars replaces the given strings,
+  ## e.g. characters the output can not handle.
+  # tag_trim_space = false
+  # tag_collapse_whitespace = false
+  # tag_replace_chars = { "," = "_", "=" = "_" }
+
+  ## Leave out tags of columns holding empty strings, also after the
+  ## sanitization, instead of adding tags with empty values.
+  # omit_empty_tags = false
+
+  ## Normalize the column names of the query results to lowercase
+  ## snake_case, e.g. "page_life_expectancy" for "[Page Life Expectancy]" or
+  ## "PageLifeExpectancy", for consistent names across queries. The names
+  ## of the columns, pivoted counters and JSON paths are normalized before
+  ## any other option applies, so the column options, rename and fieldpass
+  ## refer to the normalized names. The new names given by rename are kept
+  ## as they are, rate fields are named by them.
+  # normalize_names = false
+
+  ## Truncate string fields, e.g. of query texts or error messages, to the
+  ## given number of characters, can be overridden per query. Zero disables
+  ## the truncation.
+  # max_field_length = 0
+
+  ## Maximum time a query may run before it is cancelled, can be overridden
+  ## per query. Zero disables the timeout.
+  # query_timeout = "0s"
+
+  ## Every query is prefixed with
+  ##   SET DEADLOCK_PRIORITY -10;
+  ##   SET NOCOUNT ON;
+  ##   SET TRANSACTION ISOLATION LEVEL READ UNCOMMITTED;
+  ## Set to true to run the scripts exactly as configured, can also be set
+  ## per query.
+  # disable_query_prefix = false
+
+  ## Transaction isolation level set by the query prefix, one of
+  ## "read uncommitted", "read committed", "repeatable read", "snapshot" or
+  ## "serializable". Can be overridden per query.
+  # isolation_level = "read uncommitted"
+
+  ## Deadlock priority set by the query prefix, one of "low", "normal",
+  ## "high" or a number between -10 and 10. Use "none" to leave the session
+  ## default. Can be overridden per query.
+  # deadlock_priority = "-10"
+
+  ## SQL variables declared at the start of every query, e.g. to tune shared
+  ## query files per deployment. Integer and decimal values are declared as
+  ## bigint and float, anything else as nvarchar. Can be extended per query.
+  # declare = { "@TopN" = "25", "@MinDurationMs" = "500" }
+
+  ## Maximum number of queries of a concurrency class running at the same
+  ## time on each server, queries are assigned with concurrency_class.
+  # concurrency_classes = { heavy = 1, light = 4 }
+
+  ## Maximum number of queries running at the same time on each server,
+  ## bounding the sessions opened against it. Zero runs all due queries in
+  ## parallel.
+  # max_concurrent_queries_per_server = 0
+
+  ## Files containing the SQL text of additional queries, one query per file.
+  ## The query name is the file name without its extension. Modified files
+  ## are reloaded on the next gather. Options of the query table can be set
+  ## by comments at the top of the file, values with spaces are quoted:
+  ##   -- telegraf: measurement=waits interval=60s tags=collector:waits
+  ##   -- telegraf: schedule="0 */6 * * *"
+  # query_files = ["/etc/telegraf/sql/index_fragmentation.sql"]
+
+  ## Glob pattern matching query files, works like query_files but is
+  ## re-evaluated on every gather so added or removed files are picked up
+  ## without changing the configuration.
+  # query_dir = "/etc/telegraf/sql/*.sql"
+
+  ## Bundled query packs to enable in addition to the configured queries,
+  ## available packs are "core", "waits", "io" and "ag". The queries of a
+  ## pack are named with the pack name as prefix, e.g. "waits_stats".
+  # query_packs = ["core", "waits"]
+
+  ## Glob patterns of queries run on the Dedicated Admin Connection (DAC) of
+  ## servers refusing regular logins, e.g. when they run out of worker
+  ## threads, so that basic health metrics keep flowing. The metrics are
+  ## tagged with dac=true. Remote DACs must be enabled on the server with
+  ## "remote admin connections", a server accepts only one DAC at a time so
+  ## keep these queries few and cheap.
+  # dac_fallback_queries = []
+
+  ## Glob patterns of query names to run or to skip, applied to all queries
+  ## regardless of where they are defined.
+  # include_queries = []
+  # exclude_queries = []
+
+  ## File the start time of the last successful run and the watermark of
+  ## every query are saved to, so incremental queries resume where they
+  ## stopped after a restart.
+  # state_file = "/var/lib/telegraf/sqlserver_extended.json"
+
+  ## Parse all queries with SET PARSEONLY ON on every server at startup and
+  ## fail on syntax errors. Servers which cannot be reached are skipped.
+  # validate_queries = false
+
+  ## Servers can also be defined with structured connection parameters,
+  ## overriding the ones of the optional connection_string.
+  # [[inputs.sqlserver_extended.server]]
+  #   connection_string = "encrypt=true;log=1"
+  #   host = "sql01.example.com"
+  #   port = 1433
+  #   instance = ""
+  #   ## Windows only: connect over named pipes ("np") or to a local server
+  #   ## ("lpc", using its local named pipe as shared memory is not
+  #   ## supported), instead of TCP. The pipe defaults to the one of the
+  #   ## instance. LocalDB instances are given as host "(localdb)" and their
+  #   ## instance, they are started if needed.
+  #   # protocol = "tcp"
+  #   # pipe = '\\sql01\pipe\sql\query'
+  #   user = "telegraf"
+  #   password = "$ENV{SQL_MONITOR_PASSWORD}"
+  #   ## Read the credentials from files instead, e.g. mounted secrets
+  #   # user_file = "/run/secrets/sql_user"
+  #   # password_file = "/run/secrets/sql_password"
+  #   database = "master"
+  #   app_name = "telegraf"
+  #   ## Collect from this server while the host is unreachable
+  #   failover_partner = "sql02.example.com"
+  #   ## Tags added to every metric of the server
+  #   # tags = { env = "prod", dc = "eu-west" }
+  #   ## Overrides the proxy of the plugin
+  #   # proxy = "socks5://jump.example.com:1080"
+  #   ## Overrides the read_only_intent of the plugin
+  #   read_only_intent = false
+  #   ## Authentication method, "SQL" logs in with user and password, "NTLM"
+  #   ## authenticates the Windows user of the domain with its password.
+  #   # auth_method = "SQL"
+  #   # domain = "CORP"
+
+  ## Restrict the queries executed on the servers whose name, the server of
+  ## the connection string, matches one of the glob patterns. The first
+  ## matching set applies, servers not matching any set run all queries.
+  # [[inputs.sqlserver_extended.query_set]]
+  #   servers = ["sqlag-*"]
+  #   include_queries = ["ag_*", "core_*"]
+  #   exclude_queries = []
+
+  ## Queries to execute, each defined in its own table.
+  # [[inputs.sqlserver_extended.query]]
+  #   ## Name of the query, added to every metric as the "query_name" tag and
+  #   ## used to identify the query in error messages, it must be unique.
+  #   name = "waits"
+  #
+  #   ## SQL text of the query, ${VAR} placeholders are replaced with the
+  #   ## value of the environment variable when the plugin starts, this also
+  #   ## applies to query files. The script is a Go template, resolved for
+  #   ## every server on each gather, with the following variables:
+  #   ##   {{.ServerName}} - server of the connection string
+  #   ##   {{.Database}}   - database of the connection string
+  #   ##   {{.Interval}}   - seconds between two runs of the query
+  #   ##   {{.Now}}        - start time of the current run
+  #   ##   {{.LastGatherTime}} - start time of the last successful run on
+  #   ##       the server, or of the plugin if the query did not succeed yet
+  #   ##   {{.Watermark}}  - highest value of the watermark_column read on the
+  #   ##       server as SQL literal, empty before the first row was read
+  #   ## The times are local and formatted like "2006-01-02T15:04:05.000",
+  #   ## other formats are available with e.g. {{.Now.UTC.Format "..."}}.
+  #   script = "SELECT TOP (@top_n) 'waits' AS measurement, wait_type, wait_time_ms AS field_wait_time_ms FROM sys.dm_os_wait_stats ORDER BY wait_time_ms DESC"
+  #
+  #   ## Measurement name of rows without a "measurement" column, defaults to
+  #   ## "sqlserver_extended".
+  #   # measurement = "waits"
+  #
+  #   ## Column holding the measurement name of the rows.
+  #   # measurement_column = "measurement"
+  #
+  #   ## Column holding the time of the rows, e.g. of job history or ring
+  #   ## buffer events, instead of the time the row was read. Rows with a NULL
+  #   ## time get the current time.
+  #   # time_column = "event_time"
+  #
+  #   ## Format of time columns holding strings or numbers, one of "unix",
+  #   ## "unix_ms", "unix_us", "unix_ns" or a Go time layout such as
+  #   ## "2006-01-02 15:04:05". Date and time columns need no format.
+  #   # time_format = ""
+  #
+  #   ## Timezone of time strings and of date and time columns without an
+  #   ## offset, e.g. the server local time returned by GETDATE(). Either
+  #   ## "UTC", "Local" for the timezone of the agent or a name of the IANA
+  #   ## timezone database such as "Europe/Berlin".
+  #   # timezone = "UTC"
+  #
+  #   ## Handling of NULL values, either "skip" to leave the columns out of
+  #   ## the metric, "zero" to collect the zero value of the type the column
+  #   ## is collected as, e.g. 0 or an empty string for binary columns and
+  #   ## rfc3339 datetimes, or "string" to collect the string "NULL".
+  #   # null_handling = "skip"
+  #
+  #   ## DECIMAL, NUMERIC, MONEY and SMALLMONEY columns are collected as
+  #   ## floats, this collects them as strings instead to keep their full
+  #   ## precision.
+  #   # decimal_as_string = false
+  #
+  #   ## Formats date and time columns are collected in, by column. Either
+  #   ## "unix", "unix_ms", "unix_us" and "unix_ns" for integer fields,
+  #   ## "rfc3339" for string fields or "time" to use the column as the time
+  #   ## of the metric like time_column. Columns without a format are left
+  #   ## out. Times without an offset are in the timezone given above.
+  #   # datetime_formats = { start_time = "unix_ns", last_run = "rfc3339" }
+  #
+  #   ## Encodings of binary columns such as query_hash or plan_handle, by
+  #   ## column. Either "hex" for a hex literal like "0x1A2B" or "base64".
+  #   ## Columns without an encoding are collected as hex literal.
+  #   # binary_encodings = { plan_handle = "base64" }
+  #
+  #   ## Columns collected as unsigned integers, given as glob patterns, e.g.
+  #   ## of large COUNT_BIG, DECIMAL(20,0) or rowversion values. Values out of
+  #   ## the unsigned 64-bit range fail the query instead of wrapping around.
+  #   # unsigned_columns = ["rv"]
+  #
+  #   ## Types the columns are converted to after the conversions above, by
+  #   ## column. Either "float", "int", "uint", "bool" or "string". Use it to
+  #   ## keep the type of a field stable for outputs rejecting type conflicts.
+  #   ## Values which can not be converted fail the query, NULLs replaced by
+  #   ## the "zero" null_handling are converted as well.
+  #   # convert = { field_cpu = "float", field_flag = "bool" }
+  #
+  #   ## Columns holding JSON documents, e.g. produced by FOR JSON, given as
+  #   ## glob patterns. The documents are flattened into fields named by the
+  #   ## field name of the column and the dotted path of the values, e.g.
+  #   ## "waits.0.wait_ms", the columns themselves are not collected.
+  #   # json_columns = ["waits"]
+  #
+  #   ## Fields and tags extracted from the XML documents of a column, e.g. of
+  #   ## deadlock graphs, showplans or extended event payloads, the column
+  #   ## itself is not collected. The expressions support a subset of XPath:
+  #   ## paths of element names or "*" with "/" and "//", predicates on the
+  #   ## position, last() or the value of attributes and child elements, an
+  #   ## attribute or text() as last step and count(). Namespaces are ignored.
+  #   ## Numeric field values are collected as floats, expressions matching
+  #   ## nothing are left out.
+  #   # [[inputs.sqlserver_extended.query.xpath]]
+  #   #   column = "deadlock_graph"
+  #   #   fields = { processes = "count(//process-list/process)", wait_ms = "//process[1]/@waittime" }
+  #   #   tags = { victim = "//victim-list/victimProcess/@id" }
+  #
+  #   ## Overrides the plugin-wide result_by_row for this query.
+  #   # result_by_row = false
+  #
+  #   ## Turn rows of the shape (name, value) into fields, e.g. of
+  #   ## sys.dm_os_performance_counters, instead of one metric per row. The
+  #   ## rows of a result set with the same measurement and tags are merged
+  #   ## into a single metric with one field per name. The name and value
+  #   ## columns are not collected as tags. Results with a cntr_type column
+  #   ## are collected by the counter type, see the README.
+  #   # pivot = false
+  #   # pivot_name_column = "name"
+  #   # pivot_value_column = "value"
+  #
+  #   ## Explode the fields of wide rows into one metric per field, tagged
+  #   ## with the field name as "name" and holding the single field "value".
+  #   # unpivot = false
+  #
+  #   ## Options of the fields matching the name, given as glob pattern. With
+  #   ## rate enabled, cumulative fields are collected as their rate per
+  #   ## second since the previous gather, fields without a previous value
+  #   ## or reset since, e.g. by a failover, are left out.
+  #   # [[inputs.sqlserver_extended.query.field]]
+  #   #   name = "reads"
+  #   #   rate = true
+  #
+  #   ## Columns collected as tags and as fields, given as glob patterns.
+  #   ## Without tag_columns, the string and BIT columns not collected as
+  #   ## fields are tags. Without field_columns, the columns starting with
+  #   ## "field_" are fields, named after the part following the prefix.
+  #   ## Columns matched by field_columns keep their name. Other columns are
+  #   ## ignored. BIT columns are collected as boolean fields or tagged with
+  #   ## "true" or "false".
+  #   # tag_columns = ["wait_type"]
+  #   # field_columns = ["wait_time_ms", "waiting_tasks_count"]
+  #
+  #   ## Overrides the plugin-wide field_prefix for this query.
+  #   # field_prefix = "f_"
+  #
+  #   ## Overrides the plugin-wide field_name_mode for this query.
+  #   # field_name_mode = "trim"
+  #
+  #   ## Names of the fields and tags of columns, by column name. For pivoted
+  #   ## queries the keys are the values of the pivot_name_column.
+  #   # rename = { field_plecount = "page_life_expectancy" }
+  #
+  #   ## Fields collected and left out, given as glob patterns of the field
+  #   ## names. Metrics without any remaining field are dropped.
+  #   # fieldpass = ["reads", "writes"]
+  #   # fielddrop = ["*_text"]
+  #
+  #   ## Run the query at most once per interval instead of on every gather,
+  #   ## should be a multiple of the agent interval.
+  #   # interval = "10m"
+  #
+  #   ## Run the query at fixed times instead, given as a cron expression with
+  #   ## the fields minute, hour, day of month, month and day of week in local
+  #   ## time. The query runs on the first gather at or after a matching time,
+  #   ## it can not be combined with interval.
+  #   # schedule = "0 */6 * * *"
+  #
+  #   ## Re-emit the metrics of the last successful run with the current time
+  #   ## on gathers the query does not run on because of interval or schedule,
+  #   ## as long as they are not older than the given duration.
+  #   # cache_ttl = "1h"
+  #
+  #   ## Delay the query by a random time up to the given duration on each
+  #   ## run, so heavy queries of many agents do not hit a shared server at
+  #   ## the same second. Should be well below the interval of the query.
+  #   # jitter = "30s"
+  #
+  #   ## Maximum execution time of the query, defaults to query_timeout.
+  #   # timeout = "30s"
+  #
+  #   ## Stop reading the results after the given number of rows, counted over
+  #   ## all result sets, and log a warning. Zero means no limit.
+  #   # max_rows = 10000
+  #
+  #   ## Maximum number of characters of string fields, defaults to
+  #   ## max_field_length.
+  #   # max_field_length = 1024
+  #
+  #   ## Number of times the query is retried after failing with a deadlock,
+  #   ## a lock timeout or a query timeout, as long as it did not return any
+  #   ## rows yet. The backoff doubles after every retry.
+  #   # retries = 0
+  #   # retry_backoff = "1s"
+  #
+  #   ## Values of named parameters bound by the driver, referred to as @name
+  #   ## in the script. Lists are passed as table-valued parameters and need
+  #   ## a user-defined table type with a single column of a matching type,
+  #   ## given in table_types.
+  #   # params = { top_n = 20, wait_types = ["LCK_M_S", "LCK_M_X"] }
+  #   # table_types = { wait_types = "dbo.NameList" }
+  #
+  #   ## SQL variables declared at the start of the script, in addition to and
+  #   ## overriding the plugin-wide declare.
+  #   # declare = { "@TopN" = "10" }
+  #
+  #   ## The script is an EXEC statement calling a stored procedure, a
+  #   ## non-zero return value of the procedure is reported as an error.
+  #   # exec_procedures = false
+  #
+  #   ## OUTPUT parameters of the procedure and their type, one of "int",
+  #   ## "float", "string" or "bool", added as fields of one more metric
+  #   ## once the procedure finished. The script has to pass them on, e.g.
+  #   ## "EXEC dbo.health_check @score = @score OUTPUT". The fields are named
+  #   ## after the parameters unless mapped otherwise by output_fields.
+  #   # output_params = { "@score" = "float" }
+  #   # output_fields = { "@score" = "health_score" }
+  #
+  #   ## Run the script without the SET statements prefix.
+  #   # disable_query_prefix = false
+  #
+  #   ## Transaction isolation level of the query, defaults to isolation_level.
+  #   # isolation_level = "read committed"
+  #
+  #   ## Deadlock priority of the query, defaults to deadlock_priority.
+  #   # deadlock_priority = "normal"
+  #
+  #   ## Milliseconds to wait for locks before the query fails, set with
+  #   ## SET LOCK_TIMEOUT even if the query prefix is disabled. Zero fails
+  #   ## immediately, -1 waits forever.
+  #   # lock_timeout_ms = 2000
+  #
+  #   ## Static tags added to every metric of the query.
+  #   # tags = { collector = "waits", team = "dba" }
+  #
+  #   ## Range of SQL Server versions the query is executed on, both ends are
+  #   ## inclusive and compared on the given components only, e.g. "13" for
+  #   ## any SQL Server 2016 build. Servers outside the range are skipped.
+  #   # min_version = "15.0"
+  #   # max_version = "15"
+  #
+  #   ## Engine editions the query is executed on, any of "SQLServer",
+  #   ## "AzureSQLDB", "AzureSQLManagedInstance", "AzureSynapse" and
+  #   ## "AzureSQLEdge". Servers of other editions are skipped.
+  #   # engine_editions = ["SQLServer", "AzureSQLManagedInstance"]
+  #
+  #   ## Execute the query in the context of every online database of the
+  #   ## server, the metrics are tagged with "database_name" and the
+  #   ## {{.Database}} template variable is set to the current database.
+  #   # run_in_each_database = false
+  #
+  #   ## Glob patterns of the databases to run the query in or to skip when
+  #   ## run_in_each_database is set. The system databases master, model, msdb
+  #   ## and tempdb are skipped unless include_system_databases is set.
+  #   # database_include = []
+  #   # database_exclude = []
+  #   # include_system_databases = false
+  #
+  #   ## Name of a query this query depends on. The query runs after the other
+  #   ## one in the same gather and only if it returned at least one row.
+  #   # depends_on = "blocking_check"
+  #
+  #   ## Column of an incremental query, e.g. a rowversion, an integer or a
+  #   ## datetime, whose highest value is available as {{.Watermark}} in the
+  #   ## next run, e.g. "{{with .Watermark}}WHERE rv > {{.}}{{end}}". Times
+  #   ## are given as datetime2(7) or datetimeoffset(7) to keep their full
+  #   ## precision, decimals are compared and given by their numeric value.
+  #   # watermark_column = "rv"
+  #
+  #   ## Queries of the same execution group run one after another in the
+  #   ## order of their names instead of in parallel on each server.
+  #   # execution_group = "staging"
+  #
+  #   ## Concurrency class of the query, limiting how many queries of the
+  #   ## class run in parallel, defined in concurrency_classes.
+  #   # concurrency_class = "heavy"
+  #
+  #   ## Replicas to run the query on with discover_replicas, either
+  #   ## "primary", "secondary" or "all".
+  #   # replicas = "primary"
 `
 
+// Start validates the queries, discovers the servers and keeps refreshing
+// them in the background, the queries are run by Gather
+func (s *SQLServerExtended) Start(acc telegraf.Accumulator) error {
+	acc = &redactingAccumulator{Accumulator: acc}
+	if s.ctx == nil || s.ctx.Err() != nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	if s.ValidateQueries {
+		if err := s.validateQueries(); err != nil {
+			return err
+		}
+	}
+
+	if s.discovery != nil {
+		// the servers are gathered even if the initial discovery fails
+		acc.AddError(s.discovery.refresh(s.ctx))
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.discovery.run(s.ctx, acc)
+		}()
+	}
+	return nil
+}
+
+// Stop stops the background discovery, cancels the running queries and
+// closes the connections
+func (s *SQLServerExtended) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+	if s.pools != nil {
+		s.pools.close()
+	}
+}
+
 // SampleConfig return the sample configuration
 func (s *SQLServerExtended) SampleConfig() string {
 	return sampleConfig
@@ -62,74 +879,1176 @@ type scanner interface {
 	Scan(dest ...interface{}) error
 }
 
-func initQueries(s *SQLServerExtended) {
+// resultSet is the subset of *sql.Rows used to read query results
+type resultSet interface {
+	scanner
+	Columns() ([]string, error)
+	Next() bool
+	NextResultSet() bool
+	Err() error
+}
+
+// Init validates the configuration and prepares the queries
+func (s *SQLServerExtended) Init() error {
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	// errors of the driver can contain the connection strings
+	if _, ok := s.Log.(*redactingLogger); !ok && s.Log != nil {
+		s.Log = &redactingLogger{Logger: s.Log}
+	}
+	return initQueries(s)
+}
+
+func initQueries(s *SQLServerExtended) error {
 	s.queries = make(MapQuery)
+	s.lastRun = make(map[string]time.Time)
+	s.nextRun = make(map[string]time.Time)
+	s.cache = newResultCache()
+	s.counters = newCounterStore()
+	if s.pools != nil {
+		s.pools.close()
+	}
+	s.status = make(map[string]*serverStatus)
+	s.owners = make(map[string]map[string]bool)
+	s.pools = newConnectionPools(s.MaxOpenConnections, s.MaxIdleConnections, s.ConnectionMaxLifetime.Duration, s.ConnectTimeout.Duration)
+	params, err := s.connectionParams()
+	if err != nil {
+		return err
+	}
+	s.pools.params = params
+	if s.EnforcePrimary {
+		s.pools.forcedParams = map[string]string{"applicationintent": "ReadWrite"}
+	}
+	s.state = newGatherState()
+	if s.StateFile != "" {
+		if err := s.state.load(s.StateFile); err != nil {
+			return err
+		}
+	}
+	s.queryFiles = make(map[string]*queryFile)
 	queries := s.queries
 
-	i := 0
-	for _, quer := range s.Queries {
-		queries["custom_"+strconv.Itoa(i)] = Query{Script: sqlPrefix + quer, ResultByRow: s.ResultByRow}
-		i += 1
+	s.dacQueries, err = filter.Compile(s.DACFallbackQueries)
+	if err != nil {
+		return fmt.Errorf("invalid dac_fallback_queries: %v", err)
+	}
+	s.queryFilter, err = filter.NewIncludeExcludeFilter(s.IncludeQueries, s.ExcludeQueries)
+	if err != nil {
+		return fmt.Errorf("invalid query filter: %v", err)
+	}
+	s.sanitizer = newTagSanitizer(s.TagTrimSpace, s.TagCollapseWhitespace, s.TagReplaceChars)
+
+	if s.ConnectRetries < 0 {
+		return fmt.Errorf("connect_retries must be 0 or greater")
+	}
+	if s.ConnectRetryBackoff.Duration <= 0 {
+		s.ConnectRetryBackoff.Duration = time.Second
+	}
+
+	for class, limit := range s.ConcurrencyClasses {
+		if limit < 1 {
+			return fmt.Errorf("concurrency class %q: limit must be at least 1", class)
+		}
+	}
+	if s.MaxConcurrentQueriesPerServer < 0 {
+		return fmt.Errorf("max_concurrent_queries_per_server must be 0 or greater")
+	}
+
+	s.servers, s.serverTags, err = compileServers(s.Servers, s.Server)
+	if err != nil {
+		return err
+	}
+	if s.EnforcePrimary {
+		for _, server := range s.servers {
+			if strings.EqualFold(parseConnectionString(server)["applicationintent"], "ReadOnly") {
+				return fmt.Errorf("server %q: ApplicationIntent=ReadOnly conflicts with enforce_primary", serverName(parseConnectionString(server)))
+			}
+		}
+	}
+
+	s.serversFile = nil
+	if s.ServersFile != "" {
+		s.serversFile = &serversFile{path: s.ServersFile}
+		if err := s.serversFile.refresh(); err != nil {
+			return err
+		}
+	}
+
+	if s.DiscoveryTimeout.Duration <= 0 {
+		s.DiscoveryTimeout.Duration = defaultDiscoveryTimeout
+	}
+	d, err := s.newDiscoverer()
+	if err != nil {
+		return err
+	}
+	s.discovery = nil
+	if d != nil {
+		if s.DiscoveryInterval.Duration <= 0 {
+			s.DiscoveryInterval.Duration = defaultDiscoveryInterval
+		}
+		s.discovery = &discoveryCache{discoverer: d, interval: s.DiscoveryInterval.Duration}
+	} else if len(s.servers) == 0 && s.serversFile == nil {
+		s.servers = []string{defaultServer}
+	}
+
+	s.querySets, err = compileQuerySets(s.QuerySets)
+	if err != nil {
+		return err
+	}
+
+	if len(s.Queries) > 0 && s.Log != nil {
+		s.Log.Warn("Option \"queries\" is deprecated, please use [[inputs.sqlserver_extended.query]] instead")
+	}
+	for i, script := range s.Queries {
+		name := "custom_" + strconv.Itoa(i)
+		if !s.queryFilter.Match(name) {
+			continue
+		}
+		prefix, err := s.queryPrefix(QueryConfig{})
+		if err != nil {
+			return err
+		}
+		queries[name] = Query{Name: name, Script: prefix + script, ResultByRow: s.ResultByRow, Timeout: s.QueryTimeout.Duration, MaxFieldLength: s.MaxFieldLength, legacy: true}
+	}
+
+	for _, q := range s.Query {
+		if err := s.addQuery(q); err != nil {
+			return err
+		}
+	}
+	for _, path := range s.QueryFiles {
+		if err := s.loadQueryFile(path, false); err != nil {
+			return err
+		}
+	}
+	for _, pack := range s.QueryPacks {
+		packQueries, ok := queryPacks[pack]
+		if !ok {
+			return fmt.Errorf("unknown query pack %q", pack)
+		}
+		for _, q := range packQueries {
+			if err := s.addQuery(q); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := s.checkDependencies(); err != nil {
+		return err
+	}
+
+	if s.QueryDir != "" {
+		s.queryDir, err = globpath.Compile(s.QueryDir)
+		if err != nil {
+			return fmt.Errorf("invalid query_dir: %v", err)
+		}
+		if err := s.loadQueryDir(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addQuery validates the query configuration and registers the query unless
+// it is filtered out by name
+func (s *SQLServerExtended) addQuery(q QueryConfig) error {
+	if q.Name == "" {
+		return fmt.Errorf("query name must not be empty")
+	}
+	if q.Script == "" {
+		return fmt.Errorf("query %q: script must not be empty", q.Name)
+	}
+	if _, ok := s.queries[q.Name]; ok {
+		return fmt.Errorf("query %q is defined more than once", q.Name)
+	}
+	if !s.queryFilter.Match(q.Name) {
+		return nil
+	}
+	if q.ExecProcedures && !isExecStatement(q.Script) {
+		return fmt.Errorf("query %q: script must be an EXEC statement when exec_procedures is set", q.Name)
+	}
+	var sched *schedule
+	if q.Schedule != "" {
+		if q.Interval.Duration > 0 {
+			return fmt.Errorf("query %q: interval and schedule are mutually exclusive", q.Name)
+		}
+		var err error
+		if sched, err = parseSchedule(q.Schedule); err != nil {
+			return fmt.Errorf("query %q: %v", q.Name, err)
+		}
+	}
+	if q.MaxRows < 0 {
+		return fmt.Errorf("query %q: max_rows must not be negative", q.Name)
+	}
+	if q.MaxFieldLength < 0 {
+		return fmt.Errorf("query %q: max_field_length must not be negative", q.Name)
+	}
+	maxFieldLength := s.MaxFieldLength
+	if q.MaxFieldLength > 0 {
+		maxFieldLength = q.MaxFieldLength
+	}
+	if _, ok := s.ConcurrencyClasses[q.ConcurrencyClass]; q.ConcurrencyClass != "" && !ok {
+		return fmt.Errorf("query %q: unknown concurrency class %q", q.Name, q.ConcurrencyClass)
+	}
+	if q.Retries < 0 {
+		return fmt.Errorf("query %q: retries must not be negative", q.Name)
+	}
+	replicas := q.Replicas
+	switch replicas {
+	case "":
+		replicas = replicaPrimary
+	case replicaPrimary, replicaSecondary, replicaAll:
+	default:
+		return fmt.Errorf("query %q: invalid replicas %q", q.Name, q.Replicas)
+	}
+	args, err := namedArgs(q.Params, q.TableTypes)
+	if err != nil {
+		return fmt.Errorf("query %q: %v", q.Name, err)
+	}
+	if len(q.OutputParams) > 0 && !q.ExecProcedures {
+		return fmt.Errorf("query %q: output_params require exec_procedures", q.Name)
+	}
+	outputs, err := outputParams(q.OutputParams, q.OutputFields)
+	if err != nil {
+		return fmt.Errorf("query %q: %v", q.Name, err)
+	}
+	declare := make(map[string]string, len(s.Declare)+len(q.Declare))
+	for name, value := range s.Declare {
+		declare["@"+strings.TrimPrefix(name, "@")] = value
+	}
+	for name, value := range q.Declare {
+		declare["@"+strings.TrimPrefix(name, "@")] = value
+	}
+	declarations, err := declareStatements(declare)
+	if err != nil {
+		return fmt.Errorf("query %q: %v", q.Name, err)
+	}
+	timeout := s.QueryTimeout.Duration
+	if q.Timeout.Duration > 0 {
+		timeout = q.Timeout.Duration
+	}
+	prefix, err := s.queryPrefix(q)
+	if err != nil {
+		return fmt.Errorf("query %q: %v", q.Name, err)
+	}
+	if q.LockTimeoutMs != nil {
+		if *q.LockTimeoutMs < -1 {
+			return fmt.Errorf("query %q: lock_timeout_ms must be -1 or greater", q.Name)
+		}
+		prefix += fmt.Sprintf("SET LOCK_TIMEOUT %d;\n", *q.LockTimeoutMs)
 	}
+	minVersion, err := parseVersion(q.MinVersion)
+	if err != nil {
+		return fmt.Errorf("query %q: min_version: %v", q.Name, err)
+	}
+	maxVersion, err := parseVersion(q.MaxVersion)
+	if err != nil {
+		return fmt.Errorf("query %q: max_version: %v", q.Name, err)
+	}
+	for _, edition := range q.EngineEditions {
+		if !isEngineEdition(edition) {
+			return fmt.Errorf("query %q: unknown engine edition %q", q.Name, edition)
+		}
+	}
+	databaseFilter, err := filter.NewIncludeExcludeFilter(q.DatabaseInclude, q.DatabaseExclude)
+	if err != nil {
+		return fmt.Errorf("query %q: invalid database filter: %v", q.Name, err)
+	}
+	resultByRow := s.ResultByRow
+	if q.ResultByRow != nil {
+		resultByRow = *q.ResultByRow
+	}
+	pivotNameColumn, pivotValueColumn := q.PivotNameColumn, q.PivotValueColumn
+	if q.Unpivot && resultByRow {
+		return fmt.Errorf("query %q: unpivot and result_by_row are mutually exclusive", q.Name)
+	}
+	if q.Pivot {
+		if resultByRow {
+			return fmt.Errorf("query %q: pivot and result_by_row are mutually exclusive", q.Name)
+		}
+		if q.Unpivot {
+			return fmt.Errorf("query %q: pivot and unpivot are mutually exclusive", q.Name)
+		}
+		if pivotNameColumn == "" {
+			pivotNameColumn = defaultPivotNameColumn
+		}
+		if pivotValueColumn == "" {
+			pivotValueColumn = defaultPivotValueColumn
+		}
+	}
+	fieldPrefix := defaultFieldPrefix
+	if s.FieldPrefix != nil {
+		fieldPrefix = *s.FieldPrefix
+	}
+	if q.FieldPrefix != nil {
+		fieldPrefix = *q.FieldPrefix
+	}
+	fieldNameMode := s.FieldNameMode
+	if q.FieldNameMode != "" {
+		fieldNameMode = q.FieldNameMode
+	}
+	columns, err := newColumnRoles(q.TagColumns, q.FieldColumns, fieldPrefix, fieldNameMode)
+	if err != nil {
+		return fmt.Errorf("query %q: %v", q.Name, err)
+	}
+	measurementColumn := q.MeasurementColumn
+	if measurementColumn == "" {
+		measurementColumn = defaultMeasurementColumn
+	}
+	nullHandling := q.NullHandling
+	switch nullHandling {
+	case "":
+		nullHandling = nullSkip
+	case nullSkip, nullZero, nullString:
+	default:
+		return fmt.Errorf("query %q: invalid null_handling %q", q.Name, q.NullHandling)
+	}
+	timeColumn := q.TimeColumn
+	datetimeFormats := make(map[string]string, len(q.DatetimeFormats))
+	for column, format := range q.DatetimeFormats {
+		if !isDatetimeFormat(format) {
+			return fmt.Errorf("query %q: invalid datetime format %q of column %q", q.Name, format, column)
+		}
+		if format != datetimeTime {
+			datetimeFormats[column] = format
+			continue
+		}
+		if timeColumn != "" && timeColumn != column {
+			return fmt.Errorf("query %q: column %q can not be the time, the time column is %q", q.Name, column, timeColumn)
+		}
+		timeColumn = column
+	}
+	for column, encoding := range q.BinaryEncodings {
+		if encoding != encodingHex && encoding != encodingBase64 {
+			return fmt.Errorf("query %q: invalid binary encoding %q of column %q", q.Name, encoding, column)
+		}
+	}
+	for column, t := range q.Convert {
+		if !isCoerceType(t) {
+			return fmt.Errorf("query %q: invalid type %q to convert column %q to", q.Name, t, column)
+		}
+	}
+	for column, name := range q.Rename {
+		if name == "" {
+			return fmt.Errorf("query %q: empty name to rename column %q to", q.Name, column)
+		}
+	}
+	var fieldFilter filter.Filter
+	if len(q.FieldPass) > 0 || len(q.FieldDrop) > 0 {
+		if fieldFilter, err = filter.NewIncludeExcludeFilter(q.FieldPass, q.FieldDrop); err != nil {
+			return fmt.Errorf("query %q: invalid fieldpass or fielddrop: %v", q.Name, err)
+		}
+	}
+	var jsonColumns filter.Filter
+	if len(q.JSONColumns) > 0 {
+		if jsonColumns, err = filter.Compile(q.JSONColumns); err != nil {
+			return fmt.Errorf("query %q: invalid json_columns: %v", q.Name, err)
+		}
+	}
+	var xpaths []xpathColumn
+	for _, cfg := range q.XPath {
+		xpath, err := newXPathColumn(cfg)
+		if err != nil {
+			return fmt.Errorf("query %q: %v", q.Name, err)
+		}
+		xpaths = append(xpaths, xpath)
+	}
+	rateFields, err := compileRateFields(q.Fields)
+	if err != nil {
+		return fmt.Errorf("query %q: invalid field: %v", q.Name, err)
+	}
+	var unsignedColumns filter.Filter
+	if len(q.UnsignedColumns) > 0 {
+		if unsignedColumns, err = filter.Compile(q.UnsignedColumns); err != nil {
+			return fmt.Errorf("query %q: invalid unsigned_columns: %v", q.Name, err)
+		}
+	}
+	timeLocation := time.UTC
+	if q.Timezone != "" {
+		if timeLocation, err = time.LoadLocation(q.Timezone); err != nil {
+			return fmt.Errorf("query %q: invalid timezone: %v", q.Name, err)
+		}
+	}
+	script := prefix + declarations + expandEnv(q.Script)
+	tmpl, err := template.New(q.Name).Option("missingkey=error").Parse(script)
+	if err != nil {
+		return fmt.Errorf("query %q: parsing script template failed: %v", q.Name, err)
+	}
+	s.queries[q.Name] = Query{
+		Name:              q.Name,
+		Script:            script,
+		Measurement:       q.Measurement,
+		MeasurementColumn: measurementColumn,
+		TimeColumn:        timeColumn,
+		TimeFormat:        q.TimeFormat,
+		TimeLocation:      timeLocation,
+		NullHandling:      nullHandling,
+		DecimalAsString:   q.DecimalAsString,
+		DatetimeFormats:   datetimeFormats,
+		BinaryEncodings:   q.BinaryEncodings,
+		UnsignedColumns:   unsignedColumns,
+		Convert:           q.Convert,
+		JSONColumns:       jsonColumns,
+		XPaths:            xpaths,
+		RateFields:        rateFields,
+		ResultByRow:       resultByRow,
+		Pivot:             q.Pivot,
+		PivotNameColumn:   pivotNameColumn,
+		PivotValueColumn:  pivotValueColumn,
+		Unpivot:           q.Unpivot,
+		Columns:           columns,
+		Rename:            q.Rename,
+		FieldFilter:       fieldFilter,
+		Interval:          q.Interval.Duration,
+		Schedule:          sched,
+		CacheTTL:          q.CacheTTL.Duration,
+		Jitter:            q.Jitter.Duration,
+		Timeout:           timeout,
+		MaxRows:           q.MaxRows,
+		MaxFieldLength:    maxFieldLength,
+		Retries:           q.Retries,
+		RetryBackoff:      q.RetryBackoff.Duration,
+		Args:              args,
+		ExecProcedure:     q.ExecProcedures,
+		Outputs:           outputs,
+		Template:          tmpl,
+		Tags:              q.Tags,
+		MinVersion:        minVersion,
+		MaxVersion:        maxVersion,
+		EngineEditions:    q.EngineEditions,
+		EachDatabase:      q.RunInEachDatabase,
+		DatabaseFilter:    databaseFilter,
+		IncludeSystemDbs:  q.IncludeSystemDatabases,
+		DependsOn:         q.DependsOn,
+		WatermarkColumn:   q.WatermarkColumn,
+		ExecutionGroup:    q.ExecutionGroup,
+		ConcurrencyClass:  q.ConcurrencyClass,
+		Replicas:          replicas,
+	}
+	return nil
+}
 
-	// Set a flag so we know that queries have already been initialized
-	s.isInitialized = true
+// checkDependencies verifies that there are no dependency cycles between the
+// queries and warns about dependencies on unknown queries
+func (s *SQLServerExtended) checkDependencies() error {
+	for name, query := range s.queries {
+		seen := map[string]bool{name: true}
+		for dep := query.DependsOn; dep != ""; dep = s.queries[dep].DependsOn {
+			if _, ok := s.queries[dep]; !ok {
+				if s.Log != nil {
+					s.Log.Warnf("Query %q depends on unknown or excluded query %q and will not run", name, dep)
+				}
+				break
+			}
+			if seen[dep] {
+				return fmt.Errorf("query %q is part of a dependency cycle", name)
+			}
+			seen[dep] = true
+		}
+	}
+	return nil
+}
+
+// queryPrefix builds the SET statements executed ahead of the query script
+func (s *SQLServerExtended) queryPrefix(q QueryConfig) (string, error) {
+	if s.DisableQueryPrefix || q.DisableQueryPrefix {
+		return "", nil
+	}
+
+	level := s.IsolationLevel
+	if q.IsolationLevel != "" {
+		level = q.IsolationLevel
+	}
+	if level == "" {
+		level = "read uncommitted"
+	}
+	isolation, ok := isolationLevels[strings.ToLower(level)]
+	if !ok {
+		return "", fmt.Errorf("unknown isolation level %q", level)
+	}
+
+	priority := s.DeadlockPriority
+	if q.DeadlockPriority != "" {
+		priority = q.DeadlockPriority
+	}
+	if priority == "" {
+		priority = "-10"
+	}
+
+	var prefix strings.Builder
+	switch strings.ToLower(priority) {
+	case "none":
+	case "low", "normal", "high":
+		fmt.Fprintf(&prefix, "SET DEADLOCK_PRIORITY %s;\n", strings.ToUpper(priority))
+	default:
+		n, err := strconv.Atoi(priority)
+		if err != nil || n < -10 || n > 10 {
+			return "", fmt.Errorf("invalid deadlock priority %q", priority)
+		}
+		fmt.Fprintf(&prefix, "SET DEADLOCK_PRIORITY %d;\n", n)
+	}
+	prefix.WriteString("SET NOCOUNT ON;\n")
+	fmt.Fprintf(&prefix, "SET TRANSACTION ISOLATION LEVEL %s;\n", isolation)
+
+	return prefix.String(), nil
+}
+
+// isExecStatement reports whether the script is a stored procedure call
+func isExecStatement(script string) bool {
+	fields := strings.Fields(script)
+	if len(fields) < 2 {
+		return false
+	}
+	keyword := strings.ToUpper(fields[0])
+	return keyword == "EXEC" || keyword == "EXECUTE"
+}
+
+// namedArgs converts the configured parameters into named arguments for the
+// driver, sorted by name to keep the parameter list stable. Lists are passed
+// as table-valued parameters of the table type given for the parameter.
+func namedArgs(params map[string]interface{}, tableTypes map[string]string) ([]interface{}, error) {
+	types := make(map[string]string, len(tableTypes))
+	for name, typeName := range tableTypes {
+		name = strings.TrimPrefix(name, "@")
+		if _, ok := params[name]; !ok {
+			if _, ok := params["@"+name]; !ok {
+				return nil, fmt.Errorf("table type of unknown parameter %q", name)
+			}
+		}
+		types[name] = typeName
+	}
+
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	args := make([]interface{}, 0, len(params))
+	for _, name := range names {
+		value := params[name]
+		name = strings.TrimPrefix(name, "@")
+		switch v := value.(type) {
+		case string, int64, float64, bool:
+		case []interface{}:
+			tvp, err := tableParam(types[name], v)
+			if err != nil {
+				return nil, fmt.Errorf("parameter %q: %v", name, err)
+			}
+			value = tvp
+		default:
+			return nil, fmt.Errorf("unsupported type %T of parameter %q", value, name)
+		}
+		args = append(args, sql.Named(name, value))
+	}
+	return args, nil
+}
+
+// variableRe matches the names of declared SQL variables
+var variableRe = regexp.MustCompile(`^@[A-Za-z_][A-Za-z0-9_]*$`)
+
+// declareStatements returns a DECLARE statement for every variable, typed
+// after the value, in the order of the names
+func declareStatements(vars map[string]string) (string, error) {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		if !variableRe.MatchString(name) {
+			return "", fmt.Errorf("invalid variable name %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf strings.Builder
+	for _, name := range names {
+		value := vars[name]
+		if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+			fmt.Fprintf(&buf, "DECLARE %s bigint = %s;\n", name, value)
+		} else if _, err := strconv.ParseFloat(value, 64); err == nil && !strings.ContainsAny(value, "xXpPnN") {
+			fmt.Fprintf(&buf, "DECLARE %s float = %s;\n", name, value)
+		} else {
+			fmt.Fprintf(&buf, "DECLARE %s nvarchar(4000) = N'%s';\n", name, strings.Replace(value, "'", "''", -1))
+		}
+	}
+	return buf.String(), nil
+}
+
+// envVarRe matches ${VAR} placeholders, the bare $VAR form is not supported
+// as it clashes with T-SQL syntax such as $action or $PARTITION
+var envVarRe = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// expandEnv replaces ${VAR} placeholders with the value of the environment
+// variable, placeholders of unset variables are left untouched
+func expandEnv(script string) string {
+	return envVarRe.ReplaceAllStringFunc(script, func(placeholder string) string {
+		if value, ok := os.LookupEnv(envVarRe.FindStringSubmatch(placeholder)[1]); ok {
+			return value
+		}
+		return placeholder
+	})
 }
 
 // Gather collect data from SQL Server
 func (s *SQLServerExtended) Gather(acc telegraf.Accumulator) error {
-	if !s.isInitialized {
-		initQueries(s)
+	acc = &redactingAccumulator{Accumulator: acc}
+	acc.AddError(s.refreshQueryFiles())
+
+	var wg sync.WaitGroup
+
+	now := time.Now()
+	var queries, cached []Query
+	for _, query := range s.queries {
+		query.LastRun = s.lastRun[query.Name]
+		if s.isDue(query, now) {
+			queries = append(queries, query)
+		} else if query.CacheTTL > 0 {
+			cached = append(cached, query)
+		}
 	}
 
-	if len(s.Servers) == 0 {
-		s.Servers = append(s.Servers, defaultServer)
+	if s.serversFile != nil {
+		acc.AddError(s.serversFile.refresh())
 	}
+	servers, serverTags := s.gatherServers()
 
-	var wg sync.WaitGroup
+	for _, serv := range servers {
+		wg.Add(1)
+		go func(serv string) {
+			defer wg.Done()
+			serverAcc := acc
+			if tags := serverTags[serv]; len(tags) > 0 {
+				serverAcc = &taggingAccumulator{Accumulator: acc, tags: tags}
+			}
+			s.own(serv, serv)
+			if s.DiscoverReplicas && !s.connect(s.ctx, serv, serverAcc) {
+				return
+			}
+			for _, r := range s.replicas(s.ctx, serv, serverAcc) {
+				s.own(serv, r.server, r.partner)
+				wg.Add(1)
+				go func(r replica) {
+					defer wg.Done()
+					s.gatherReplica(s.ctx, r, queries, cached, now, serverAcc)
+				}(r)
+			}
+		}(serv)
+	}
+
+	wg.Wait()
+	s.releaseServers(servers)
+
+	if s.StateFile != "" {
+		acc.AddError(s.state.save(s.StateFile))
+	}
+	return nil
+}
+
+// replayCached re-emits the cached results of the queries for the server
+func (s *SQLServerExtended) replayCached(server string, queries []Query, now time.Time, acc telegraf.Accumulator) {
+	for _, query := range queries {
+		if result := s.cache.get(server, query.Name, query.CacheTTL, now); result != nil {
+			result.replay(acc, now)
+		}
+	}
+}
+
+// gatherQueries runs the queries applicable to the server in parallel
+func (s *SQLServerExtended) gatherQueries(ctx context.Context, server string, queries []Query, acc telegraf.Accumulator) {
+	var info *serverInfo
+	for _, query := range queries {
+		if query.needsServerInfo() {
+			i, err := s.serverInfo(ctx, server)
+			if err != nil {
+				acc.AddError(err)
+			} else {
+				info = &i
+			}
+			break
+		}
+	}
+
+	pending := make(map[string]Query)
+	for _, query := range queries {
+		if query.needsServerInfo() {
+			if info == nil {
+				continue
+			}
+			if !query.supports(*info) {
+				s.Log.Debugf("Skipping query %q, not supported by the server", query.Name)
+				continue
+			}
+		}
+		pending[query.Name] = query
+	}
+
+	slots := make(map[string]chan struct{}, len(s.ConcurrencyClasses))
+	for class, limit := range s.ConcurrencyClasses {
+		slots[class] = make(chan struct{}, limit)
+	}
+	var serverSlots chan struct{}
+	if s.MaxConcurrentQueriesPerServer > 0 {
+		serverSlots = make(chan struct{}, s.MaxConcurrentQueriesPerServer)
+	}
+
+	// queries depending on another one run after it in a later round and
+	// only if it returned rows
+	var mu sync.Mutex
+	rowCounts := make(map[string]int)
+	for len(pending) > 0 {
+		var ready []Query
+		for name, query := range pending {
+			if query.DependsOn != "" {
+				if _, ok := pending[query.DependsOn]; ok {
+					continue
+				}
+				if rowCounts[query.DependsOn] == 0 {
+					s.Log.Debugf("Skipping query %q, query %q returned no rows", query.Name, query.DependsOn)
+					delete(pending, name)
+					continue
+				}
+			}
+			ready = append(ready, query)
+		}
+		if len(ready) == 0 {
+			break
+		}
 
-	for _, serv := range s.Servers {
-		for _, query := range s.queries {
+		var wg sync.WaitGroup
+		for _, batch := range executionBatches(ready) {
+			for _, query := range batch {
+				delete(pending, query.Name)
+			}
 			wg.Add(1)
-			go func(serv string, query Query) {
+			go func(batch []Query) {
 				defer wg.Done()
-				acc.AddError(s.gatherServer(serv, query, acc))
-			}(serv, query)
+				for _, query := range batch {
+					if query.Jitter > 0 && !sleep(ctx, internal.RandomDuration(query.Jitter)) {
+						return
+					}
+					slot := slots[query.ConcurrencyClass]
+					if slot != nil {
+						slot <- struct{}{}
+					}
+					if serverSlots != nil {
+						serverSlots <- struct{}{}
+					}
+					count, err := s.gatherCached(ctx, server, query, acc)
+					if serverSlots != nil {
+						<-serverSlots
+					}
+					if slot != nil {
+						<-slot
+					}
+					acc.AddError(err)
+
+					mu.Lock()
+					rowCounts[query.Name] = count
+					mu.Unlock()
+				}
+			}(batch)
 		}
+		wg.Wait()
 	}
+}
 
-	wg.Wait()
-	return nil
+// executionBatches splits the queries into batches running in parallel, the
+// queries of an execution group form a single batch ordered by name
+func executionBatches(queries []Query) [][]Query {
+	sort.Slice(queries, func(i, j int) bool { return queries[i].Name < queries[j].Name })
+
+	var batches [][]Query
+	groups := make(map[string]int)
+	for _, query := range queries {
+		if query.ExecutionGroup == "" {
+			batches = append(batches, []Query{query})
+			continue
+		}
+		if i, ok := groups[query.ExecutionGroup]; ok {
+			batches[i] = append(batches[i], query)
+			continue
+		}
+		groups[query.ExecutionGroup] = len(batches)
+		batches = append(batches, []Query{query})
+	}
+	return batches
+}
+
+// gatherCached runs the query on the server and caches its metrics if the
+// query has a cache_ttl
+func (s *SQLServerExtended) gatherCached(ctx context.Context, server string, query Query, acc telegraf.Accumulator) (int, error) {
+	if query.CacheTTL <= 0 {
+		return s.gatherServer(ctx, server, query, acc)
+	}
+
+	start := time.Now()
+	recorder := &recordingAccumulator{Accumulator: acc}
+	count, err := s.gatherServer(ctx, server, query, recorder)
+	if err == nil {
+		s.cache.store(server, query.Name, &cachedResult{created: start, metrics: recorder.metrics})
+	}
+	return count, err
 }
 
-func (s *SQLServerExtended) gatherServer(server string, query Query, acc telegraf.Accumulator) error {
-	// deferred opening
-	conn, err := sql.Open("mssql", server)
+// serverInfo connects to the server and detects its properties
+func (s *SQLServerExtended) serverInfo(ctx context.Context, server string) (serverInfo, error) {
+	conn, err := s.pools.get(server)
 	if err != nil {
-		return err
+		return serverInfo{}, err
+	}
+
+	if s.QueryTimeout.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.QueryTimeout.Duration)
+		defer cancel()
+	}
+	return detectServerInfo(ctx, conn)
+}
+
+// needsServerInfo reports whether the query is restricted to some servers
+func (q *Query) needsServerInfo() bool {
+	return q.MinVersion != nil || q.MaxVersion != nil || len(q.EngineEditions) > 0
+}
+
+// supports reports whether the query can be executed on the server
+func (q *Query) supports(info serverInfo) bool {
+	if q.MinVersion != nil && info.Version.compare(q.MinVersion) < 0 {
+		return false
+	}
+	if q.MaxVersion != nil && info.Version.compare(q.MaxVersion) > 0 {
+		return false
+	}
+	if len(q.EngineEditions) > 0 {
+		for _, edition := range q.EngineEditions {
+			if edition == info.EngineEdition {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// isDue reports whether the query has to run in the gather cycle started at
+// now and records the run if so
+func (s *SQLServerExtended) isDue(query Query, now time.Time) bool {
+	if query.Schedule != nil {
+		next, ok := s.nextRun[query.Name]
+		if !ok {
+			s.nextRun[query.Name] = query.Schedule.next(now)
+			return false
+		}
+		if now.Add(intervalGrace).Before(next) {
+			return false
+		}
+		// a run started slightly ahead of the scheduled time must not
+		// match the same time again
+		if now.After(next) {
+			next = now
+		}
+		s.nextRun[query.Name] = query.Schedule.next(next)
+	} else if query.Interval > 0 {
+		if last, ok := s.lastRun[query.Name]; ok && now.Sub(last)+intervalGrace < query.Interval {
+			return false
+		}
+	}
+	s.lastRun[query.Name] = now
+	return true
+}
+
+// templateData holds the variables available in query script templates
+type templateData struct {
+	ServerName     string
+	Database       string
+	Interval       int64
+	Now            sqlTime
+	LastGatherTime sqlTime
+	Watermark      string
+}
+
+// templateData returns the template variables of the query for the server
+func (q *Query) templateData(server string, now time.Time) templateData {
+	params := parseConnectionString(server)
+	data := templateData{
+		ServerName: serverName(params),
+		Database:   databaseName(params),
+		Now:        sqlTime{now},
+	}
+	if q.Interval > 0 {
+		data.Interval = int64(q.Interval / time.Second)
+	} else if !q.LastRun.IsZero() {
+		data.Interval = int64(now.Sub(q.LastRun).Round(time.Second) / time.Second)
+	}
+	return data
+}
+
+// render resolves the script template of the query
+func (q *Query) render(data templateData) (string, error) {
+	if q.Template == nil {
+		return q.Script, nil
+	}
+
+	var buf strings.Builder
+	if err := q.Template.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// gatherServer runs the query on the server and returns the number of rows
+// it produced
+func (s *SQLServerExtended) gatherServer(ctx context.Context, server string, query Query, acc telegraf.Accumulator) (int, error) {
+	conn, err := s.pools.get(server)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	data := query.templateData(server, now)
+	data.LastGatherTime = sqlTime{s.state.lastGather(server, query.Name)}
+	if !query.EachDatabase {
+		count, err := s.executeQuery(ctx, conn, server, query, data, "", acc)
+		if err == nil {
+			s.state.setLastGather(server, query.Name, now)
+		}
+		return count, err
+	}
+
+	databases, err := listDatabases(ctx, conn, query.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("query %q: %v", query.Name, err)
+	}
+	var total int
+	failed := false
+	for _, database := range databases {
+		if !query.runsIn(database) {
+			continue
+		}
+
+		q := query
+		q.Tags = make(map[string]string, len(query.Tags)+1)
+		for k, v := range query.Tags {
+			q.Tags[k] = v
+		}
+		q.Tags["database_name"] = database
+
+		data.Database = database
+		count, err := s.executeQuery(ctx, conn, server, q, data, database, acc)
+		acc.AddError(err)
+		failed = failed || err != nil
+		total += count
+	}
+	if !failed {
+		s.state.setLastGather(server, query.Name, now)
+	}
+	return total, nil
+}
+
+// runsIn reports whether the query has to be executed in the database when
+// iterating over the databases of the server
+func (q *Query) runsIn(database string) bool {
+	if !q.IncludeSystemDbs && systemDatabases[database] {
+		return false
+	}
+	return q.DatabaseFilter == nil || q.DatabaseFilter.Match(database)
+}
+
+// executeQuery runs the query, in the context of the given database if any,
+// adds the results to the accumulator and returns the number of rows read
+func (s *SQLServerExtended) executeQuery(ctx context.Context, conn *sql.DB, server string, query Query, data templateData, database string, acc telegraf.Accumulator) (int, error) {
+	name := query.Name
+	if database != "" {
+		name = query.Name + "@" + database
+	}
+
+	if query.Pivot || query.RateFields != nil {
+		query.counters = s.counters.get(server, name)
+	}
+	if query.WatermarkColumn != "" {
+		query.watermark = &watermarkTracker{}
+		data.Watermark = s.state.watermark(server, name)
+	}
+	script, err := query.render(data)
+	if err != nil {
+		return 0, fmt.Errorf("query %q: rendering script failed: %v", name, err)
+	}
+	if database != "" {
+		script = "USE " + quoteName(database) + ";\n" + script
+	}
+
+	// failed attempts are only retried if they did not add any metrics yet
+	for attempt := 0; ; attempt++ {
+		count, err := s.runScript(ctx, conn, query, script, name, acc)
+		if err == nil && query.watermark != nil {
+			if watermark := query.watermark.literal(); watermark != "" {
+				s.state.setWatermark(server, name, watermark)
+			}
+		}
+		if err == nil || count > 0 || attempt >= query.Retries || !isTransient(err) {
+			return count, err
+		}
+		backoff := query.RetryBackoff << uint(attempt)
+		s.Log.Debugf("Query %q failed, retrying in %s: %v", name, backoff, err)
+		if !sleep(ctx, backoff) {
+			return count, err
+		}
+	}
+}
+
+// runScript executes the rendered script of the query once and adds the
+// results to the accumulator
+func (s *SQLServerExtended) runScript(ctx context.Context, conn *sql.DB, query Query, script, name string, acc telegraf.Accumulator) (int, error) {
+	if query.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, query.Timeout)
+		defer cancel()
+	}
+
+	// the driver fills in the return value of the procedure once all of
+	// its result sets have been read
+	var returnStatus mssql.ReturnStatus
+	var outputs []interface{}
+	args := query.Args
+	if query.ExecProcedure {
+		var outArgs []interface{}
+		outArgs, outputs = outputArgs(query.Outputs)
+		args = append(append(append([]interface{}{}, query.Args...), outArgs...), &returnStatus)
 	}
-	defer conn.Close()
 
 	// execute query
-	rows, err := conn.Query(query.Script)
+	rows, err := conn.QueryContext(ctx, script, args...)
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("query %q failed: %w", name, err)
 	}
 	defer rows.Close()
 
-	// grab the column information from the result
-	query.OrderedColumns, err = rows.Columns()
+	count, err := s.accResults(query, acc, rows)
 	if err != nil {
-		return err
+		return count, fmt.Errorf("query %q: %w", name, err)
+	}
+	if err = rows.Close(); err != nil {
+		return count, fmt.Errorf("query %q: %w", name, err)
 	}
 
-	for rows.Next() {
-		err = s.accRow(query, acc, rows)
+	if returnStatus != 0 {
+		return count, fmt.Errorf("query %q: procedure returned %d", name, returnStatus)
+	}
+	if len(outputs) > 0 {
+		accOutputs(query, acc, outputs)
+	}
+	return count, nil
+}
+
+// sleep waits for the duration and reports whether the context was not
+// cancelled in the meantime
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// transientErrors are the SQL Server error numbers worth retrying
+var transientErrors = map[int32]bool{
+	1205: true, // chosen as deadlock victim
+	1222: true, // lock request time out period exceeded
+}
+
+// isTransient reports whether the query failed because of a deadlock or a
+// timeout and may succeed when retried
+func isTransient(err error) bool {
+	var sqlErr mssql.Error
+	if errors.As(err, &sqlErr) {
+		return transientErrors[sqlErr.Number]
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// accResults adds the rows of all result sets to the accumulator and returns
+// the number of rows read
+func (s *SQLServerExtended) accResults(query Query, acc telegraf.Accumulator, rows resultSet) (int, error) {
+	var err error
+	var count int
+	for {
+		// grab the column information from the result
+		query.OrderedColumns, err = rows.Columns()
 		if err != nil {
-			return err
+			return count, err
+		}
+		// the columns are normalized first, so that all options refer to
+		// the normalized names
+		if s.NormalizeNames {
+			for i, column := range query.OrderedColumns {
+				query.OrderedColumns[i] = normalizeName(column)
+			}
+		}
+		query.ColumnTypes, err = columnTypes(rows)
+		if err != nil {
+			return count, err
+		}
+
+		rowAcc := acc
+		if query.RateFields != nil {
+			rowAcc = &rateAccumulator{Accumulator: rowAcc, fields: query.RateFields, series: query.counters}
+		}
+		// the rows of a pivoted result set are merged into metrics by
+		// measurement and tags
+		var pivot *pivotAccumulator
+		query.perfCounters = nil
+		if query.Pivot {
+			pivot = newPivotAccumulator(rowAcc)
+			rowAcc = pivot
+			query.now = time.Now()
+			for _, column := range query.OrderedColumns {
+				if column == counterTypeColumn {
+					query.perfCounters = &perfCounterBatch{}
+				}
+			}
+		}
+		// unpivoted rows are filtered by the names of their fields
+		if query.FieldFilter != nil && !query.Unpivot {
+			rowAcc = &fieldFilterAccumulator{Accumulator: rowAcc, filter: query.FieldFilter}
+		}
+		if query.MaxFieldLength > 0 {
+			rowAcc = &truncatingAccumulator{Accumulator: rowAcc, length: query.MaxFieldLength}
+		}
+		flush := func() {
+			if query.perfCounters != nil {
+				query.perfCounters.emit(rowAcc, query.counters)
+			}
+			if pivot != nil {
+				pivot.flush()
+			}
+		}
+
+		for rows.Next() {
+			if query.MaxRows > 0 && count >= query.MaxRows {
+				s.Log.Warnf("Query %q returned more than %d rows, ignoring the remaining rows", query.Name, query.MaxRows)
+				flush()
+				return count, nil
+			}
+			err = s.accRow(query, rowAcc, rows)
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+		flush()
+
+		// scripts and procedures may return several result sets, each
+		// with its own columns
+		if !rows.NextResultSet() {
+			break
 		}
 	}
-	return rows.Err()
+	return count, rows.Err()
 }
 
 func (s *SQLServerExtended) accRow(query Query, acc telegraf.Accumulator, row scanner) error {
@@ -151,36 +2070,177 @@ func (s *SQLServerExtended) accRow(query Query, acc telegraf.Accumulator, row sc
 		return err
 	}
 
+	if query.watermark != nil {
+		for i, column := range query.OrderedColumns {
+			if column == query.WatermarkColumn {
+				query.watermark.observe(*columnMap[column], query.columnType(i))
+			}
+		}
+	}
+
 	// measurement: identified by the header
-	// tags: all other fields with column name != 'field_%'
+	// tags: the tag columns, see columnRoles
 	tags := map[string]string{}
+	for k, v := range query.Tags {
+		tags[k] = v
+	}
+	measurementColumn := query.MeasurementColumn
+	if measurementColumn == "" {
+		measurementColumn = defaultMeasurementColumn
+	}
+	timestamp := query.now
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	if val, ok := columnMap[query.TimeColumn]; ok && query.TimeColumn != "" {
+		if timestamp, err = query.rowTime(*val, timestamp); err != nil {
+			return err
+		}
+	}
+	for i, column := range query.OrderedColumns {
+		if column != measurementColumn && !query.isJSONColumn(column) && query.xpathColumn(column) == nil {
+			val := columnMap[column]
+			if *val, err = query.convert(column, *val, query.columnType(i)); err != nil {
+				return fmt.Errorf("converting column %q failed: %v", column, err)
+			}
+		}
+	}
+
 	var measurement string
 	for header, val := range columnMap {
-		if str, ok := (*val).(string); ok {
-			if header == "measurement" {
+		if header == query.TimeColumn {
+			continue
+		}
+		if header == measurementColumn {
+			if str, ok := (*val).(string); ok {
 				measurement = str
-			} else if !strings.HasPrefix(header, "field_") {
-				tags[header] = str
 			}
+			continue
+		}
+		if query.isJSONColumn(header) || query.xpathColumn(header) != nil {
+			continue
+		}
+		if query.Pivot && (header == query.PivotNameColumn || header == query.PivotValueColumn || header == counterTypeColumn) {
+			continue
+		}
+		if str, ok := tagValue(*val); ok && query.Columns.isTag(header, *val) {
+			s.addTag(tags, query.tagName(header), str)
 		}
 	}
-	
+	if !query.legacy {
+		tags["query_name"] = query.Name
+	}
+
+	if measurement == "" {
+		measurement = query.Measurement
+	}
 	if measurement == "" {
 		measurement = "sqlserver_extended"
 	}
 
 	if query.ResultByRow {
+		value, ok := columnMap["value"]
+		if !ok {
+			return fmt.Errorf("value column of result_by_row query %q is missing", query.Name)
+		}
+		if *value == nil {
+			return nil
+		}
 		acc.AddFields(measurement,
-			map[string]interface{}{"value": *columnMap["value"]},
-			tags, time.Now())
+			map[string]interface{}{"value": *value},
+			tags, timestamp)
+	} else if query.Pivot {
+		name, ok := columnMap[query.PivotNameColumn]
+		if !ok {
+			return fmt.Errorf("pivot name column %q is missing", query.PivotNameColumn)
+		}
+		value, ok := columnMap[query.PivotValueColumn]
+		if !ok {
+			return fmt.Errorf("pivot value column %q is missing", query.PivotValueColumn)
+		}
+		field, _ := tagValue(*name)
+		// names of fixed length columns are padded with spaces
+		field = strings.TrimSpace(field)
+		if field == "" || *value == nil {
+			return nil
+		}
+		counter := field
+		if s.NormalizeNames {
+			field = normalizeName(field)
+		}
+		if name, ok := query.Rename[field]; ok {
+			field = name
+		}
+		if query.perfCounters != nil {
+			// rows without a counter type can not be computed
+			if *columnMap[counterTypeColumn] == nil {
+				return nil
+			}
+			counterType, err := toInt(*columnMap[counterTypeColumn])
+			if err != nil {
+				return fmt.Errorf("counter type of %q: %v", counter, err)
+			}
+			query.perfCounters.add(perfCounter{
+				measurement: measurement,
+				tags:        tags,
+				name:        counter,
+				field:       field,
+				value:       *value,
+				counterType: counterType.(int64),
+				time:        timestamp,
+			})
+			return nil
+		}
+		acc.AddFields(measurement, map[string]interface{}{field: *value}, tags, timestamp)
 	} else {
 		// values
 		for header, val := range columnMap {
-		    if strings.HasPrefix(header, "field_"){
-				fields[strings.Split(header, "_")[1]] = (*val)
+			if *val == nil {
+				continue
+			}
+			if query.isJSONColumn(header) {
+				name := query.fieldName(header)
+				expanded := fields
+				if s.NormalizeNames {
+					expanded = make(map[string]interface{})
+				}
+				if err := expandJSON(name, *val, expanded); err != nil {
+					return fmt.Errorf("expanding column %q failed: %v", header, err)
+				}
+				if s.NormalizeNames {
+					normalizePaths(name, expanded, fields)
+				}
+				continue
+			}
+			if xpath := query.xpathColumn(header); xpath != nil {
+				extracted := make(map[string]string)
+				if err := xpath.extract(*val, fields, extracted); err != nil {
+					return fmt.Errorf("extracting from column %q failed: %v", header, err)
+				}
+				for key, value := range extracted {
+					s.addTag(tags, key, value)
+				}
+				continue
+			}
+			if header != measurementColumn && header != query.TimeColumn && query.Columns.isField(header, *val) {
+				fields[query.fieldName(header)] = (*val)
 			}
 		}
-		acc.AddFields(measurement, fields, tags, time.Now())
+		if query.Unpivot {
+			for name, value := range fields {
+				if query.FieldFilter != nil && !query.FieldFilter.Match(name) {
+					continue
+				}
+				fieldTags := make(map[string]string, len(tags)+1)
+				for k, v := range tags {
+					fieldTags[k] = v
+				}
+				fieldTags["name"] = name
+				acc.AddFields(measurement, map[string]interface{}{"value": value}, fieldTags, timestamp)
+			}
+			return nil
+		}
+		acc.AddFields(measurement, fields, tags, timestamp)
 	}
 	return nil
 }
@@ -191,7 +2251,11 @@ func init() {
 	})
 }
 
-const sqlPrefix string = `SET DEADLOCK_PRIORITY -10;
-SET NOCOUNT ON;
-SET TRANSACTION ISOLATION LEVEL READ UNCOMMITTED;
-`
+// isolationLevels maps the isolation_level values to their T-SQL keywords
+var isolationLevels = map[string]string{
+	"read uncommitted": "READ UNCOMMITTED",
+	"read committed":   "READ COMMITTED",
+	"repeatable read":  "REPEATABLE READ",
+	"snapshot":         "SNAPSHOT",
+	"serializable":     "SERIALIZABLE",
+}
@@ -0,0 +1,600 @@
+package sqlserver_extended
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const sqlPrefix = `SET DEADLOCK_PRIORITY -10;
+SET NOCOUNT ON;
+SET TRANSACTION ISOLATION LEVEL READ UNCOMMITTED;
+`
+
+// mockRow implements the scanner interface over a single in-memory row
+type mockRow []interface{}
+
+func (r mockRow) Scan(dest ...interface{}) error {
+	for i := range dest {
+		*(dest[i].(*interface{})) = r[i]
+	}
+	return nil
+}
+
+// mockResults implements the resultSet interface over in-memory result sets
+type mockResults struct {
+	sets    []mockResultSet
+	set     int
+	row     int
+	started bool
+}
+
+type mockResultSet struct {
+	columns []string
+	rows    []mockRow
+}
+
+func (r *mockResults) Columns() ([]string, error) {
+	return r.sets[r.set].columns, nil
+}
+
+func (r *mockResults) Next() bool {
+	if r.started {
+		r.row++
+	}
+	r.started = true
+	return r.row < len(r.sets[r.set].rows)
+}
+
+func (r *mockResults) Scan(dest ...interface{}) error {
+	return r.sets[r.set].rows[r.row].Scan(dest...)
+}
+
+func (r *mockResults) NextResultSet() bool {
+	if r.set+1 >= len(r.sets) {
+		return false
+	}
+	r.set++
+	r.row = 0
+	r.started = false
+	return true
+}
+
+func (r *mockResults) Err() error {
+	return nil
+}
+
+func TestSqlServerExtended_InitQueries(t *testing.T) {
+	s := &SQLServerExtended{
+		Query: []QueryConfig{
+			{Name: "waits", Script: "SELECT 1"},
+			{Name: "counters", Script: "SELECT 2"},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	require.Len(t, s.queries, 2)
+	assert.Equal(t, "waits", s.queries["waits"].Name)
+	assert.Equal(t, sqlPrefix+"SELECT 1", s.queries["waits"].Script)
+}
+
+func TestSqlServerExtended_ResultByRowOverride(t *testing.T) {
+	enabled, disabled := true, false
+	s := &SQLServerExtended{
+		ResultByRow: true,
+		Query: []QueryConfig{
+			{Name: "default", Script: "SELECT 1"},
+			{Name: "wide", Script: "SELECT 2", ResultByRow: &disabled},
+			{Name: "rows", Script: "SELECT 3", ResultByRow: &enabled},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	assert.True(t, s.queries["default"].ResultByRow)
+	assert.False(t, s.queries["wide"].ResultByRow)
+	assert.True(t, s.queries["rows"].ResultByRow)
+}
+
+func TestSqlServerExtended_InitDeprecatedQueries(t *testing.T) {
+	s := &SQLServerExtended{
+		Queries: []string{"SELECT 1", "SELECT 2"},
+		Log:     testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	assert.Contains(t, s.queries, "custom_0")
+	assert.Contains(t, s.queries, "custom_1")
+}
+
+func TestSqlServerExtended_InitWithoutLogger(t *testing.T) {
+	s := &SQLServerExtended{
+		Queries: []string{"SELECT 1"},
+		Query: []QueryConfig{
+			{Name: "orphan", Script: "SELECT 2", DependsOn: "excluded"},
+		},
+	}
+	require.NoError(t, s.Init())
+	defer s.Stop()
+	assert.Contains(t, s.queries, "custom_0")
+}
+
+func TestSqlServerExtended_InitInvalidQueries(t *testing.T) {
+	cases := []struct {
+		name  string
+		query []QueryConfig
+	}{
+		{"missing name", []QueryConfig{{Script: "SELECT 1"}}},
+		{"missing script", []QueryConfig{{Name: "waits"}}},
+		{"duplicate name", []QueryConfig{{Name: "waits", Script: "SELECT 1"}, {Name: "waits", Script: "SELECT 2"}}},
+		{"invalid timezone", []QueryConfig{{Name: "waits", Script: "SELECT 1", Timezone: "Mars/Olympus"}}},
+		{"invalid datetime format", []QueryConfig{{Name: "waits", Script: "SELECT 1", DatetimeFormats: map[string]string{"start": "iso"}}}},
+		{"two time columns", []QueryConfig{{Name: "waits", Script: "SELECT 1", TimeColumn: "end", DatetimeFormats: map[string]string{"start": "time"}}}},
+		{"invalid binary encoding", []QueryConfig{{Name: "waits", Script: "SELECT 1", BinaryEncodings: map[string]string{"plan_handle": "base32"}}}},
+		{"invalid field name mode", []QueryConfig{{Name: "waits", Script: "SELECT 1", FieldNameMode: "split"}}},
+		{"invalid convert type", []QueryConfig{{Name: "waits", Script: "SELECT 1", Convert: map[string]string{"field_cpu": "double"}}}},
+		{"empty rename", []QueryConfig{{Name: "waits", Script: "SELECT 1", Rename: map[string]string{"field_wait": ""}}}},
+		{"invalid fieldpass", []QueryConfig{{Name: "waits", Script: "SELECT 1", FieldPass: []string{"wait["}}}},
+		{"negative max field length", []QueryConfig{{Name: "waits", Script: "SELECT 1", MaxFieldLength: -1}}},
+		{"invalid null handling", []QueryConfig{{Name: "waits", Script: "SELECT 1", NullHandling: "drop"}}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &SQLServerExtended{Query: tt.query, Log: testutil.Logger{}}
+			require.Error(t, s.Init())
+		})
+	}
+}
+
+func TestSqlServerExtended_AccRow(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	query := Query{
+		Name:           "waits",
+		OrderedColumns: []string{"measurement", "wait_type", "field_wait", "field_tasks"},
+	}
+	require.NoError(t, s.accRow(query, &acc, mockRow{"waits", "LCK_M_S", int64(10), int64(2)}))
+
+	acc.AssertContainsTaggedFields(t, "waits",
+		map[string]interface{}{"wait": int64(10), "tasks": int64(2)},
+		map[string]string{"wait_type": "LCK_M_S", "query_name": "waits"})
+}
+
+func TestSqlServerExtended_AccRowByRow(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	query := Query{
+		Name:           "counters",
+		ResultByRow:    true,
+		OrderedColumns: []string{"counter", "value"},
+	}
+	require.NoError(t, s.accRow(query, &acc, mockRow{"Page life expectancy", int64(300)}))
+
+	acc.AssertContainsTaggedFields(t, "sqlserver_extended",
+		map[string]interface{}{"value": int64(300)},
+		map[string]string{"counter": "Page life expectancy", "query_name": "counters"})
+}
+
+func TestSqlServerExtended_QueryInterval(t *testing.T) {
+	s := &SQLServerExtended{
+		Query: []QueryConfig{
+			{Name: "cheap", Script: "SELECT 1"},
+			{Name: "expensive", Script: "SELECT 2", Interval: internal.Duration{Duration: 10 * time.Minute}},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+
+	start := time.Now()
+	assert.True(t, s.isDue(s.queries["cheap"], start))
+	assert.True(t, s.isDue(s.queries["expensive"], start))
+
+	next := start.Add(10 * time.Second)
+	assert.True(t, s.isDue(s.queries["cheap"], next))
+	assert.False(t, s.isDue(s.queries["expensive"], next))
+
+	// ticks arriving slightly early must not skip a whole interval
+	next = start.Add(10*time.Minute - 100*time.Millisecond)
+	assert.True(t, s.isDue(s.queries["expensive"], next))
+}
+
+func TestSqlServerExtended_QueryParams(t *testing.T) {
+	s := &SQLServerExtended{
+		Query: []QueryConfig{
+			{
+				Name:   "top",
+				Script: "SELECT TOP (@top_n) name FROM sys.databases WHERE name = @db_name",
+				Params: map[string]interface{}{"top_n": int64(20), "db_name": "Sales"},
+			},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	assert.Equal(t,
+		[]interface{}{sql.Named("db_name", "Sales"), sql.Named("top_n", int64(20))},
+		s.queries["top"].Args)
+
+	s.Query[0].Params = map[string]interface{}{"list": []interface{}{"a", "b"}}
+	require.Error(t, s.Init())
+}
+
+func TestSqlServerExtended_ExecProcedures(t *testing.T) {
+	s := &SQLServerExtended{
+		Query: []QueryConfig{
+			{Name: "collect", Script: "EXEC dbo.telegraf_collect @set='waits'", ExecProcedures: true},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	assert.True(t, s.queries["collect"].ExecProcedure)
+
+	s.Query[0].Script = "SELECT 1"
+	require.Error(t, s.Init())
+}
+
+func TestSqlServerExtended_ScriptTemplate(t *testing.T) {
+	s := &SQLServerExtended{
+		Query: []QueryConfig{
+			{
+				Name:     "size",
+				Script:   "SELECT '{{.ServerName}}', DB_ID('{{.Database}}'), {{.Interval}}",
+				Interval: internal.Duration{Duration: 10 * time.Minute},
+			},
+			{Name: "broken", Script: "SELECT {{.Unknown}}"},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+
+	server := "Server=192.168.1.10;Port=1433;Database=Sales;User Id=telegraf;"
+	query := s.queries["size"]
+	script, err := query.render(query.templateData(server, time.Now()))
+	require.NoError(t, err)
+	assert.Equal(t, sqlPrefix+"SELECT '192.168.1.10', DB_ID('Sales'), 600", script)
+
+	query = s.queries["broken"]
+	_, err = query.render(query.templateData(server, time.Now()))
+	require.Error(t, err)
+}
+
+func TestSqlServerExtended_QueryTimeWindow(t *testing.T) {
+	s := &SQLServerExtended{
+		Query: []QueryConfig{
+			{
+				Name:               "jobs",
+				Script:             "SELECT * FROM msdb.dbo.sysjobhistory WHERE run_time > '{{.LastGatherTime}}' AND run_time <= '{{.Now}}'",
+				DisableQueryPrefix: true,
+			},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+
+	server := "Server=192.168.1.10;User Id=telegraf;"
+	last := time.Date(2020, 11, 17, 10, 0, 0, 0, time.Local)
+	now := last.Add(time.Minute)
+	s.state.setLastGather(server, "jobs", last)
+
+	query := s.queries["jobs"]
+	data := query.templateData(server, now)
+	data.LastGatherTime = sqlTime{s.state.lastGather(server, "jobs")}
+	script, err := query.render(data)
+	require.NoError(t, err)
+	assert.Equal(t, "SELECT * FROM msdb.dbo.sysjobhistory WHERE run_time > '2020-11-17T10:00:00.000' AND run_time <= '2020-11-17T10:01:00.000'", script)
+
+	// other servers start from the start of the plugin
+	assert.Equal(t, s.state.started, s.state.lastGather("Server=other", "jobs"))
+}
+
+func TestSqlServerExtended_QueryTimeout(t *testing.T) {
+	s := &SQLServerExtended{
+		QueryTimeout: internal.Duration{Duration: 10 * time.Second},
+		Query: []QueryConfig{
+			{Name: "default", Script: "SELECT 1"},
+			{Name: "custom", Script: "SELECT 2", Timeout: internal.Duration{Duration: 30 * time.Second}},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	assert.Equal(t, 10*time.Second, s.queries["default"].Timeout)
+	assert.Equal(t, 30*time.Second, s.queries["custom"].Timeout)
+}
+
+func TestSqlServerExtended_DisableQueryPrefix(t *testing.T) {
+	s := &SQLServerExtended{
+		Query: []QueryConfig{
+			{Name: "prefixed", Script: "SELECT 1"},
+			{Name: "plain", Script: "SELECT 2", DisableQueryPrefix: true},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	assert.Equal(t, sqlPrefix+"SELECT 1", s.queries["prefixed"].Script)
+	assert.Equal(t, "SELECT 2", s.queries["plain"].Script)
+
+	s.DisableQueryPrefix = true
+	require.NoError(t, s.Init())
+	assert.Equal(t, "SELECT 1", s.queries["prefixed"].Script)
+}
+
+func TestSqlServerExtended_IsolationLevel(t *testing.T) {
+	s := &SQLServerExtended{
+		IsolationLevel: "read committed",
+		Query: []QueryConfig{
+			{Name: "default", Script: "SELECT 1"},
+			{Name: "snapshot", Script: "SELECT 2", IsolationLevel: "Snapshot"},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	assert.Contains(t, s.queries["default"].Script, "SET TRANSACTION ISOLATION LEVEL READ COMMITTED;")
+	assert.Contains(t, s.queries["snapshot"].Script, "SET TRANSACTION ISOLATION LEVEL SNAPSHOT;")
+
+	s.IsolationLevel = "chaos"
+	require.Error(t, s.Init())
+}
+
+func TestSqlServerExtended_DeadlockPriority(t *testing.T) {
+	s := &SQLServerExtended{
+		DeadlockPriority: "normal",
+		Query: []QueryConfig{
+			{Name: "default", Script: "SELECT 1"},
+			{Name: "numeric", Script: "SELECT 2", DeadlockPriority: "5"},
+			{Name: "omitted", Script: "SELECT 3", DeadlockPriority: "none"},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	assert.Contains(t, s.queries["default"].Script, "SET DEADLOCK_PRIORITY NORMAL;")
+	assert.Contains(t, s.queries["numeric"].Script, "SET DEADLOCK_PRIORITY 5;")
+	assert.NotContains(t, s.queries["omitted"].Script, "DEADLOCK_PRIORITY")
+
+	s.DeadlockPriority = "11"
+	require.Error(t, s.Init())
+}
+
+func TestSqlServerExtended_LockTimeout(t *testing.T) {
+	short, never := 2000, -1
+	s := &SQLServerExtended{
+		Query: []QueryConfig{
+			{Name: "default", Script: "SELECT 1"},
+			{Name: "short", Script: "SELECT 2", LockTimeoutMs: &short},
+			{Name: "raw", Script: "SELECT 3", LockTimeoutMs: &never, DisableQueryPrefix: true},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	assert.NotContains(t, s.queries["default"].Script, "LOCK_TIMEOUT")
+	assert.Equal(t, sqlPrefix+"SET LOCK_TIMEOUT 2000;\nSELECT 2", s.queries["short"].Script)
+	assert.Equal(t, "SET LOCK_TIMEOUT -1;\nSELECT 3", s.queries["raw"].Script)
+
+	invalid := -2
+	s.Query = []QueryConfig{{Name: "invalid", Script: "SELECT 1", LockTimeoutMs: &invalid}}
+	require.Error(t, s.Init())
+}
+
+func TestSqlServerExtended_IsTransient(t *testing.T) {
+	assert.True(t, isTransient(fmt.Errorf("query %q failed: %w", "waits", mssql.Error{Number: 1205})))
+	assert.True(t, isTransient(fmt.Errorf("query %q: %w", "waits", context.DeadlineExceeded)))
+	assert.False(t, isTransient(fmt.Errorf("query %q failed: %w", "waits", mssql.Error{Number: 208})))
+	assert.False(t, isTransient(errors.New("procedure returned 1")))
+}
+
+func TestSqlServerExtended_QueryTags(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	query := Query{
+		Name:           "waits",
+		Tags:           map[string]string{"collector": "waits", "team": "dba"},
+		OrderedColumns: []string{"measurement", "wait_type", "field_wait"},
+	}
+	require.NoError(t, s.accRow(query, &acc, mockRow{"waits", "LCK_M_S", int64(10)}))
+
+	acc.AssertContainsTaggedFields(t, "waits",
+		map[string]interface{}{"wait": int64(10)},
+		map[string]string{"wait_type": "LCK_M_S", "query_name": "waits", "collector": "waits", "team": "dba"})
+}
+
+func TestSqlServerExtended_QueryFilter(t *testing.T) {
+	s := &SQLServerExtended{
+		IncludeQueries: []string{"ag_*", "waits"},
+		ExcludeQueries: []string{"ag_replicas"},
+		Query: []QueryConfig{
+			{Name: "waits", Script: "SELECT 1"},
+			{Name: "ag_health", Script: "SELECT 2"},
+			{Name: "ag_replicas", Script: "SELECT 3"},
+			{Name: "io", Script: "SELECT 4"},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	require.Len(t, s.queries, 2)
+	assert.Contains(t, s.queries, "waits")
+	assert.Contains(t, s.queries, "ag_health")
+}
+
+func TestSqlServerExtended_MultipleResultSets(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	rows := &mockResults{sets: []mockResultSet{
+		{
+			columns: []string{"measurement", "wait_type", "field_wait"},
+			rows: []mockRow{
+				{"waits", "LCK_M_S", int64(10)},
+				{"waits", "PAGEIOLATCH_SH", int64(20)},
+			},
+		},
+		{},
+		{
+			columns: []string{"measurement", "field_sessions"},
+			rows:    []mockRow{{"sessions", int64(42)}},
+		},
+	}}
+	count, err := s.accResults(Query{Name: "collect"}, &acc, rows)
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+
+	require.Equal(t, uint64(3), acc.NMetrics())
+	acc.AssertContainsTaggedFields(t, "waits",
+		map[string]interface{}{"wait": int64(20)},
+		map[string]string{"wait_type": "PAGEIOLATCH_SH", "query_name": "collect"})
+	acc.AssertContainsTaggedFields(t, "sessions",
+		map[string]interface{}{"sessions": int64(42)},
+		map[string]string{"query_name": "collect"})
+}
+
+func TestSqlServerExtended_MaxRows(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{Log: testutil.Logger{}}
+
+	rows := &mockResults{sets: []mockResultSet{
+		{
+			columns: []string{"session", "field_cpu"},
+			rows:    []mockRow{{"51", int64(10)}, {"52", int64(20)}},
+		},
+		{
+			columns: []string{"session", "field_cpu"},
+			rows:    []mockRow{{"53", int64(30)}, {"54", int64(40)}},
+		},
+	}}
+	count, err := s.accResults(Query{Name: "sessions", MaxRows: 3}, &acc, rows)
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+	require.Equal(t, uint64(3), acc.NMetrics())
+	acc.AssertContainsTaggedFields(t, "sqlserver_extended",
+		map[string]interface{}{"cpu": int64(30)},
+		map[string]string{"session": "53", "query_name": "sessions"})
+
+	s.Query = []QueryConfig{{Name: "sessions", Script: "SELECT 1", MaxRows: -1}}
+	require.Error(t, s.Init())
+}
+
+func TestSqlServerExtended_QueryDependencies(t *testing.T) {
+	s := &SQLServerExtended{
+		Query: []QueryConfig{
+			{Name: "blocking_check", Script: "SELECT 1"},
+			{Name: "blocking_chain", Script: "SELECT 2", DependsOn: "blocking_check"},
+			{Name: "orphan", Script: "SELECT 3", DependsOn: "excluded"},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	assert.Equal(t, "blocking_check", s.queries["blocking_chain"].DependsOn)
+
+	s.Query = []QueryConfig{
+		{Name: "a", Script: "SELECT 1", DependsOn: "b"},
+		{Name: "b", Script: "SELECT 2", DependsOn: "a"},
+	}
+	require.Error(t, s.Init())
+}
+
+func TestSqlServerExtended_ExecutionBatches(t *testing.T) {
+	batches := executionBatches([]Query{
+		{Name: "stage_load"},
+		{Name: "waits"},
+		{Name: "stage_clear", ExecutionGroup: "staging"},
+		{Name: "stage_collect", ExecutionGroup: "staging"},
+		{Name: "io"},
+	})
+
+	var names [][]string
+	for _, batch := range batches {
+		var batchNames []string
+		for _, query := range batch {
+			batchNames = append(batchNames, query.Name)
+		}
+		names = append(names, batchNames)
+	}
+	assert.Equal(t, [][]string{
+		{"io"},
+		{"stage_clear", "stage_collect"},
+		{"stage_load"},
+		{"waits"},
+	}, names)
+}
+
+func TestSqlServerExtended_Declare(t *testing.T) {
+	s := &SQLServerExtended{
+		Declare: map[string]string{"@TopN": "25", "@MinDurationMs": "500"},
+		Query: []QueryConfig{
+			{
+				Name:    "top",
+				Script:  "SELECT TOP (@TopN) 1",
+				Declare: map[string]string{"TopN": "10", "@Ratio": "0.5", "@Login": "O'Brien"},
+			},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	assert.Equal(t, sqlPrefix+
+		"DECLARE @Login nvarchar(4000) = N'O''Brien';\n"+
+		"DECLARE @MinDurationMs bigint = 500;\n"+
+		"DECLARE @Ratio float = 0.5;\n"+
+		"DECLARE @TopN bigint = 10;\n"+
+		"SELECT TOP (@TopN) 1", s.queries["top"].Script)
+
+	s.Declare = map[string]string{"@Top N": "25"}
+	require.Error(t, s.Init())
+}
+
+func TestSqlServerExtended_ConcurrencyClasses(t *testing.T) {
+	s := &SQLServerExtended{
+		ConcurrencyClasses: map[string]int{"heavy": 1},
+		Query: []QueryConfig{
+			{Name: "index_stats", Script: "SELECT 1", ConcurrencyClass: "heavy"},
+			{Name: "waits", Script: "SELECT 2"},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	assert.Equal(t, "heavy", s.queries["index_stats"].ConcurrencyClass)
+
+	s.Query[1].ConcurrencyClass = "light"
+	require.Error(t, s.Init())
+
+	s.Query[1].ConcurrencyClass = ""
+	s.ConcurrencyClasses["heavy"] = 0
+	require.Error(t, s.Init())
+}
+
+func TestSqlServerExtended_MaxConcurrentQueriesPerServer(t *testing.T) {
+	s := &SQLServerExtended{MaxConcurrentQueriesPerServer: 2, Log: testutil.Logger{}}
+	require.NoError(t, s.Init())
+
+	s.MaxConcurrentQueriesPerServer = -1
+	require.Error(t, s.Init())
+}
+
+func TestSqlServerExtended_Stop(t *testing.T) {
+	s := &SQLServerExtended{Log: testutil.Logger{}}
+	require.NoError(t, s.Init())
+	_, err := s.pools.get("Server=sql01;User Id=telegraf;")
+	require.NoError(t, err)
+
+	s.Stop()
+	assert.Error(t, s.ctx.Err())
+	assert.Empty(t, s.pools.pools)
+	assert.False(t, sleep(s.ctx, time.Hour))
+}
+
+func TestSqlServerExtended_ExpandEnv(t *testing.T) {
+	require.NoError(t, os.Setenv("SQLSERVER_EXTENDED_TOP_N", "25"))
+	defer os.Unsetenv("SQLSERVER_EXTENDED_TOP_N")
+
+	assert.Equal(t,
+		"SELECT TOP (25) $action, ${SQLSERVER_EXTENDED_UNSET}",
+		expandEnv("SELECT TOP (${SQLSERVER_EXTENDED_TOP_N}) $action, ${SQLSERVER_EXTENDED_UNSET}"))
+}
@@ -0,0 +1,240 @@
+package sqlserver_extended
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sqlTime is a time passed to query templates, printed in the ISO 8601
+// format understood by the datetime types of SQL Server
+type sqlTime struct {
+	time.Time
+}
+
+func (t sqlTime) String() string {
+	return t.Format("2006-01-02T15:04:05.000")
+}
+
+// timeLiteral returns the time as SQL literal with the full precision of
+// datetime2, so rows within the same millisecond as the watermark are not
+// read again. Times of datetimeoffset columns keep their offset.
+func timeLiteral(t time.Time) string {
+	if t.Location() == time.UTC {
+		return "CAST('" + t.Format("2006-01-02T15:04:05.0000000") + "' AS datetime2(7))"
+	}
+	return "CAST('" + t.Format("2006-01-02T15:04:05.0000000-07:00") + "' AS datetimeoffset(7))"
+}
+
+// queryState is the state of a query on a server kept across runs
+type queryState struct {
+	LastGather time.Time `json:"last_gather"`
+	Watermark  string    `json:"watermark,omitempty"`
+}
+
+// gatherState keeps the state of every query per server, optionally saved
+// to a file to survive restarts. Servers are identified by the server and
+// database of the connection string to keep credentials out of the file.
+type gatherState struct {
+	sync.Mutex
+	started time.Time
+	servers map[string]map[string]*queryState
+	changed bool
+}
+
+func newGatherState() *gatherState {
+	return &gatherState{
+		started: time.Now(),
+		servers: make(map[string]map[string]*queryState),
+	}
+}
+
+// stateKey identifies the server of the connection string in the state
+func stateKey(server string) string {
+	params := parseConnectionString(server)
+	if database := databaseName(params); database != "" {
+		return serverName(params) + "/" + database
+	}
+	return serverName(params)
+}
+
+// query returns the state of the query on the server, the caller must hold
+// the lock
+func (g *gatherState) query(server, query string) *queryState {
+	key := stateKey(server)
+	if g.servers[key] == nil {
+		g.servers[key] = make(map[string]*queryState)
+	}
+	state, ok := g.servers[key][query]
+	if !ok {
+		state = &queryState{}
+		g.servers[key][query] = state
+	}
+	return state
+}
+
+// lastGather returns the start time of the last successful run of the query
+// on the server, or the start of the plugin if there was none
+func (g *gatherState) lastGather(server, query string) time.Time {
+	g.Lock()
+	defer g.Unlock()
+	if t := g.query(server, query).LastGather; !t.IsZero() {
+		return t
+	}
+	return g.started
+}
+
+func (g *gatherState) setLastGather(server, query string, t time.Time) {
+	g.Lock()
+	defer g.Unlock()
+	g.query(server, query).LastGather = t
+	g.changed = true
+}
+
+// watermark returns the highest value of the watermark column read by the
+// query on the server as SQL literal, empty if there is none yet
+func (g *gatherState) watermark(server, query string) string {
+	g.Lock()
+	defer g.Unlock()
+	return g.query(server, query).Watermark
+}
+
+func (g *gatherState) setWatermark(server, query, watermark string) {
+	g.Lock()
+	defer g.Unlock()
+	g.query(server, query).Watermark = watermark
+	g.changed = true
+}
+
+// load reads the state saved to the file, a missing file is not an error
+func (g *gatherState) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading state file failed: %v", err)
+	}
+
+	g.Lock()
+	defer g.Unlock()
+	if err := json.Unmarshal(data, &g.servers); err != nil {
+		return fmt.Errorf("parsing state file %q failed: %v", path, err)
+	}
+	return nil
+}
+
+// save writes the state to the file if it changed since the last save, the
+// file is replaced atomically
+func (g *gatherState) save(path string) error {
+	g.Lock()
+	defer g.Unlock()
+	if !g.changed {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(g.servers, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("writing state file failed: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing state file failed: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing state file failed: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("writing state file failed: %v", err)
+	}
+	g.changed = false
+	return nil
+}
+
+// watermarkTracker records the highest value of the watermark column of a
+// query run
+type watermarkTracker struct {
+	sync.Mutex
+	max interface{}
+}
+
+// decimalWatermark is a DECIMAL, NUMERIC or MONEY value, which the driver
+// returns as text, compared by its numeric value
+type decimalWatermark struct {
+	text  string
+	value *big.Rat
+}
+
+// observe records the value of the column of the given database type if it
+// is higher than the ones seen before, NULL values and values of unsupported
+// types are ignored
+func (w *watermarkTracker) observe(value interface{}, dbType string) {
+	w.Lock()
+	defer w.Unlock()
+	switch dbType {
+	case "DECIMAL", "NUMERIC", "MONEY", "SMALLMONEY":
+		b, ok := value.([]byte)
+		if !ok {
+			return
+		}
+		v, ok := new(big.Rat).SetString(string(b))
+		if !ok {
+			return
+		}
+		if current, ok := w.max.(decimalWatermark); !ok || v.Cmp(current.value) > 0 {
+			w.max = decimalWatermark{text: string(b), value: v}
+		}
+		return
+	}
+	switch v := value.(type) {
+	case int64:
+		if current, ok := w.max.(int64); !ok || v > current {
+			w.max = v
+		}
+	case time.Time:
+		if current, ok := w.max.(time.Time); !ok || v.After(current) {
+			w.max = v
+		}
+	case []byte:
+		if current, ok := w.max.([]byte); !ok || bytes.Compare(v, current) > 0 {
+			w.max = append([]byte(nil), v...)
+		}
+	case string:
+		if current, ok := w.max.(string); !ok || v > current {
+			w.max = v
+		}
+	}
+}
+
+// literal returns the highest value as SQL literal, empty if none was seen
+func (w *watermarkTracker) literal() string {
+	w.Lock()
+	defer w.Unlock()
+	switch v := w.max.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case time.Time:
+		return timeLiteral(v)
+	case decimalWatermark:
+		return v.text
+	case []byte:
+		return "0x" + strings.ToUpper(hex.EncodeToString(v))
+	case string:
+		return "N'" + strings.Replace(v, "'", "''", -1) + "'"
+	}
+	return ""
+}
@@ -0,0 +1,119 @@
+package sqlserver_extended
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatermarkTracker(t *testing.T) {
+	var w watermarkTracker
+	assert.Equal(t, "", w.literal())
+
+	w.observe(nil, "")
+	w.observe([]byte{0, 0, 0, 0, 0, 0, 0x07, 0xD1}, "")
+	w.observe([]byte{0, 0, 0, 0, 0, 0, 0x0A, 0x01}, "")
+	w.observe([]byte{0, 0, 0, 0, 0, 0, 0x03, 0xFF}, "")
+	assert.Equal(t, "0x0000000000000A01", w.literal())
+
+	w = watermarkTracker{}
+	w.observe(int64(10), "")
+	w.observe(int64(42), "")
+	assert.Equal(t, "42", w.literal())
+
+	w = watermarkTracker{}
+	w.observe(time.Date(2020, 11, 17, 10, 0, 0, 0, time.UTC), "")
+	w.observe(time.Date(2020, 11, 17, 9, 0, 0, 0, time.UTC), "")
+	assert.Equal(t, "CAST('2020-11-17T10:00:00.0000000' AS datetime2(7))", w.literal())
+
+	// datetime2 values within the same millisecond stay distinct
+	w = watermarkTracker{}
+	w.observe(time.Date(2020, 11, 17, 10, 0, 0, 1234500, time.UTC), "")
+	w.observe(time.Date(2020, 11, 17, 10, 0, 0, 1234400, time.UTC), "")
+	assert.Equal(t, "CAST('2020-11-17T10:00:00.0012345' AS datetime2(7))", w.literal())
+
+	w = watermarkTracker{}
+	w.observe(time.Date(2020, 11, 17, 10, 0, 0, 100, time.FixedZone("", 3600)), "")
+	assert.Equal(t, "CAST('2020-11-17T10:00:00.0000001+01:00' AS datetimeoffset(7))", w.literal())
+
+	// decimals arrive as text and compare by their value
+	w = watermarkTracker{}
+	w.observe([]byte("9.50"), "DECIMAL")
+	w.observe([]byte("10.25"), "DECIMAL")
+	w.observe([]byte("-11"), "DECIMAL")
+	w.observe(nil, "DECIMAL")
+	assert.Equal(t, "10.25", w.literal())
+
+	w = watermarkTracker{}
+	w.observe("O'Brien", "")
+	assert.Equal(t, "N'O''Brien'", w.literal())
+}
+
+func TestStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlserver_extended")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	s := &SQLServerExtended{
+		StateFile: path,
+		Query: []QueryConfig{
+			{
+				Name:            "audit",
+				Script:          "SELECT * FROM audit {{with .Watermark}}WHERE rv > {{.}}{{end}}",
+				WatermarkColumn: "rv",
+			},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+
+	server := "Server=sql01;Database=Sales;User Id=telegraf;Password=secret;"
+	last := time.Date(2020, 11, 17, 10, 0, 0, 0, time.UTC)
+	s.state.setLastGather(server, "audit", last)
+	s.state.setWatermark(server, "audit", "0x0000000000000A01")
+	require.NoError(t, s.state.save(path))
+
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "sql01/Sales")
+	assert.NotContains(t, string(content), "secret")
+
+	// the state is restored on restart
+	require.NoError(t, s.Init())
+	assert.True(t, last.Equal(s.state.lastGather(server, "audit")))
+
+	query := s.queries["audit"]
+	data := query.templateData(server, time.Now())
+	data.Watermark = s.state.watermark(server, "audit")
+	script, err := query.render(data)
+	require.NoError(t, err)
+	assert.Equal(t, sqlPrefix+"SELECT * FROM audit WHERE rv > 0x0000000000000A01", script)
+}
+
+func TestAccRowWatermark(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	query := Query{
+		Name:            "audit",
+		WatermarkColumn: "rv",
+		OrderedColumns:  []string{"rv", "field_value"},
+		watermark:       &watermarkTracker{},
+	}
+	require.NoError(t, s.accRow(query, &acc, mockRow{int64(5), int64(1)}))
+	require.NoError(t, s.accRow(query, &acc, mockRow{int64(7), int64(2)}))
+	assert.Equal(t, "7", query.watermark.literal())
+
+	query.ColumnTypes = []string{"DECIMAL", "BIGINT"}
+	query.watermark = &watermarkTracker{}
+	require.NoError(t, s.accRow(query, &acc, mockRow{[]byte("10"), int64(1)}))
+	require.NoError(t, s.accRow(query, &acc, mockRow{[]byte("9"), int64(2)}))
+	assert.Equal(t, "10", query.watermark.literal())
+}
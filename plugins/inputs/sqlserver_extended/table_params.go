@@ -0,0 +1,61 @@
+package sqlserver_extended
+
+import (
+	"fmt"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+)
+
+// rows of the lists passed as table-valued parameters, the user defined
+// table type must have a single column of a matching type
+type (
+	tvpString struct{ Value string }
+	tvpInt    struct{ Value int64 }
+	tvpFloat  struct{ Value float64 }
+)
+
+// tableParam converts the list to a table-valued parameter of the given user
+// defined table type, all values have to be of the same type
+func tableParam(typeName string, values []interface{}) (mssql.TVP, error) {
+	if typeName == "" {
+		return mssql.TVP{}, fmt.Errorf("list requires a table type")
+	}
+	if len(values) == 0 {
+		return mssql.TVP{TypeName: typeName, Value: []tvpString{}}, nil
+	}
+
+	switch values[0].(type) {
+	case string:
+		rows := make([]tvpString, 0, len(values))
+		for _, v := range values {
+			s, ok := v.(string)
+			if !ok {
+				return mssql.TVP{}, fmt.Errorf("mixed types %T and %T in list", values[0], v)
+			}
+			rows = append(rows, tvpString{s})
+		}
+		return mssql.TVP{TypeName: typeName, Value: rows}, nil
+	case int64:
+		rows := make([]tvpInt, 0, len(values))
+		for _, v := range values {
+			i, ok := v.(int64)
+			if !ok {
+				return mssql.TVP{}, fmt.Errorf("mixed types %T and %T in list", values[0], v)
+			}
+			rows = append(rows, tvpInt{i})
+		}
+		return mssql.TVP{TypeName: typeName, Value: rows}, nil
+	case float64:
+		rows := make([]tvpFloat, 0, len(values))
+		for _, v := range values {
+			f, ok := v.(float64)
+			if !ok {
+				return mssql.TVP{}, fmt.Errorf("mixed types %T and %T in list", values[0], v)
+			}
+			rows = append(rows, tvpFloat{f})
+		}
+		return mssql.TVP{TypeName: typeName, Value: rows}, nil
+	default:
+		return mssql.TVP{}, fmt.Errorf("unsupported type %T in list", values[0])
+	}
+}
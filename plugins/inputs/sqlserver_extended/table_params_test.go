@@ -0,0 +1,38 @@
+package sqlserver_extended
+
+import (
+	"database/sql"
+	"testing"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTableParams(t *testing.T) {
+	args, err := namedArgs(map[string]interface{}{
+		"wait_types": []interface{}{"LCK_M_S", "LCK_M_X"},
+		"@ids":       []interface{}{int64(1), int64(2)},
+		"none":       []interface{}{},
+	}, map[string]string{"@wait_types": "dbo.NameList", "ids": "dbo.IdList", "none": "dbo.NameList"})
+	require.NoError(t, err)
+	require.Len(t, args, 3)
+
+	assert.Equal(t, sql.Named("ids", mssql.TVP{TypeName: "dbo.IdList", Value: []tvpInt{{1}, {2}}}), args[0])
+	assert.Equal(t, sql.Named("none", mssql.TVP{TypeName: "dbo.NameList", Value: []tvpString{}}), args[1])
+	assert.Equal(t, sql.Named("wait_types", mssql.TVP{TypeName: "dbo.NameList", Value: []tvpString{{"LCK_M_S"}, {"LCK_M_X"}}}), args[2])
+}
+
+func TestTableParamsInvalid(t *testing.T) {
+	_, err := namedArgs(map[string]interface{}{"ids": []interface{}{int64(1)}}, nil)
+	require.Error(t, err)
+
+	_, err = namedArgs(map[string]interface{}{"ids": []interface{}{int64(1), "2"}}, map[string]string{"ids": "dbo.IdList"})
+	require.Error(t, err)
+
+	_, err = namedArgs(map[string]interface{}{"ids": []interface{}{true}}, map[string]string{"ids": "dbo.IdList"})
+	require.Error(t, err)
+
+	_, err = namedArgs(nil, map[string]string{"ids": "dbo.IdList"})
+	require.Error(t, err)
+}
@@ -0,0 +1,5 @@
+SELECT
+	'waits' AS measurement,
+	wait_type,
+	wait_time_ms AS field_wait_time_ms
+FROM sys.dm_os_wait_stats
@@ -0,0 +1,112 @@
+package sqlserver_extended
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Protocols of the server, as given by the "np:", "lpc:" and "tcp:" prefixes
+// of the server name or the protocol of the server table
+const (
+	protocolTCP          = "tcp"
+	protocolNamedPipes   = "np"
+	protocolSharedMemory = "lpc"
+)
+
+// pipeHost is the server name the driver is pointed to for connections over
+// named pipes, the connector dials the pipe instead of the TCP address
+const pipeHost = "127.0.0.1"
+
+// transport is the named pipe or LocalDB instance a server is connected to,
+// both are empty for TCP connections
+type transport struct {
+	pipe    string
+	localDB string
+}
+
+// parseTransport splits the protocol prefix or the LocalDB marker off the
+// server name and returns the transport and the server name left for TCP
+func parseTransport(server string) (transport, string, error) {
+	if parts := strings.SplitN(server, `\`, 2); len(parts) == 2 && strings.EqualFold(parts[0], "(localdb)") {
+		if parts[1] == "" {
+			return transport{}, "", fmt.Errorf("missing LocalDB instance in %q", server)
+		}
+		return transport{localDB: parts[1]}, "", nil
+	}
+
+	i := strings.Index(server, ":")
+	if i < 0 {
+		return transport{}, server, nil
+	}
+	protocol, name := strings.ToLower(server[:i]), server[i+1:]
+	switch protocol {
+	case protocolTCP:
+		return transport{}, name, nil
+	case protocolNamedPipes:
+		if strings.HasPrefix(name, `\\`) {
+			return transport{pipe: name}, "", nil
+		}
+		host, instance := splitInstance(name)
+		if isLocalHost(host) {
+			host = "."
+		}
+		return transport{pipe: pipePath(host, instance)}, "", nil
+	case protocolSharedMemory:
+		// shared memory is not implemented by the driver, the local named
+		// pipe of the instance is used instead
+		host, instance := splitInstance(name)
+		if !isLocalHost(host) {
+			return transport{}, "", fmt.Errorf("shared memory requires a local server, not %q", host)
+		}
+		return transport{pipe: pipePath(".", instance)}, "", nil
+	}
+	// anything else is part of the server name, e.g. of an IPv6 address
+	return transport{}, server, nil
+}
+
+// hostname returns the host of the pipe, as verified against the server
+// certificate
+func (t transport) hostname() string {
+	if t.localDB != "" {
+		return "localhost"
+	}
+	host, _ := splitInstance(strings.TrimPrefix(t.pipe, `\\`))
+	if host == "." {
+		return "localhost"
+	}
+	return host
+}
+
+// splitInstance splits a server name into its host and instance
+func splitInstance(server string) (string, string) {
+	parts := strings.SplitN(server, `\`, 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// isLocalHost reports whether the host names the local machine
+func isLocalHost(host string) bool {
+	return host == "" || host == "." || strings.EqualFold(host, "(local)") || strings.EqualFold(host, "localhost")
+}
+
+// pipePath returns the default pipe of the instance on the host
+func pipePath(host, instance string) string {
+	if instance == "" || strings.EqualFold(instance, "MSSQLSERVER") {
+		return `\\` + host + `\pipe\sql\query`
+	}
+	return `\\` + host + `\pipe\MSSQL$` + instance + `\sql\query`
+}
+
+// parseLocalDBPipe returns the pipe from the output of "SqlLocalDB info",
+// empty if the instance is not running
+func parseLocalDBPipe(info string) string {
+	for _, line := range strings.Split(info, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 && strings.EqualFold(strings.TrimSpace(parts[0]), "Instance pipe name") {
+			return strings.TrimPrefix(strings.TrimSpace(parts[1]), "np:")
+		}
+	}
+	return ""
+}
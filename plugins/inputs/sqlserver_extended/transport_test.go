@@ -0,0 +1,66 @@
+package sqlserver_extended
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTransport(t *testing.T) {
+	tests := []struct {
+		server    string
+		transport transport
+		host      string
+	}{
+		{server: "sql01", host: "sql01"},
+		{server: `sql01\INST1`, host: `sql01\INST1`},
+		{server: "tcp:sql01", host: "sql01"},
+		{server: "fe80::1", host: "fe80::1"},
+		{server: "np:sql01", transport: transport{pipe: `\\sql01\pipe\sql\query`}},
+		{server: `np:sql01\INST1`, transport: transport{pipe: `\\sql01\pipe\MSSQL$INST1\sql\query`}},
+		{server: `np:(local)`, transport: transport{pipe: `\\.\pipe\sql\query`}},
+		{server: `np:\\sql01\pipe\custom`, transport: transport{pipe: `\\sql01\pipe\custom`}},
+		{server: `lpc:.\SQLEXPRESS`, transport: transport{pipe: `\\.\pipe\MSSQL$SQLEXPRESS\sql\query`}},
+		{server: "LPC:localhost", transport: transport{pipe: `\\.\pipe\sql\query`}},
+		{server: `(localdb)\MSSQLLocalDB`, transport: transport{localDB: "MSSQLLocalDB"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.server, func(t *testing.T) {
+			tr, host, err := parseTransport(tt.server)
+			require.NoError(t, err)
+			assert.Equal(t, tt.transport, tr)
+			assert.Equal(t, tt.host, host)
+		})
+	}
+
+	_, _, err := parseTransport("lpc:sql01")
+	require.Error(t, err)
+	_, _, err = parseTransport(`(localdb)\`)
+	require.Error(t, err)
+}
+
+func TestTransportHostname(t *testing.T) {
+	assert.Equal(t, "sql01", transport{pipe: `\\sql01\pipe\sql\query`}.hostname())
+	assert.Equal(t, "localhost", transport{pipe: `\\.\pipe\sql\query`}.hostname())
+	assert.Equal(t, "localhost", transport{localDB: "MSSQLLocalDB"}.hostname())
+}
+
+func TestParseLocalDBPipe(t *testing.T) {
+	info := "Name:               MSSQLLocalDB\r\n" +
+		"Version:            15.0.4153.1\r\n" +
+		"State:              Running\r\n" +
+		`Instance pipe name: np:\\.\pipe\LOCALDB#5E4F2C1B\tsql\query` + "\r\n"
+	assert.Equal(t, `\\.\pipe\LOCALDB#5E4F2C1B\tsql\query`, parseLocalDBPipe(info))
+	assert.Equal(t, "", parseLocalDBPipe("State:              Stopped\r\nInstance pipe name: \r\n"))
+}
+
+func TestConnectionPoolPipe(t *testing.T) {
+	pools := newConnectionPools(0, nil, 0, 0)
+	defer pools.close()
+
+	_, err := pools.get(`Server=np:sql01\INST1;User Id=telegraf`)
+	require.NoError(t, err)
+	_, err = pools.get(dacServer(`Server=np:sql01;User Id=telegraf`))
+	require.Error(t, err)
+}
@@ -0,0 +1,37 @@
+package sqlserver_extended
+
+import (
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// truncate returns the string cut to the given number of characters
+func truncate(s string, length int) string {
+	if len(s) <= length {
+		return s
+	}
+	count := 0
+	for i := range s {
+		if count == length {
+			return s[:i]
+		}
+		count++
+	}
+	return s
+}
+
+// truncatingAccumulator truncates the string fields to max_field_length
+type truncatingAccumulator struct {
+	telegraf.Accumulator
+	length int
+}
+
+func (a *truncatingAccumulator) AddFields(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	for k, v := range fields {
+		if s, ok := v.(string); ok {
+			fields[k] = truncate(s, a.length)
+		}
+	}
+	a.Accumulator.AddFields(measurement, fields, tags, t...)
+}
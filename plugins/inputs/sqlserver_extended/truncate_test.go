@@ -0,0 +1,48 @@
+package sqlserver_extended
+
+import (
+	"testing"
+
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTruncate(t *testing.T) {
+	assert.Equal(t, "SELECT", truncate("SELECT * FROM sys.objects", 6))
+	assert.Equal(t, "short", truncate("short", 6))
+	assert.Equal(t, "Größe", truncate("Größe der Datei", 5))
+	assert.Equal(t, "Größe", truncate("Größe", 5))
+}
+
+func TestAccResultsMaxFieldLength(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	columns, err := newColumnRoles(nil, []string{"statement", "cpu"}, "", "")
+	require.NoError(t, err)
+	rows := &mockResults{sets: []mockResultSet{{
+		columns: []string{"measurement", "session", "statement", "cpu"},
+		rows:    []mockRow{{"requests", "51", "SELECT * FROM sys.objects", int64(10)}},
+	}}}
+	_, err = s.accResults(Query{Name: "requests", Columns: columns, MaxFieldLength: 8}, &acc, rows)
+	require.NoError(t, err)
+	acc.AssertContainsTaggedFields(t, "requests",
+		map[string]interface{}{"statement": "SELECT *", "cpu": int64(10)},
+		map[string]string{"session": "51", "query_name": "requests"})
+}
+
+func TestMaxFieldLengthOverride(t *testing.T) {
+	s := &SQLServerExtended{
+		MaxFieldLength: 100,
+		Query: []QueryConfig{
+			{Name: "default", Script: "SELECT 1"},
+			{Name: "short", Script: "SELECT 2", MaxFieldLength: 10},
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, s.Init())
+	defer s.Stop()
+	assert.Equal(t, 100, s.queries["default"].MaxFieldLength)
+	assert.Equal(t, 10, s.queries["short"].MaxFieldLength)
+}
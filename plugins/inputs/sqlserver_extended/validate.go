@@ -0,0 +1,112 @@
+package sqlserver_extended
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+)
+
+// validationTimeout bounds the validation of the queries on a server when
+// no query_timeout is configured
+const validationTimeout = 10 * time.Second
+
+// validateQueries parses the queries on every reachable server without
+// executing them. Syntax errors are returned, servers which cannot be
+// reached are skipped with a warning.
+func (s *SQLServerExtended) validateQueries() error {
+	names := make([]string, 0, len(s.queries))
+	for name := range s.queries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, server := range s.servers {
+		if err := s.validateServer(server, names); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLServerExtended) validateServer(server string, names []string) error {
+	timeout := s.QueryTimeout.Duration
+	if timeout <= 0 {
+		timeout = validationTimeout
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	defer cancel()
+
+	db, err := s.pools.get(server)
+	if err != nil {
+		return err
+	}
+
+	info, err := detectServerInfo(ctx, db)
+	if err != nil {
+		s.Log.Warnf("Skipping validation of the queries on server %q: %v", serverName(parseConnectionString(server)), err)
+		return nil
+	}
+
+	// PARSEONLY is a session setting, keep all statements on one connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		s.Log.Warnf("Skipping validation of the queries on server %q: %v", serverName(parseConnectionString(server)), err)
+		return nil
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SET PARSEONLY ON"); err != nil {
+		return fmt.Errorf("enabling PARSEONLY failed: %v", err)
+	}
+	for _, name := range names {
+		query := s.queries[name]
+		if query.needsServerInfo() && !query.supports(info) {
+			continue
+		}
+
+		script, err := query.render(query.templateData(server, time.Now()))
+		if err != nil {
+			return fmt.Errorf("query %q: rendering script failed: %v", name, err)
+		}
+		// parameters are declared instead of being bound, the driver would
+		// otherwise wrap the script in sp_executesql which is not parsed
+		if _, err := conn.ExecContext(ctx, parameterDeclarations(query.Args)+script); err != nil {
+			return fmt.Errorf("query %q: validation failed: %v", name, err)
+		}
+	}
+	_, err = conn.ExecContext(ctx, "SET PARSEONLY OFF")
+	return err
+}
+
+// parameterDeclarations returns DECLARE statements for the named parameters
+// of a query typed after their values
+func parameterDeclarations(args []interface{}) string {
+	var buf strings.Builder
+	for _, arg := range args {
+		named, ok := arg.(sql.NamedArg)
+		if !ok {
+			continue
+		}
+
+		var typ string
+		switch v := named.Value.(type) {
+		case int64:
+			typ = "bigint"
+		case float64:
+			typ = "float"
+		case bool:
+			typ = "bit"
+		case mssql.TVP:
+			typ = v.TypeName
+		default:
+			typ = "nvarchar(4000)"
+		}
+		fmt.Fprintf(&buf, "DECLARE @%s %s;\n", named.Name, typ)
+	}
+	return buf.String()
+}
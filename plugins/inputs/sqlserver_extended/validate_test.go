@@ -0,0 +1,24 @@
+package sqlserver_extended
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParameterDeclarations(t *testing.T) {
+	args, err := namedArgs(map[string]interface{}{
+		"top_n":  int64(20),
+		"ratio":  0.5,
+		"login":  "sa",
+		"active": true,
+		"dbs":    []interface{}{"db1"},
+	}, map[string]string{"dbs": "dbo.NameList"})
+	require.NoError(t, err)
+	assert.Equal(t, "DECLARE @active bit;\n"+
+		"DECLARE @dbs dbo.NameList;\n"+
+		"DECLARE @login nvarchar(4000);\n"+
+		"DECLARE @ratio float;\n"+
+		"DECLARE @top_n bigint;\n", parameterDeclarations(args))
+}
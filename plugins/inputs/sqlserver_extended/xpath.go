@@ -0,0 +1,438 @@
+package sqlserver_extended
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// XPathConfig extracts fields and tags from the XML documents of a column,
+// e.g. of deadlock graphs, showplans or extended event payloads
+type XPathConfig struct {
+	Column string            `toml:"column"`
+	Fields map[string]string `toml:"fields"`
+	Tags   map[string]string `toml:"tags"`
+}
+
+// xpathColumn holds the compiled expressions of a column
+type xpathColumn struct {
+	column string
+	fields map[string]*xpathExpr
+	tags   map[string]*xpathExpr
+}
+
+func newXPathColumn(cfg XPathConfig) (xpathColumn, error) {
+	c := xpathColumn{
+		column: cfg.Column,
+		fields: make(map[string]*xpathExpr, len(cfg.Fields)),
+		tags:   make(map[string]*xpathExpr, len(cfg.Tags)),
+	}
+	if cfg.Column == "" {
+		return c, fmt.Errorf("xpath column must not be empty")
+	}
+	for name, expr := range cfg.Fields {
+		compiled, err := compileXPath(expr)
+		if err != nil {
+			return c, fmt.Errorf("xpath of field %q: %v", name, err)
+		}
+		c.fields[name] = compiled
+	}
+	for name, expr := range cfg.Tags {
+		compiled, err := compileXPath(expr)
+		if err != nil {
+			return c, fmt.Errorf("xpath of tag %q: %v", name, err)
+		}
+		c.tags[name] = compiled
+	}
+	return c, nil
+}
+
+// xpathColumn returns the expressions of the column, nil if it holds no XML
+// documents to extract values from
+func (q *Query) xpathColumn(column string) *xpathColumn {
+	for i := range q.XPaths {
+		if q.XPaths[i].column == column {
+			return &q.XPaths[i]
+		}
+	}
+	return nil
+}
+
+// extract adds the values selected from the XML document to the fields and
+// tags. Numeric field values are collected as floats, expressions matching
+// nothing are left out.
+func (c *xpathColumn) extract(value interface{}, fields map[string]interface{}, tags map[string]string) error {
+	var document string
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		document = v
+	case []byte:
+		document = string(v)
+	default:
+		return fmt.Errorf("expected an XML document but got %T", value)
+	}
+
+	root, err := parseXML(document)
+	if err != nil {
+		return fmt.Errorf("parsing XML failed: %v", err)
+	}
+	for name, expr := range c.fields {
+		v, ok := expr.evaluate(root)
+		if !ok {
+			continue
+		}
+		if s, isString := v.(string); isString {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+				v = f
+			}
+		}
+		fields[name] = v
+	}
+	for name, expr := range c.tags {
+		if v, ok := expr.evaluate(root); ok {
+			tags[name] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+// xmlNode is an element of a parsed XML document, the document itself is an
+// element without name
+type xmlNode struct {
+	name    string
+	attrs   map[string]string
+	content []interface{} // string or *xmlNode in document order
+}
+
+// parseXML parses the document, namespaces are ignored
+func parseXML(document string) (*xmlNode, error) {
+	root := &xmlNode{}
+	stack := []*xmlNode{root}
+	decoder := xml.NewDecoder(strings.NewReader(document))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		current := stack[len(stack)-1]
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{name: t.Name.Local, attrs: make(map[string]string, len(t.Attr))}
+			for _, attr := range t.Attr {
+				node.attrs[attr.Name.Local] = attr.Value
+			}
+			current.content = append(current.content, node)
+			stack = append(stack, node)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			current.content = append(current.content, string(t))
+		}
+	}
+	if len(stack) != 1 {
+		return nil, fmt.Errorf("unexpected end of document")
+	}
+	return root, nil
+}
+
+// text returns the string value of the node, the text of all its descendants
+func (n *xmlNode) text() string {
+	var b strings.Builder
+	for _, c := range n.content {
+		switch c := c.(type) {
+		case string:
+			b.WriteString(c)
+		case *xmlNode:
+			b.WriteString(c.text())
+		}
+	}
+	return b.String()
+}
+
+// children returns the child elements matching the name, "*" matches all
+func (n *xmlNode) children(name string) []*xmlNode {
+	var nodes []*xmlNode
+	for _, c := range n.content {
+		if child, ok := c.(*xmlNode); ok && (name == "*" || child.name == name) {
+			nodes = append(nodes, child)
+		}
+	}
+	return nodes
+}
+
+// descendantsOrSelf returns the node and all elements below it
+func (n *xmlNode) descendantsOrSelf() []*xmlNode {
+	nodes := []*xmlNode{n}
+	for _, c := range n.content {
+		if child, ok := c.(*xmlNode); ok {
+			nodes = append(nodes, child.descendantsOrSelf()...)
+		}
+	}
+	return nodes
+}
+
+// xpathExpr is a compiled expression of the supported XPath subset: location
+// paths of element names or "*" with the child and descendant axes, position,
+// last() and equality predicates on attributes or child elements, ending in
+// an element, an attribute or text(). The path may be wrapped in count().
+type xpathExpr struct {
+	steps []xpathStep
+	count bool
+}
+
+type xpathStep struct {
+	descendant bool
+	name       string // element name, "*", "@attribute" or "text()"
+	predicates []xpathPredicate
+}
+
+type xpathPredicate struct {
+	position int  // 1-based position, 0 if not a position predicate
+	last     bool // last()
+	attr     bool // name refers to an attribute instead of a child element
+	name     string
+	value    *string // nil checks the existence only
+}
+
+func compileXPath(expr string) (*xpathExpr, error) {
+	x := &xpathExpr{}
+	path := strings.TrimSpace(expr)
+	if strings.HasPrefix(path, "count(") && strings.HasSuffix(path, ")") {
+		x.count = true
+		path = strings.TrimSpace(path[len("count(") : len(path)-1])
+	}
+	if path == "" {
+		return nil, fmt.Errorf("empty expression")
+	}
+
+	for path != "" {
+		step := xpathStep{}
+		switch {
+		case strings.HasPrefix(path, "//"):
+			step.descendant = true
+			path = path[2:]
+		case strings.HasPrefix(path, "/"):
+			path = path[1:]
+		case len(x.steps) > 0:
+			return nil, fmt.Errorf("invalid expression %q", expr)
+		}
+
+		end := stepEnd(path)
+		raw := path[:end]
+		path = path[end:]
+
+		name := raw
+		if i := strings.Index(raw, "["); i >= 0 {
+			name = raw[:i]
+			var err error
+			if step.predicates, err = parsePredicates(raw[i:]); err != nil {
+				return nil, fmt.Errorf("invalid expression %q: %v", expr, err)
+			}
+		}
+		if name == "" || (name != "text()" && strings.ContainsAny(name, "()[]'\" ")) {
+			return nil, fmt.Errorf("invalid expression %q", expr)
+		}
+		if (strings.HasPrefix(name, "@") || name == "text()") && (path != "" || len(step.predicates) > 0) {
+			return nil, fmt.Errorf("invalid expression %q: %s must be the last step", expr, name)
+		}
+		step.name = name
+		x.steps = append(x.steps, step)
+	}
+	return x, nil
+}
+
+// stepEnd returns the end of the first step of the path
+func stepEnd(path string) int {
+	depth := 0
+	var quote rune
+	for i, r := range path {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '[':
+			depth++
+		case r == ']':
+			depth--
+		case r == '/' && depth == 0:
+			return i
+		}
+	}
+	return len(path)
+}
+
+func parsePredicates(raw string) ([]xpathPredicate, error) {
+	var predicates []xpathPredicate
+	for raw != "" {
+		if raw[0] != '[' {
+			return nil, fmt.Errorf("unexpected %q", raw)
+		}
+		// the closing bracket may be part of a quoted value
+		end := -1
+		var quote byte
+		for i := 1; i < len(raw) && end < 0; i++ {
+			switch {
+			case quote != 0:
+				if raw[i] == quote {
+					quote = 0
+				}
+			case raw[i] == '\'' || raw[i] == '"':
+				quote = raw[i]
+			case raw[i] == ']':
+				end = i
+			}
+		}
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated predicate")
+		}
+		p, err := parsePredicate(strings.TrimSpace(raw[1:end]))
+		if err != nil {
+			return nil, err
+		}
+		predicates = append(predicates, p)
+		raw = raw[end+1:]
+	}
+	return predicates, nil
+}
+
+func parsePredicate(raw string) (xpathPredicate, error) {
+	var p xpathPredicate
+	if raw == "last()" {
+		p.last = true
+		return p, nil
+	}
+	if n, err := strconv.Atoi(raw); err == nil {
+		if n < 1 {
+			return p, fmt.Errorf("invalid position %d", n)
+		}
+		p.position = n
+		return p, nil
+	}
+
+	name := raw
+	if i := strings.Index(raw, "="); i >= 0 {
+		name = strings.TrimSpace(raw[:i])
+		value := strings.TrimSpace(raw[i+1:])
+		if len(value) < 2 || (value[0] != '\'' && value[0] != '"') || value[len(value)-1] != value[0] {
+			return p, fmt.Errorf("invalid value %q", value)
+		}
+		value = value[1 : len(value)-1]
+		p.value = &value
+	}
+	if strings.HasPrefix(name, "@") {
+		p.attr = true
+		name = name[1:]
+	}
+	if name == "" || strings.ContainsAny(name, "()[]'\" /") {
+		return p, fmt.Errorf("unsupported predicate %q", raw)
+	}
+	p.name = name
+	return p, nil
+}
+
+// evaluate returns the value of the first node selected by the expression or
+// the number of nodes for count()
+func (x *xpathExpr) evaluate(root *xmlNode) (interface{}, bool) {
+	nodes := []*xmlNode{root}
+	for i, step := range x.steps {
+		context := nodes
+		if step.descendant {
+			// the descendants of nested nodes overlap, every node is
+			// selected once in document order
+			context = nil
+			seen := make(map[*xmlNode]bool)
+			for _, n := range nodes {
+				for _, d := range n.descendantsOrSelf() {
+					if !seen[d] {
+						seen[d] = true
+						context = append(context, d)
+					}
+				}
+			}
+		}
+
+		if i == len(x.steps)-1 && (strings.HasPrefix(step.name, "@") || step.name == "text()") {
+			var values []string
+			for _, n := range context {
+				if step.name == "text()" {
+					for _, c := range n.content {
+						if s, ok := c.(string); ok {
+							values = append(values, s)
+						}
+					}
+				} else if v, ok := n.attrs[step.name[1:]]; ok {
+					values = append(values, v)
+				}
+			}
+			if x.count {
+				return int64(len(values)), true
+			}
+			if len(values) == 0 {
+				return nil, false
+			}
+			return values[0], true
+		}
+
+		nodes = nil
+		for _, n := range context {
+			nodes = append(nodes, step.filter(n.children(step.name))...)
+		}
+	}
+
+	if x.count {
+		return int64(len(nodes)), true
+	}
+	if len(nodes) == 0 {
+		return nil, false
+	}
+	return nodes[0].text(), true
+}
+
+// filter applies the predicates of the step to the candidates of a parent
+func (s xpathStep) filter(nodes []*xmlNode) []*xmlNode {
+	for _, p := range s.predicates {
+		switch {
+		case p.last:
+			if len(nodes) > 0 {
+				nodes = nodes[len(nodes)-1:]
+			}
+		case p.position > 0:
+			if p.position > len(nodes) {
+				return nil
+			}
+			nodes = nodes[p.position-1 : p.position]
+		default:
+			var matching []*xmlNode
+			for _, n := range nodes {
+				if p.matches(n) {
+					matching = append(matching, n)
+				}
+			}
+			nodes = matching
+		}
+	}
+	return nodes
+}
+
+func (p xpathPredicate) matches(n *xmlNode) bool {
+	if p.attr {
+		v, ok := n.attrs[p.name]
+		return ok && (p.value == nil || v == *p.value)
+	}
+	for _, child := range n.children(p.name) {
+		if p.value == nil || child.text() == *p.value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package sqlserver_extended
+
+import (
+	"testing"
+
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const deadlockGraph = `<deadlock xmlns="urn:test">
+  <victim-list>
+    <victimProcess id="process1"/>
+  </victim-list>
+  <process-list>
+    <process id="process1" waittime="1200" spid="52">
+      <inputbuf>UPDATE t SET a = 1</inputbuf>
+    </process>
+    <process id="process2" waittime="300" spid="57">
+      <inputbuf>UPDATE t SET a = 2</inputbuf>
+    </process>
+  </process-list>
+</deadlock>`
+
+func TestXPath(t *testing.T) {
+	root, err := parseXML(deadlockGraph)
+	require.NoError(t, err)
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{expr: "/deadlock/victim-list/victimProcess/@id", expected: "process1"},
+		{expr: "deadlock/victim-list/victimProcess/@id", expected: "process1"},
+		{expr: "//process[2]/@spid", expected: "57"},
+		{expr: "//process[last()]/@waittime", expected: "300"},
+		{expr: "//process[@spid='57']/inputbuf", expected: "UPDATE t SET a = 2"},
+		{expr: "//process[inputbuf='UPDATE t SET a = 1']/@id", expected: "process1"},
+		{expr: "//process[1]/inputbuf/text()", expected: "UPDATE t SET a = 1"},
+		{expr: "/*/process-list/*[2]/@id", expected: "process2"},
+		{expr: "count(//process)", expected: int64(2)},
+		{expr: "count(//process/@missing)", expected: int64(0)},
+	}
+	for _, tt := range tests {
+		x, err := compileXPath(tt.expr)
+		require.NoError(t, err, tt.expr)
+		actual, ok := x.evaluate(root)
+		require.True(t, ok, tt.expr)
+		assert.Equal(t, tt.expected, actual, tt.expr)
+	}
+
+	x, err := compileXPath("//process[3]/@id")
+	require.NoError(t, err)
+	_, ok := x.evaluate(root)
+	require.False(t, ok)
+
+	for _, expr := range []string{"", "//process[", "//@id/process", "//process[@id=unquoted]", "//process[0]", "concat(a, b)"} {
+		_, err := compileXPath(expr)
+		require.Error(t, err, expr)
+	}
+}
+
+func TestXPathNestedDescendants(t *testing.T) {
+	root, err := parseXML(`<r><a id="outer"><a id="inner"><b>1</b></a></a><b>2</b></r>`)
+	require.NoError(t, err)
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{expr: "count(//a)", expected: int64(2)},
+		{expr: "count(//a//b)", expected: int64(1)},
+		{expr: "count(//a/b)", expected: int64(1)},
+		{expr: "count(//b)", expected: int64(2)},
+		{expr: "//a//a/@id", expected: "inner"},
+	}
+	for _, tt := range tests {
+		x, err := compileXPath(tt.expr)
+		require.NoError(t, err, tt.expr)
+		actual, ok := x.evaluate(root)
+		require.True(t, ok, tt.expr)
+		assert.Equal(t, tt.expected, actual, tt.expr)
+	}
+}
+
+func TestAccRowXPath(t *testing.T) {
+	var acc testutil.Accumulator
+	s := &SQLServerExtended{}
+
+	xpath, err := newXPathColumn(XPathConfig{
+		Column: "graph",
+		Fields: map[string]string{"processes": "count(//process)", "wait_ms": "//process[1]/@waittime", "statement": "//process[1]/inputbuf"},
+		Tags:   map[string]string{"victim": "//victimProcess/@id"},
+	})
+	require.NoError(t, err)
+	query := Query{
+		Name:           "deadlocks",
+		XPaths:         []xpathColumn{xpath},
+		OrderedColumns: []string{"measurement", "graph"},
+	}
+	require.NoError(t, s.accRow(query, &acc, mockRow{"deadlocks", deadlockGraph}))
+	acc.AssertContainsTaggedFields(t, "deadlocks",
+		map[string]interface{}{"processes": int64(2), "wait_ms": float64(1200), "statement": "UPDATE t SET a = 1"},
+		map[string]string{"victim": "process1", "query_name": "deadlocks"})
+
+	require.Error(t, s.accRow(query, &acc, mockRow{"deadlocks", "<deadlock>"}))
+}